@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bitmark-inc/bitmark-sdk-go/account"
+	"github.com/bitmark-inc/bitmark-sdk-go/asset"
+	"github.com/bitmark-inc/ct-match/event"
+	"github.com/bitmark-inc/ct-match/ledger"
+	"github.com/bitmark-inc/ct-match/store"
+)
+
+// grantAccess lets recipient decrypt the health data of a consent once it
+// accepts the transfer of the health data bitmark
+func grantAccess(st *store.Store, acc account.Account, emit func(event.Event), c *Consent, recipient string) error {
+	if err := st.Grant(acc, c.HealthDataAssetID, recipient); err != nil {
+		return fmt.Errorf("grant access to health data %s: %s", c.HealthData, err)
+	}
+	emit(event.Event{
+		Type:         event.AccessGranted,
+		Counterparty: recipient,
+		Participant:  c.Participant,
+		Kind:         event.KindHealthData,
+		AssetID:      c.HealthDataAssetID,
+		Asset:        c.HealthData,
+		BitmarkID:    c.HealthDataID,
+		ConsentID:    c.ID,
+		TrialID:      c.TrialID,
+		Trial:        c.Trial,
+	})
+	return nil
+}
+
+// readHealthData decrypts the health data of a consent held by acc
+func readHealthData(st *store.Store, acc account.Account, emit func(event.Event), c *Consent) ([]byte, error) {
+	content, err := st.Read(acc, c.HealthDataID)
+	if err != nil {
+		return nil, fmt.Errorf("read health data %s: %s", c.HealthData, err)
+	}
+	emit(event.Event{
+		Type:        event.HealthDataRead,
+		Participant: c.Participant,
+		Kind:        event.KindHealthData,
+		AssetID:     c.HealthDataAssetID,
+		Asset:       c.HealthData,
+		BitmarkID:   c.HealthDataID,
+		ConsentID:   c.ID,
+		TrialID:     c.TrialID,
+		Trial:       c.Trial,
+	})
+	return content, nil
+}
+
+// verifyHealthData reads the health data of a consent held by acc and
+// compares it with the fingerprint registered for its asset. Intact health
+// data is parsed into the profile it describes. Health data that does not
+// match is returned to the participant, and the consent is disposed of as
+// disposal says.
+func verifyHealthData(l ledger.Ledger, st *store.Store, acc account.Account, emit func(event.Event), c *Consent, disposal, trashBin string) (Profile, bool, error) {
+	content, err := readHealthData(st, acc, emit, c)
+	if err != nil {
+		return Profile{}, false, err
+	}
+	a, err := l.GetAsset(c.HealthDataAssetID)
+	if err != nil {
+		return Profile{}, false, err
+	}
+	computed, err := fingerprint(content)
+	if err != nil {
+		return Profile{}, false, err
+	}
+	if computed == a.Fingerprint {
+		profile, err := profileFromHealthRecord(content, time.Now().UTC())
+		if err != nil {
+			return Profile{}, false, fmt.Errorf("parse health data %s: %s", c.HealthData, err)
+		}
+		return profile, true, nil
+	}
+
+	tampered := event.Event{
+		Type:         event.TamperedHealthData,
+		Counterparty: c.Participant,
+		Participant:  c.Participant,
+		Kind:         event.KindHealthData,
+		AssetID:      c.HealthDataAssetID,
+		Asset:        c.HealthData,
+		BitmarkID:    c.HealthDataID,
+		ConsentID:    c.ID,
+		TrialID:      c.TrialID,
+		Trial:        c.Trial,
+		Reason:       "content does not match the fingerprint of the asset",
+	}
+	emit(tampered)
+
+	if _, err := l.Transfer(acc, c.HealthDataID, c.Participant); err != nil {
+		return Profile{}, false, err
+	}
+	returned := tampered
+	returned.Type = event.HealthDataReturned
+	returned.Reason = "tampered"
+	emit(returned)
+
+	return Profile{}, false, disposeConsent(l, acc, emit, c, disposal, trashBin, "health data was tampered with")
+}
+
+// fingerprint computes the fingerprint the SDK registers for content
+func fingerprint(content []byte) (string, error) {
+	params := &asset.RegistrationParams{}
+	if err := params.SetFingerprintFromData(content); err != nil {
+		return "", err
+	}
+	return params.Fingerprint, nil
+}
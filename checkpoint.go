@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/bitmark-inc/bitmark-sdk-go/account"
+	"github.com/bitmark-inc/ct-match/event"
+	"github.com/bitmark-inc/ct-match/ledger"
+	"github.com/bitmark-inc/ct-match/store"
+)
+
+// RunIDKey is the metadata key tagging every asset with the run that registered it
+const RunIDKey = "Run ID"
+
+// Run records how a simulation was started
+type Run struct {
+	ID         string `json:"id"`
+	ConfigFile string `json:"config_file"`
+	Ledger     string `json:"ledger"`
+	Seed       *int64 `json:"seed,omitempty"`
+}
+
+// Checkpoint is the state of a simulation after its last completed tick
+type Checkpoint struct {
+	Run
+
+	Tick         int                       `json:"tick"`
+	Trials       []*Trial                  `json:"trials"`
+	Consents     []*Consent                `json:"consents"`
+	Participants []ParticipantState        `json:"participants"`
+	Funnel       *funnel                   `json:"funnel"`
+	Custody      *custody                  `json:"custody,omitempty"`
+	Store        *store.Store              `json:"store,omitempty"`   // encrypted health data and access grants
+	Scripts      map[string]map[string]int `json:"scripts,omitempty"` // decision point -> actor -> next scripted answer
+
+	// The in-memory ledger is lost with the process so it is saved as well
+	LedgerState *ledger.MemoryLedger `json:"ledger_state,omitempty"`
+}
+
+// newRunID draws a run id apart from the seeded random decisions
+func newRunID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+type ParticipantState struct {
+	Seed        string      `json:"seed"`
+	Profile     Profile     `json:"profile"`
+	Preferences Preferences `json:"preferences"`
+}
+
+// SaveCheckpoints makes the simulator write a checkpoint to fileName after every tick
+func (s *Simulator) SaveCheckpoints(fileName string, run Run) {
+	s.checkpointFile = fileName
+	s.run = run
+}
+
+// Restore makes the simulator continue from a checkpoint
+func (s *Simulator) Restore(cp *Checkpoint) {
+	cp.Funnel.conf = s.conf
+	s.funnel = cp.Funnel
+	if cp.Custody != nil {
+		s.custody = cp.Custody
+	}
+	if cp.Store != nil {
+		cp.Store.SetLedger(s.ledger)
+		s.store = cp.Store
+	}
+	s.tick = cp.Tick
+	s.trials = cp.Trials
+	s.consents = cp.Consents
+	s.restored = cp
+}
+
+func (s *Simulator) checkpoint() *Checkpoint {
+	cp := &Checkpoint{
+		Run:      s.run,
+		Tick:     s.tick,
+		Trials:   s.trials,
+		Consents: s.consents,
+		Funnel:   s.funnel,
+		Custody:  s.custody,
+		Store:    s.store,
+		Scripts:  s.policies.scriptPositions(),
+	}
+
+	for _, pp := range s.participants {
+		cp.Participants = append(cp.Participants, ParticipantState{
+			Seed:        pp.Account.Seed(),
+			Profile:     pp.Profile,
+			Preferences: pp.Preferences,
+		})
+	}
+
+	if l, ok := s.ledger.(*ledger.MemoryLedger); ok {
+		cp.LedgerState = l
+	}
+
+	return cp
+}
+
+func (s *Simulator) saveCheckpoint() error {
+	if s.checkpointFile == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(s.checkpoint())
+	if err != nil {
+		return err
+	}
+
+	// Replace the previous checkpoint only once the new one is complete
+	tmpFile := s.checkpointFile + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, s.checkpointFile)
+}
+
+// restoreRoles recreates the roles of a checkpoint. Sponsors and matching
+// services come from the configuration, participants from the checkpoint.
+func (s *Simulator) restoreRoles(cp *Checkpoint, events event.Sink) error {
+	for i, account := range s.conf.Sponsors.Accounts {
+		ss, err := newSponsor(i, account.Identity, account.Seed, s.conf.Sponsors, s.ledger, events)
+		if err != nil {
+			return err
+		}
+		s.sponsors = append(s.sponsors, ss)
+	}
+
+	for _, state := range cp.Participants {
+		acc, err := account.FromSeed(state.Seed)
+		if err != nil {
+			return err
+		}
+		pp := newParticipantWithAccount(acc, s.conf.Participants, s.ledger, events)
+		pp.Profile = state.Profile
+		pp.Preferences = state.Preferences
+		s.participants = append(s.participants, pp)
+	}
+
+	for _, account := range s.conf.MatchingService.Accounts {
+		m, err := newMatchingService(account.Identity, account.Seed, s.conf.MatchingService, s.ledger, events)
+		if err != nil {
+			return err
+		}
+
+		m.Participants = s.participants
+		s.matchingServices = append(s.matchingServices, m)
+	}
+
+	return nil
+}
+
+func loadCheckpoint(fileName string) (*Checkpoint, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	var cp Checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, err
+	}
+	if cp.Funnel == nil {
+		return nil, fmt.Errorf("%s is not a checkpoint", fileName)
+	}
+	return &cp, nil
+}
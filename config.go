@@ -1,8 +1,10 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 
 	"github.com/hashicorp/hcl"
 )
@@ -20,30 +22,145 @@ type MatchingServiceConf struct {
 	MatchProb             float64   `hcl:"match_prob"`
 	MatchDataApprovalProb float64   `hcl:"match_data_approval_prob"`
 	TrashBinAccount       string    `hcl:"trashBinAccount"`
+	Matching              string    `hcl:"matching"`         // probability or eligibility
+	ConsentDisposal       string    `hcl:"consent_disposal"` // of rejected consents: DisposalBurn (default), DisposalReturn or DisposalKeep
 }
 
 type SponsorsConf struct {
-	Accounts           []Account `hcl:"accounts"`
-	DataApprovalProb   float64   `hcl:"sponsor_data_approval_prob"`
-	TrialPerSponsorMin int       `hcl:"trials_per_sponsor_min"`
-	TrialPerSponsorMax int       `hcl:"trials_per_sponsor_max"`
-	StudiesPool        []string  `hcl:"studies_pool"`
+	Accounts           []Account       `hcl:"accounts"`
+	DataApprovalProb   float64         `hcl:"sponsor_data_approval_prob"`
+	TrialPerSponsorMin int             `hcl:"trials_per_sponsor_min"`
+	TrialPerSponsorMax int             `hcl:"trials_per_sponsor_max"`
+	StudiesPool        []string        `hcl:"studies_pool"`
+	StudiesDir         string          `hcl:"studies_dir"` // ClinicalTrials.gov exports, relative to the configuration file, used instead of studies_pool
+	Eligibility        []StudyCriteria `hcl:"eligibility"`
+	WithdrawnData      string          `hcl:"withdrawn_data"` // WithdrawnDataReturn (default) or WithdrawnDataDispose
+	IgnoreOfferProb    float64         `hcl:"sponsor_ignore_offer_prob"`
+	TrashBinAccount    string          `hcl:"trashBinAccount"`   // defaults to the one of the matching services
+	ConsentDisposal    string          `hcl:"consent_disposal"`  // of rejected consents: DisposalBurn (default), DisposalReturn or DisposalKeep
+	EnrollmentTarget   int             `hcl:"enrollment_target"` // participants every trial enrolls, 0 for the target of its study or no limit
+	WaitlistSize       int             `hcl:"waitlist_size"`     // a full trial closes once its waitlist is this long, 0 for no limit
+}
+
+// OffersConf are how long two-signature offers stay valid, in seconds (0
+// for ever), and what happens to a consent once its offer expired
+type OffersConf struct {
+	InviteTTL        int    `hcl:"invite_ttl"`         // consent offered to the participant
+	SponsorReviewTTL int    `hcl:"sponsor_review_ttl"` // health data and consent offered to the sponsor
+	EnrolmentTTL     int    `hcl:"enrolment_ttl"`      // consent offered back to the participant
+	OnExpiry         string `hcl:"on_expiry"`          // OnExpiryReoffer (default), OnExpiryReturn or OnExpiryBurn
+}
+
+// StudyCriteria are the eligibility criteria of a study of the pool
+type StudyCriteria struct {
+	Study    string `hcl:"study"`
+	Criteria `hcl:",squash"`
 }
 
 type ParticipantsConf struct {
-	ParticipantNum        int     `hcl:"participant_num"`
-	AcceptMatchProb       float64 `hcl:"participant_accept_match_prob"`
-	SubmitDataProb        float64 `hcl:"participant_submit_data_prob"`
-	AcceptTrialInviteProb float64 `hcl:"participant_accept_trial_invite_prob"`
+	ParticipantNum        int             `hcl:"participant_num"`
+	AcceptMatchProb       float64         `hcl:"participant_accept_match_prob"`
+	SubmitDataProb        float64         `hcl:"participant_submit_data_prob"`
+	AcceptTrialInviteProb float64         `hcl:"participant_accept_trial_invite_prob"`
+	WithdrawProb          float64         `hcl:"participant_withdraw_prob"`
+	WithdrawTo            string          `hcl:"withdraw_to"` // WithdrawToSponsor (default) or WithdrawToTrashBin
+	IgnoreOfferProb       float64         `hcl:"participant_ignore_offer_prob"`
+	TamperDataProb        float64         `hcl:"participant_tamper_data_prob"`
+	Profiles              ProfilesConf    `hcl:"profiles"`
+	Preferences           PreferencesConf `hcl:"preferences"`
+}
+
+// ProfilesConf are the pools participant profiles are drawn from. Every
+// condition and medication is drawn independently with its probability.
+type ProfilesConf struct {
+	AgeMin         int      `hcl:"age_min"`
+	AgeMax         int      `hcl:"age_max"`
+	Conditions     []string `hcl:"conditions"`
+	ConditionProb  float64  `hcl:"condition_prob"`
+	Medications    []string `hcl:"medications"`
+	MedicationProb float64  `hcl:"medication_prob"`
+	Locations      []string `hcl:"locations"`
+}
+
+// Ages of the participants when the configuration has no profiles
+const (
+	defaultAgeMin = 18
+	defaultAgeMax = 85
+)
+
+func (c ProfilesConf) validate() error {
+	if c.AgeMin < 0 {
+		return fmt.Errorf("invalid age_min: %d", c.AgeMin)
+	}
+	if c.AgeMax < c.AgeMin {
+		return fmt.Errorf("age_max %d is under age_min %d", c.AgeMax, c.AgeMin)
+	}
+	return nil
+}
+
+// validateIgnoreOffer refuses probabilities of ignoring offers that never
+// expire, since an ignored offer stays pending until its TTL is over
+func (c *Configuration) validateIgnoreOffer() error {
+	if c.Participants.IgnoreOfferProb > 0 && c.Offers.InviteTTL == 0 && c.Offers.EnrolmentTTL == 0 {
+		return fmt.Errorf("participant_ignore_offer_prob needs an invite_ttl or enrolment_ttl")
+	}
+	if c.Sponsors.IgnoreOfferProb > 0 && c.Offers.SponsorReviewTTL == 0 {
+		return fmt.Errorf("sponsor_ignore_offer_prob needs a sponsor_review_ttl")
+	}
+	return nil
+}
+
+// PreferencesConf are the pools participant preferences are drawn from.
+// Every sponsor, phase and data category is drawn independently with its
+// probability. Preferences that are not configured do not restrict.
+type PreferencesConf struct {
+	MaxConcurrentTrialsMin int      `hcl:"max_concurrent_trials_min"`
+	MaxConcurrentTrialsMax int      `hcl:"max_concurrent_trials_max"`
+	Sponsors               []string `hcl:"sponsors"` // identities a participant may exclude
+	ExcludedSponsorProb    float64  `hcl:"excluded_sponsor_prob"`
+	Phases                 []string `hcl:"phases"` // phases a participant may accept
+	PhaseProb              float64  `hcl:"phase_prob"`
+	TravelRadiusMin        int      `hcl:"travel_radius_min"` // km
+	TravelRadiusMax        int      `hcl:"travel_radius_max"` // km
+	DataCategories         []string `hcl:"data_categories"`   // DataConditions, DataMedications or DataVitalSigns a participant may withhold
+	WithholdDataProb       float64  `hcl:"withhold_data_prob"`
+}
+
+// ConfirmationConf bounds how long to wait for the ledger, in seconds
+type ConfirmationConf struct {
+	RequestTimeout int `hcl:"request_timeout"`
+	InitialBackoff int `hcl:"initial_backoff"`
+	MaxBackoff     int `hcl:"max_backoff"`
+	MaxWait        int `hcl:"max_wait"`
+}
+
+// PolicyConf selects the policy of a decision point. Probability policies
+// use the probability configured for the decision point.
+type PolicyConf struct {
+	Type    string `hcl:"type"` // probability, eligibility, rules, script or a registered type
+	Rules   []Rule `hcl:"rules"`
+	Script  []bool `hcl:"script"`
+	Default bool   `hcl:"default"` // when no rule matches or the script is over
+}
+
+// PoliciesConf maps the decision points of each role to their policy
+type PoliciesConf struct {
+	MatchingService map[string]PolicyConf `hcl:"matching_service"`
+	Participant     map[string]PolicyConf `hcl:"participant"`
+	Sponsor         map[string]PolicyConf `hcl:"sponsor"`
 }
 
 type Configuration struct {
 	Network         string              `hcl:"network"`
 	APIToken        string              `hcl:"api_token"`
+	APIEndpoint     string              `hcl:"api_endpoint"`
 	WaitTime        int                 `hcl:"wait_time"`
+	Confirmation    ConfirmationConf    `hcl:"confirmation"`
 	MatchingService MatchingServiceConf `hcl:"matchingService"`
 	Sponsors        SponsorsConf        `hcl:"sponsors"`
 	Participants    ParticipantsConf    `hcl:"participants"`
+	Policies        PoliciesConf        `hcl:"policies"`
+	Offers          OffersConf          `hcl:"offers"`
 }
 
 // loadConfig will read configuration from file
@@ -63,5 +180,14 @@ func loadConfig(fileName string) (*Configuration, error) {
 		return nil, err
 	}
 
+	if m.Participants.Profiles.AgeMin == 0 && m.Participants.Profiles.AgeMax == 0 {
+		m.Participants.Profiles.AgeMin = defaultAgeMin
+		m.Participants.Profiles.AgeMax = defaultAgeMax
+	}
+
+	if m.Sponsors.StudiesDir != "" && !filepath.IsAbs(m.Sponsors.StudiesDir) {
+		m.Sponsors.StudiesDir = filepath.Join(filepath.Dir(fileName), m.Sponsors.StudiesDir)
+	}
+
 	return &m, nil
 }
@@ -0,0 +1,80 @@
+package main
+
+// ConsentState is where a consent bitmark is in its journey from the
+// matching service that issued it to the participant's enrolment
+type ConsentState string
+
+const (
+	ConsentIssued             ConsentState = "issued"  // issued by the matching service
+	ConsentOffered            ConsentState = "offered" // offered to the participant
+	ConsentAccepted           ConsentState = "accepted_by_participant"
+	ConsentDeclined           ConsentState = "declined"             // the participant rejected the invitation
+	ConsentDataSubmitted      ConsentState = "data_submitted"       // the participant issued health data
+	ConsentDataWithheld       ConsentState = "data_withheld"        // the participant kept the consent without submitting data
+	ConsentReturnedToMS       ConsentState = "returned_to_ms"       // health data and consent offered to the matching service
+	ConsentWithMS             ConsentState = "with_ms"              // the matching service holds both
+	ConsentRejectedByMS       ConsentState = "rejected_by_ms"       // health data returned, consent disposed
+	ConsentForwardedToSponsor ConsentState = "forwarded_to_sponsor" // health data and consent offered to the sponsor
+	ConsentWithSponsor        ConsentState = "with_sponsor"         // the sponsor holds both
+	ConsentApproved           ConsentState = "approved"             // consent offered back to the participant
+	ConsentRejected           ConsentState = "rejected"             // health data returned by the sponsor
+	ConsentEnrolled           ConsentState = "enrolled"
+	ConsentEnrollmentDeclined ConsentState = "enrollment_declined"
+	ConsentSuspicious         ConsentState = "rejected_as_suspicious"
+	ConsentTampered           ConsentState = "rejected_as_tampered" // health data does not match the fingerprint of its asset
+	ConsentParticipating      ConsentState = "participating"        // the participant stays in the trial
+	ConsentWithdrawing        ConsentState = "withdrawing"          // the participant issued a withdrawal bitmark
+	ConsentWithdrawalSent     ConsentState = "withdrawal_sent"      // consent and withdrawal sent away by the participant
+	ConsentWithdrawn          ConsentState = "withdrawn"            // health data returned or disposed by the sponsor
+	ConsentOfferExpired       ConsentState = "offer_expired"        // the offer was cancelled, waiting for recovery
+	ConsentExpired            ConsentState = "expired"              // returned to its issuer or burnt after its offer expired
+
+	// Trials with a capacity
+	ConsentWaitlisted       ConsentState = "waitlisted"             // approved by the sponsor of a full trial, waiting for a seat
+	ConsentWaitlistReleased ConsentState = "released_from_waitlist" // no seat freed up, health data returned and consent disposed
+)
+
+// Final reports whether a consent has reached the end of its journey
+func (s ConsentState) Final() bool {
+	switch s {
+	case ConsentDeclined, ConsentDataWithheld, ConsentRejectedByMS, ConsentRejected, ConsentEnrollmentDeclined, ConsentSuspicious, ConsentTampered, ConsentParticipating, ConsentWithdrawn, ConsentExpired, ConsentWaitlistReleased:
+		return true
+	}
+	return false
+}
+
+// Trial is a trial announced by a sponsor
+type Trial struct {
+	AssetID   string `json:"asset_id"`
+	BitmarkID string `json:"bitmark_id"`
+	Name      string `json:"name"`
+	Sponsor   string `json:"sponsor"`
+	Announced bool   `json:"announced"` // considered by every matching service
+
+	Capacity int         `json:"capacity,omitempty"` // target enrollment, 0 for no limit
+	Status   TrialStatus `json:"status,omitempty"`   // TrialRecruiting when empty
+	Waitlist []string    `json:"waitlist,omitempty"` // consents approved while the trial was full, first come first served
+}
+
+// Consent is a consent bitmark and the health data submitted with it.
+// Accounts are account numbers.
+type Consent struct {
+	ID              string       `json:"id"`
+	State           ConsentState `json:"state"`
+	TrialID         string       `json:"trial_id"`
+	Trial           string       `json:"trial"`
+	Sponsor         string       `json:"sponsor"`
+	MatchingService string       `json:"matching_service"`
+	Participant     string       `json:"participant"`
+
+	HealthDataAssetID string `json:"health_data_asset_id,omitempty"`
+	HealthData        string `json:"health_data,omitempty"` // asset name
+	HealthDataID      string `json:"health_data_id,omitempty"`
+
+	WithdrawalID string `json:"withdrawal_id,omitempty"` // withdrawal bitmark issued by the participant
+	WithdrawnTo  string `json:"withdrawn_to,omitempty"`  // account the consent was sent to on withdrawal
+
+	Ignored      bool         `json:"ignored,omitempty"`       // the receiver leaves the pending offer unanswered
+	ExpiredFrom  ConsentState `json:"expired_from,omitempty"`  // state whose offer expired
+	TamperedFrom ConsentState `json:"tampered_from,omitempty"` // state in which the health data was found tampered with
+}
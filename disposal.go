@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/bitmark-inc/bitmark-sdk-go/account"
+	"github.com/bitmark-inc/ct-match/event"
+	"github.com/bitmark-inc/ct-match/ledger"
+)
+
+// What a role does with a consent bitmark it is done with
+const (
+	DisposalBurn   = "burn"   // transfer it into the trash bin
+	DisposalReturn = "return" // transfer it to the matching service that issued it
+	DisposalKeep   = "keep"   // hold it for audit
+)
+
+func validateDisposal(disposal string) error {
+	switch disposal {
+	case "", DisposalBurn, DisposalReturn, DisposalKeep:
+		return nil
+	}
+	return fmt.Errorf("unknown consent_disposal: %s", disposal)
+}
+
+// disposeConsent disposes of a consent held by acc and records it. A
+// matching service returning a consent keeps it, since it issued it.
+func disposeConsent(l ledger.Ledger, acc account.Account, emit func(event.Event), c *Consent, disposal, trashBin, reason string) error {
+	if disposal == "" {
+		disposal = DisposalBurn
+	}
+
+	to := acc.AccountNumber()
+	switch disposal {
+	case DisposalBurn:
+		to = trashBin
+	case DisposalReturn:
+		to = c.MatchingService
+	}
+
+	if to != acc.AccountNumber() {
+		if _, err := l.Transfer(acc, c.ID, to); err != nil {
+			return err
+		}
+	} else {
+		disposal = DisposalKeep
+	}
+
+	emit(event.Event{
+		Type:         event.ConsentDisposed,
+		Counterparty: to,
+		Participant:  c.Participant,
+		Kind:         event.KindConsent,
+		AssetID:      c.TrialID,
+		Asset:        c.Trial,
+		BitmarkID:    c.ID,
+		ConsentID:    c.ID,
+		TrialID:      c.TrialID,
+		Trial:        c.Trial,
+		Disposal:     disposal,
+		Reason:       reason,
+	})
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	MatchingProbability = "probability"
+	MatchingEligibility = "eligibility"
+)
+
+// Metadata keys of the eligibility criteria of a trial asset. Lists are
+// separated by listSeparator.
+const (
+	metadataMinAge              = "Min Age"
+	metadataMaxAge              = "Max Age"
+	metadataSex                 = "Sex"
+	metadataConditions          = "Conditions"
+	metadataExcludedConditions  = "Excluded Conditions"
+	metadataExcludedMedications = "Excluded Medications"
+	metadataLocations           = "Locations"
+
+	listSeparator = ";"
+)
+
+// Criteria are the eligibility rules of a trial. Empty fields do not restrict.
+type Criteria struct {
+	MinAge              int      `hcl:"min_age"`
+	MaxAge              int      `hcl:"max_age"`
+	Sex                 string   `hcl:"sex"`
+	Conditions          []string `hcl:"conditions"` // the participant needs at least one
+	ExcludedConditions  []string `hcl:"excluded_conditions"`
+	ExcludedMedications []string `hcl:"excluded_medications"`
+	Locations           []string `hcl:"locations"`
+}
+
+func (c Criteria) Empty() bool {
+	return c.MinAge == 0 && c.MaxAge == 0 && c.Sex == "" &&
+		len(c.Conditions) == 0 && len(c.ExcludedConditions) == 0 &&
+		len(c.ExcludedMedications) == 0 && len(c.Locations) == 0
+}
+
+// AddTo writes the criteria into the metadata of a trial asset
+func (c Criteria) AddTo(metadata map[string]string) {
+	if c.MinAge > 0 {
+		metadata[metadataMinAge] = strconv.Itoa(c.MinAge)
+	}
+	if c.MaxAge > 0 {
+		metadata[metadataMaxAge] = strconv.Itoa(c.MaxAge)
+	}
+	if c.Sex != "" {
+		metadata[metadataSex] = c.Sex
+	}
+	addList(metadata, metadataConditions, c.Conditions)
+	addList(metadata, metadataExcludedConditions, c.ExcludedConditions)
+	addList(metadata, metadataExcludedMedications, c.ExcludedMedications)
+	addList(metadata, metadataLocations, c.Locations)
+}
+
+func addList(metadata map[string]string, key string, values []string) {
+	if len(values) > 0 {
+		metadata[key] = strings.Join(values, listSeparator)
+	}
+}
+
+// fitLists drops the last values of the lists of keys, from the longest list
+// first, until the metadata fits the ledger. Every list keeps its first value.
+func fitLists(metadata map[string]string, keys ...string) {
+	for metadataLength(metadata) > maxMetadata {
+		longest := ""
+		for _, k := range keys {
+			if !strings.Contains(metadata[k], listSeparator) {
+				continue
+			}
+			if longest == "" || utf8.RuneCountInString(metadata[k]) > utf8.RuneCountInString(metadata[longest]) {
+				longest = k
+			}
+		}
+		if longest == "" {
+			return
+		}
+		values := list(metadata, longest)
+		metadata[longest] = strings.Join(values[:len(values)-1], listSeparator)
+	}
+}
+
+// criteriaFromMetadata reads the eligibility criteria of a trial asset
+func criteriaFromMetadata(metadata map[string]string) (Criteria, error) {
+	var c Criteria
+	var err error
+	if v, ok := metadata[metadataMinAge]; ok {
+		if c.MinAge, err = strconv.Atoi(v); err != nil {
+			return c, fmt.Errorf("invalid %s: %s", metadataMinAge, v)
+		}
+	}
+	if v, ok := metadata[metadataMaxAge]; ok {
+		if c.MaxAge, err = strconv.Atoi(v); err != nil {
+			return c, fmt.Errorf("invalid %s: %s", metadataMaxAge, v)
+		}
+	}
+	c.Sex = metadata[metadataSex]
+	c.Conditions = list(metadata, metadataConditions)
+	c.ExcludedConditions = list(metadata, metadataExcludedConditions)
+	c.ExcludedMedications = list(metadata, metadataExcludedMedications)
+	c.Locations = list(metadata, metadataLocations)
+	return c, nil
+}
+
+func list(metadata map[string]string, key string) []string {
+	v, ok := metadata[key]
+	if !ok || v == "" {
+		return nil
+	}
+	return strings.Split(v, listSeparator)
+}
+
+// Check tells whether a participant is eligible, and if not, why
+func (c Criteria) Check(p Profile) (bool, string) {
+	if c.MinAge > 0 && p.Age < c.MinAge {
+		return false, fmt.Sprintf("age %d is under the minimum of %d", p.Age, c.MinAge)
+	}
+	if c.MaxAge > 0 && p.Age > c.MaxAge {
+		return false, fmt.Sprintf("age %d is over the maximum of %d", p.Age, c.MaxAge)
+	}
+	if c.Sex != "" && !strings.EqualFold(c.Sex, p.Sex) {
+		return false, "the trial is for " + c.Sex + " participants only"
+	}
+	if len(c.Conditions) > 0 && !containsAny(p.Conditions, c.Conditions) {
+		return false, "does not have " + strings.Join(c.Conditions, " or ")
+	}
+	for _, condition := range c.ExcludedConditions {
+		if containsAny(p.Conditions, []string{condition}) {
+			return false, "has " + condition + ", which is excluded"
+		}
+	}
+	for _, medication := range c.ExcludedMedications {
+		if containsAny(p.Medications, []string{medication}) {
+			return false, "takes " + medication + ", which is excluded"
+		}
+	}
+	if len(c.Locations) > 0 && !containsAny([]string{p.Location}, c.Locations) {
+		return false, "is not located in " + strings.Join(c.Locations, " or ")
+	}
+	return true, ""
+}
+
+func containsAny(values, wanted []string) bool {
+	for _, v := range values {
+		for _, w := range wanted {
+			if strings.EqualFold(v, w) {
+				return true
+			}
+		}
+	}
+	return false
+}
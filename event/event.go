@@ -0,0 +1,75 @@
+package event
+
+import (
+	"time"
+)
+
+type Type string
+
+const (
+	TrialRegistered    Type = "TrialRegistered"
+	ConsentIssued      Type = "ConsentIssued"
+	NoMatch            Type = "NoMatch"
+	ConsentOffered     Type = "ConsentOffered"
+	OfferAccepted      Type = "OfferAccepted"
+	OfferRejected      Type = "OfferRejected"
+	HealthDataIssued   Type = "HealthDataIssued"
+	HealthDataOffered  Type = "HealthDataOffered"
+	EvaluationApproved Type = "EvaluationApproved"
+	EvaluationRejected Type = "EvaluationRejected"
+	HealthDataReturned Type = "HealthDataReturned"
+	ConsentDisposed    Type = "ConsentDisposed"
+	Enrolled           Type = "Enrolled"
+	EnrollmentDeclined Type = "EnrollmentDeclined"
+	SuspiciousOffer    Type = "SuspiciousOffer"
+	WithdrawalIssued   Type = "WithdrawalIssued"
+	ConsentWithdrawn   Type = "ConsentWithdrawn"
+	HealthDataDisposed Type = "HealthDataDisposed"
+	OfferExpired       Type = "OfferExpired"
+	AccessGranted      Type = "AccessGranted"
+	HealthDataRead     Type = "HealthDataRead"
+	TamperedHealthData Type = "TamperedHealthData"
+	TrialStatusChanged Type = "TrialStatusChanged"
+	WaitlistPromoted   Type = "WaitlistPromoted"
+	HealthDataWithheld Type = "HealthDataWithheld"
+
+	// Bitmarks of other runs found with an account of this one
+	ForeignOffer   Type = "ForeignOffer"
+	ForeignHolding Type = "ForeignHolding"
+)
+
+// Roles of the accounts acting in the simulation
+const (
+	RoleSponsor         = "sponsor"
+	RoleMatchingService = "matching service"
+	RoleParticipant     = "participant"
+)
+
+// Kinds of bitmark an event is about
+const (
+	KindTrial      = "trial"
+	KindConsent    = "consent"
+	KindHealthData = "health data"
+	KindWithdrawal = "withdrawal"
+)
+
+// Event is a single action of the simulation. Accounts are account numbers.
+type Event struct {
+	Type         Type      `json:"type"`
+	Time         time.Time `json:"time"`
+	Actor        string    `json:"actor"`
+	ActorRole    string    `json:"actor_role"`
+	Counterparty string    `json:"counterparty,omitempty"`
+	Participant  string    `json:"participant,omitempty"`
+	Kind         string    `json:"kind,omitempty"`
+	AssetID      string    `json:"asset_id,omitempty"`
+	Asset        string    `json:"asset,omitempty"`
+	BitmarkID    string    `json:"bitmark_id,omitempty"`
+	ConsentID    string    `json:"consent_id,omitempty"`
+	TrialID      string    `json:"trial_id,omitempty"`
+	Trial        string    `json:"trial,omitempty"`
+	Reason       string    `json:"reason,omitempty"`
+	Disposal     string    `json:"disposal,omitempty"`   // burn, return or keep
+	Status       string    `json:"status,omitempty"`     // recruitment status of the trial
+	Preference   string    `json:"preference,omitempty"` // of the participant, that made them decline
+}
@@ -0,0 +1,98 @@
+package event
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+)
+
+// Sink receives every event of a simulation
+type Sink interface {
+	Emit(e Event)
+}
+
+// Sinks fans events out to several sinks in order
+type Sinks []Sink
+
+func (s Sinks) Emit(e Event) {
+	for _, sink := range s {
+		sink.Emit(e)
+	}
+}
+
+// JSONLines writes one JSON document per event. Write errors are kept
+// and returned by Close so that emitting never interrupts the simulation.
+type JSONLines struct {
+	sync.Mutex
+	w       io.Writer
+	encoder *json.Encoder
+	err     error
+}
+
+func NewJSONLines(w io.Writer) *JSONLines {
+	return &JSONLines{
+		w:       w,
+		encoder: json.NewEncoder(w),
+	}
+}
+
+// CreateJSONLines writes the events to a new file
+func CreateJSONLines(fileName string) (*JSONLines, error) {
+	f, err := os.Create(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return NewJSONLines(f), nil
+}
+
+// AppendJSONLines writes the events to the end of a file, creating it if needed
+func AppendJSONLines(fileName string) (*JSONLines, error) {
+	f, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return NewJSONLines(f), nil
+}
+
+func (j *JSONLines) Emit(e Event) {
+	j.Lock()
+	defer j.Unlock()
+
+	if j.err != nil {
+		return
+	}
+	j.err = j.encoder.Encode(e)
+}
+
+func (j *JSONLines) Close() error {
+	j.Lock()
+	defer j.Unlock()
+
+	if c, ok := j.w.(io.Closer); ok {
+		if err := c.Close(); err != nil && j.err == nil {
+			j.err = err
+		}
+	}
+	return j.err
+}
+
+// ReadJSONLines sends the events of a JSON Lines file to a sink
+func ReadJSONLines(fileName string, sink Sink) error {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	decoder := json.NewDecoder(bufio.NewReader(f))
+	for decoder.More() {
+		var e Event
+		if err := decoder.Decode(&e); err != nil {
+			return err
+		}
+		sink.Emit(e)
+	}
+	return nil
+}
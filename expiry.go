@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bitmark-inc/bitmark-sdk-go/account"
+	"github.com/bitmark-inc/bitmark-sdk-go/bitmark"
+	"github.com/bitmark-inc/ct-match/event"
+	"github.com/bitmark-inc/ct-match/ledger"
+)
+
+// What happens to a consent once its offer expired
+const (
+	OnExpiryReoffer = "reoffer" // offer it again to the same account
+	OnExpiryReturn  = "return"  // give it back to the matching service that issued it
+	OnExpiryBurn    = "burn"    // dispose of it into the trash bin
+)
+
+func (c OffersConf) validate() error {
+	switch c.OnExpiry {
+	case "", OnExpiryReoffer, OnExpiryReturn, OnExpiryBurn:
+		return nil
+	}
+	return fmt.Errorf("unknown on_expiry: %s", c.OnExpiry)
+}
+
+// ttl returns how long the offers made in a consent state stay valid, 0 for ever
+func (c OffersConf) ttl(state ConsentState) time.Duration {
+	switch state {
+	case ConsentOffered:
+		return time.Duration(c.InviteTTL) * time.Second
+	case ConsentForwardedToSponsor:
+		return time.Duration(c.SponsorReviewTTL) * time.Second
+	case ConsentApproved:
+		return time.Duration(c.EnrolmentTTL) * time.Second
+	}
+	return 0
+}
+
+// expired reports whether an offer is older than ttl
+func expired(b *bitmark.Bitmark, ttl time.Duration) bool {
+	return ttl > 0 && b.Offer != nil && time.Since(b.Offer.CreatedAt) > ttl
+}
+
+// cancelOffers cancels the offers of a consent that were not answered in time
+func cancelOffers(l ledger.Ledger, acc account.Account, emit func(event.Event), c *Consent, ttl time.Duration, bitmarks ...*bitmark.Bitmark) error {
+	for _, b := range bitmarks {
+		if _, err := l.Respond(acc, b, bitmark.Cancel); err != nil {
+			return err
+		}
+
+		e := event.Event{
+			Type:         event.OfferExpired,
+			Counterparty: b.Offer.To,
+			Participant:  c.Participant,
+			Kind:         event.KindConsent,
+			AssetID:      c.TrialID,
+			Asset:        c.Trial,
+			BitmarkID:    b.ID,
+			ConsentID:    c.ID,
+			TrialID:      c.TrialID,
+			Trial:        c.Trial,
+			Reason:       "not answered within " + ttl.String(),
+		}
+		if b.ID != c.ID {
+			e.Kind = event.KindHealthData
+			e.AssetID = c.HealthDataAssetID
+			e.Asset = c.HealthData
+		}
+		emit(e)
+	}
+	return nil
+}
+
+// releaseExpired gives the health data held for a consent back to the
+// participant and disposes of the consent
+func releaseExpired(l ledger.Ledger, acc account.Account, emit func(event.Event), c *Consent, disposal, trashBin string) error {
+	if c.HealthDataID != "" {
+		if _, err := l.Transfer(acc, c.HealthDataID, c.Participant); err != nil {
+			return err
+		}
+		emit(event.Event{
+			Type:         event.HealthDataReturned,
+			Counterparty: c.Participant,
+			Participant:  c.Participant,
+			Kind:         event.KindHealthData,
+			AssetID:      c.HealthDataAssetID,
+			Asset:        c.HealthData,
+			BitmarkID:    c.HealthDataID,
+			ConsentID:    c.ID,
+			TrialID:      c.TrialID,
+			Trial:        c.Trial,
+			Reason:       "offer expired",
+		})
+	}
+
+	return disposeConsent(l, acc, emit, c, disposal, trashBin, "offer expired")
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/bitmark-inc/ct-match/util"
+)
+
+// Code systems of the synthetic records
+const (
+	systemSNOMED = "http://snomed.info/sct"
+	systemRxNorm = "http://www.nlm.nih.gov/research/umls/rxnorm"
+	systemLOINC  = "http://loinc.org"
+	systemUCUM   = "http://unitsofmeasure.org"
+
+	systemConditionClinical     = "http://terminology.hl7.org/CodeSystem/condition-clinical"
+	systemConditionVerification = "http://terminology.hl7.org/CodeSystem/condition-ver-status"
+	systemObservationCategory   = "http://terminology.hl7.org/CodeSystem/observation-category"
+)
+
+// SNOMED CT codes of the conditions in the sample configuration. Other
+// conditions are recorded by name only.
+var conditionCodes = map[string]string{
+	"hypertension":             "38341003",
+	"type 1 diabetes":          "46635009",
+	"type 2 diabetes":          "44054006",
+	"migraine":                 "37796009",
+	"depression":               "35489007",
+	"anxiety":                  "197480006",
+	"asthma":                   "195967001",
+	"heart failure":            "84114007",
+	"irritable bowel syndrome": "10743008",
+	"respiratory infection":    "275498002",
+	"hyperparathyroidism":      "66999008",
+}
+
+// RxNorm codes of the medications in the sample configuration
+var medicationCodes = map[string]string{
+	"metformin":   "6809",
+	"insulin":     "5856",
+	"lisinopril":  "29046",
+	"warfarin":    "11289",
+	"sertraline":  "36437",
+	"albuterol":   "435",
+	"sumatriptan": "37418",
+}
+
+// fhirBundle is a FHIR R4 Bundle of the few resources a health record needs
+type fhirBundle struct {
+	ResourceType string      `json:"resourceType"`
+	ID           string      `json:"id"`
+	Type         string      `json:"type"`
+	Timestamp    string      `json:"timestamp"`
+	Entry        []fhirEntry `json:"entry"`
+}
+
+type fhirEntry struct {
+	FullURL  string       `json:"fullUrl"`
+	Resource fhirResource `json:"resource"`
+}
+
+// fhirResource holds the fields used of Patient, Condition, Observation and MedicationStatement
+type fhirResource struct {
+	ResourceType string `json:"resourceType"`
+	ID           string `json:"id"`
+
+	// Patient
+	Identifier []fhirIdentifier `json:"identifier,omitempty"`
+	Gender     string           `json:"gender,omitempty"`
+	BirthDate  string           `json:"birthDate,omitempty"`
+	Address    []fhirAddress    `json:"address,omitempty"`
+
+	// Condition, Observation and MedicationStatement
+	Status                    string                `json:"status,omitempty"`
+	ClinicalStatus            *fhirCodeableConcept  `json:"clinicalStatus,omitempty"`
+	VerificationStatus        *fhirCodeableConcept  `json:"verificationStatus,omitempty"`
+	Category                  []fhirCodeableConcept `json:"category,omitempty"`
+	Code                      *fhirCodeableConcept  `json:"code,omitempty"`
+	MedicationCodeableConcept *fhirCodeableConcept  `json:"medicationCodeableConcept,omitempty"`
+	Subject                   *fhirReference        `json:"subject,omitempty"`
+	EffectiveDateTime         string                `json:"effectiveDateTime,omitempty"`
+	ValueQuantity             *fhirQuantity         `json:"valueQuantity,omitempty"`
+	Component                 []fhirComponent       `json:"component,omitempty"`
+}
+
+type fhirIdentifier struct {
+	System string `json:"system"`
+	Value  string `json:"value"`
+}
+
+type fhirAddress struct {
+	Text string `json:"text"`
+}
+
+type fhirCoding struct {
+	System  string `json:"system"`
+	Code    string `json:"code"`
+	Display string `json:"display,omitempty"`
+}
+
+type fhirCodeableConcept struct {
+	Coding []fhirCoding `json:"coding,omitempty"`
+	Text   string       `json:"text,omitempty"`
+}
+
+type fhirReference struct {
+	Reference string `json:"reference"`
+}
+
+type fhirQuantity struct {
+	Value  float64 `json:"value"`
+	Unit   string  `json:"unit"`
+	System string  `json:"system"`
+	Code   string  `json:"code"`
+}
+
+type fhirComponent struct {
+	Code          fhirCodeableConcept `json:"code"`
+	ValueQuantity *fhirQuantity       `json:"valueQuantity"`
+}
+
+// newHealthRecord generates a synthetic FHIR R4 Bundle with the Patient,
+// Conditions, MedicationStatements and, with vitals, vital sign Observations
+// of a profile
+func newHealthRecord(account string, profile Profile, vitals bool, now time.Time) ([]byte, error) {
+	patientID := newUUID()
+	subject := &fhirReference{Reference: "urn:uuid:" + patientID}
+	bundle := fhirBundle{
+		ResourceType: "Bundle",
+		ID:           newUUID(),
+		Type:         "collection",
+		Timestamp:    now.Format(time.RFC3339),
+	}
+	add := func(r fhirResource) {
+		bundle.Entry = append(bundle.Entry, fhirEntry{FullURL: "urn:uuid:" + r.ID, Resource: r})
+	}
+
+	// Born on a random day that makes the patient the age of the profile
+	birthDate := now.AddDate(-profile.Age-1, 0, 1+util.RandWithRange(0, 365))
+	patient := fhirResource{
+		ResourceType: "Patient",
+		ID:           patientID,
+		Identifier:   []fhirIdentifier{{System: "urn:bitmark:account", Value: account}},
+		Gender:       profile.Sex,
+		BirthDate:    birthDate.Format("2006-01-02"),
+	}
+	if profile.Location != "" {
+		patient.Address = []fhirAddress{{Text: profile.Location}}
+	}
+	add(patient)
+
+	for _, condition := range profile.Conditions {
+		add(fhirResource{
+			ResourceType:       "Condition",
+			ID:                 newUUID(),
+			ClinicalStatus:     concept(systemConditionClinical, "active", ""),
+			VerificationStatus: concept(systemConditionVerification, "confirmed", ""),
+			Code:               concept(systemSNOMED, conditionCodes[condition], condition),
+			Subject:            subject,
+		})
+	}
+	for _, medication := range profile.Medications {
+		add(fhirResource{
+			ResourceType:              "MedicationStatement",
+			ID:                        newUUID(),
+			Status:                    "active",
+			MedicationCodeableConcept: concept(systemRxNorm, medicationCodes[medication], medication),
+			Subject:                   subject,
+		})
+	}
+
+	if vitals {
+		for _, o := range vitalSigns(profile) {
+			o.ResourceType = "Observation"
+			o.ID = newUUID()
+			o.Status = "final"
+			o.Category = []fhirCodeableConcept{*concept(systemObservationCategory, "vital-signs", "")}
+			o.Subject = subject
+			o.EffectiveDateTime = now.Format(time.RFC3339)
+			add(o)
+		}
+	}
+
+	return json.MarshalIndent(bundle, "", "  ")
+}
+
+// vitalSigns draws plausible height, weight, BMI, blood pressure and heart
+// rate for a profile, raised blood pressure for hypertension
+func vitalSigns(profile Profile) []fhirResource {
+	height := 150 + float64(util.RandWithRange(0, 26))
+	if profile.Sex == "male" {
+		height += 12
+	}
+	if profile.Age < 18 {
+		height -= float64(18-profile.Age) * 6
+	}
+	bmi := 18.5 + float64(util.RandWithRange(0, 140))/10
+	weight := round(bmi*height*height/10000, 1)
+
+	systolic, diastolic := util.RandWithRange(105, 136), util.RandWithRange(65, 86)
+	for _, condition := range profile.Conditions {
+		if condition == "hypertension" {
+			systolic, diastolic = util.RandWithRange(140, 171), util.RandWithRange(90, 106)
+		}
+	}
+
+	return []fhirResource{
+		{Code: concept(systemLOINC, "8302-2", "Body height"), ValueQuantity: quantity(height, "cm")},
+		{Code: concept(systemLOINC, "29463-7", "Body weight"), ValueQuantity: quantity(weight, "kg")},
+		{Code: concept(systemLOINC, "39156-5", "Body mass index"), ValueQuantity: quantity(round(bmi, 1), "kg/m2")},
+		{
+			Code: concept(systemLOINC, "85354-9", "Blood pressure panel"),
+			Component: []fhirComponent{
+				{Code: *concept(systemLOINC, "8480-6", "Systolic blood pressure"), ValueQuantity: quantity(float64(systolic), "mm[Hg]")},
+				{Code: *concept(systemLOINC, "8462-4", "Diastolic blood pressure"), ValueQuantity: quantity(float64(diastolic), "mm[Hg]")},
+			},
+		},
+		{Code: concept(systemLOINC, "8867-4", "Heart rate"), ValueQuantity: quantity(float64(util.RandWithRange(58, 96)), "/min")},
+	}
+}
+
+// profileFromHealthRecord reads back the profile a FHIR Bundle describes
+func profileFromHealthRecord(content []byte, now time.Time) (Profile, error) {
+	var bundle fhirBundle
+	if err := json.Unmarshal(content, &bundle); err != nil {
+		return Profile{}, err
+	}
+	if bundle.ResourceType != "Bundle" {
+		return Profile{}, fmt.Errorf("health record is a %s, not a Bundle", bundle.ResourceType)
+	}
+
+	p := Profile{
+		Conditions:  make([]string, 0),
+		Medications: make([]string, 0),
+	}
+	patients := 0
+	for _, entry := range bundle.Entry {
+		r := entry.Resource
+		switch r.ResourceType {
+		case "Patient":
+			patients++
+			birthDate, err := time.Parse("2006-01-02", r.BirthDate)
+			if err != nil {
+				return Profile{}, fmt.Errorf("birth date of the patient: %s", err)
+			}
+			p.Age = now.Year() - birthDate.Year()
+			if now.Month() < birthDate.Month() || now.Month() == birthDate.Month() && now.Day() < birthDate.Day() {
+				p.Age--
+			}
+			p.Sex = r.Gender
+			if len(r.Address) > 0 {
+				p.Location = r.Address[0].Text
+			}
+		case "Condition":
+			if r.Code != nil {
+				p.Conditions = append(p.Conditions, r.Code.Text)
+			}
+		case "MedicationStatement":
+			if r.MedicationCodeableConcept != nil {
+				p.Medications = append(p.Medications, r.MedicationCodeableConcept.Text)
+			}
+		}
+	}
+	if patients != 1 {
+		return Profile{}, fmt.Errorf("health record has %d patients", patients)
+	}
+	return p, nil
+}
+
+func concept(system, code, text string) *fhirCodeableConcept {
+	c := &fhirCodeableConcept{Text: text}
+	if code != "" {
+		c.Coding = []fhirCoding{{System: system, Code: code, Display: text}}
+	}
+	return c
+}
+
+func quantity(value float64, unit string) *fhirQuantity {
+	return &fhirQuantity{Value: value, Unit: unit, System: systemUCUM, Code: unit}
+}
+
+func round(x float64, decimals int) float64 {
+	pow := math.Pow(10, float64(decimals))
+	return math.Round(x*pow) / pow
+}
+
+// newUUID draws a version 4 UUID from the seeded generator
+func newUUID() string {
+	b := util.RandBytes(16)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/bitmark-inc/bitmark-sdk-go/account"
+	"github.com/bitmark-inc/bitmark-sdk-go/asset"
+	"github.com/bitmark-inc/bitmark-sdk-go/bitmark"
+	"github.com/bitmark-inc/bitmark-sdk-go/tx"
+	"github.com/bitmark-inc/ct-match/event"
+	"github.com/bitmark-inc/ct-match/ledger"
+	"github.com/bitmark-inc/ct-match/store"
+	"github.com/bitmark-inc/ct-match/util"
+)
+
+const roleTrashBin = "trash_bin"
+
+// Transfers the consent protocol makes for each kind of bitmark, from role to role
+var custodyProtocol = map[string]map[[2]string]bool{
+	event.KindConsent: {
+		{event.RoleMatchingService, event.RoleParticipant}: true, // invitation
+		{event.RoleParticipant, event.RoleMatchingService}: true, // submission
+		{event.RoleMatchingService, event.RoleSponsor}:     true, // forwarded for review
+		{event.RoleSponsor, event.RoleParticipant}:         true, // enrolment
+		{event.RoleParticipant, event.RoleSponsor}:         true, // withdrawal
+		{event.RoleSponsor, event.RoleMatchingService}:     true, // returned to its issuer
+		{event.RoleMatchingService, roleTrashBin}:          true,
+		{event.RoleSponsor, roleTrashBin}:                  true,
+		{event.RoleParticipant, roleTrashBin}:              true,
+	},
+	event.KindHealthData: {
+		{event.RoleParticipant, event.RoleMatchingService}: true,
+		{event.RoleMatchingService, event.RoleSponsor}:     true,
+		{event.RoleMatchingService, event.RoleParticipant}: true,
+		{event.RoleSponsor, event.RoleParticipant}:         true,
+		{event.RoleSponsor, roleTrashBin}:                  true,
+	},
+	event.KindWithdrawal: {
+		{event.RoleParticipant, event.RoleSponsor}: true,
+	},
+}
+
+// Inspector renders the custody chain of a bitmark of a run and checks it
+// against the consent protocol
+type Inspector struct {
+	ledger     ledger.Ledger
+	conf       *Configuration
+	identities map[string]string // account -> name
+	roles      map[string]string // account -> role
+	consents   map[string]*Consent
+	store      *store.Store // nil without a checkpoint
+}
+
+// newInspector knows the accounts of the configuration, and the participants
+// and consents of the checkpoint cp if it is not nil. Without a checkpoint
+// every other account is taken for a participant.
+func newInspector(conf *Configuration, l ledger.Ledger, cp *Checkpoint) (*Inspector, error) {
+	i := &Inspector{
+		ledger:     l,
+		conf:       conf,
+		identities: make(map[string]string),
+		roles:      make(map[string]string),
+		consents:   make(map[string]*Consent),
+	}
+
+	for _, a := range conf.MatchingService.Accounts {
+		if err := i.add(a.Seed, a.Identity, event.RoleMatchingService); err != nil {
+			return nil, err
+		}
+	}
+	for _, a := range conf.Sponsors.Accounts {
+		if err := i.add(a.Seed, a.Identity, event.RoleSponsor); err != nil {
+			return nil, err
+		}
+	}
+	for _, trashBin := range []string{conf.MatchingService.TrashBinAccount, conf.Sponsors.TrashBinAccount} {
+		if trashBin != "" {
+			i.identities[trashBin] = "Trash bin"
+			i.roles[trashBin] = roleTrashBin
+		}
+	}
+
+	if cp == nil {
+		return i, nil
+	}
+	for _, state := range cp.Participants {
+		acc, err := account.FromSeed(state.Seed)
+		if err != nil {
+			return nil, err
+		}
+		i.identities[acc.AccountNumber()] = "Participant " + util.ShortenAccountNumber(acc.AccountNumber())
+		i.roles[acc.AccountNumber()] = event.RoleParticipant
+	}
+	for _, c := range cp.Consents {
+		i.consents[c.ID] = c
+	}
+	i.store = cp.Store
+	return i, nil
+}
+
+func (i *Inspector) add(seed, name, role string) error {
+	acc, err := account.FromSeed(seed)
+	if err != nil {
+		return err
+	}
+	i.identities[acc.AccountNumber()] = name
+	i.roles[acc.AccountNumber()] = role
+	return nil
+}
+
+func (i *Inspector) role(account string) string {
+	if role, ok := i.roles[account]; ok {
+		return role
+	}
+	if len(i.consents) == 0 {
+		return event.RoleParticipant
+	}
+	return ""
+}
+
+func (i *Inspector) name(account string) string {
+	if name, ok := i.identities[account]; ok {
+		return name
+	}
+	if i.role(account) == event.RoleParticipant {
+		return "Participant " + util.ShortenAccountNumber(account)
+	}
+	return account
+}
+
+// Inspect writes the custody chain of a bitmark and its deviations from the consent protocol
+func (i *Inspector) Inspect(w io.Writer, bitmarkID string) error {
+	b, err := i.ledger.GetBitmark(bitmarkID)
+	if err != nil {
+		return err
+	}
+	a, err := i.ledger.GetAsset(b.AssetID)
+	if err != nil {
+		return err
+	}
+	txs, err := i.ledger.Provenance(bitmarkID)
+	if err != nil {
+		return err
+	}
+
+	kind := assetKind(a)
+	fmt.Fprintf(w, "%s bitmark %s\n", strings.Title(kind), b.ID)
+	fmt.Fprintf(w, "Asset: %s (%s)\n", a.Name, a.ID)
+	if runID := a.Metadata[RunIDKey]; runID != "" {
+		fmt.Fprintf(w, "Run: %s\n", runID)
+	}
+
+	chain := make([]string, 0, len(txs))
+	for n, t := range txs {
+		name := i.name(t.Owner)
+		if n == 0 {
+			name += " issued"
+		}
+		if t.Status == "pending" || t.Status == "queued" {
+			name += " (" + t.Status + ")"
+		}
+		chain = append(chain, name)
+	}
+	fmt.Fprintf(w, "Custody: %s\n", strings.Join(chain, " → "))
+	if b.Offer != nil {
+		fmt.Fprintf(w, "Pending offer to %s\n", i.name(b.Offer.To))
+	}
+	if i.store != nil && kind == event.KindHealthData {
+		grantees := make([]string, 0)
+		for _, account := range i.store.Grantees(a.ID) {
+			grantees = append(grantees, i.name(account))
+		}
+		fmt.Fprintf(w, "Access granted to: %s\n", strings.Join(grantees, ", "))
+	}
+
+	deviations, err := i.deviations(kind, b, a, txs)
+	if err != nil {
+		return err
+	}
+	if len(deviations) == 0 {
+		fmt.Fprintln(w, "No deviation from the consent protocol")
+		return nil
+	}
+	fmt.Fprintln(w, "Deviations from the consent protocol:")
+	for _, d := range deviations {
+		fmt.Fprintf(w, "  - %s\n", d)
+	}
+	return nil
+}
+
+func assetKind(a *asset.Asset) string {
+	switch a.Metadata[metadataType] {
+	case AssetTrial:
+		return event.KindConsent
+	case AssetHealthData:
+		return event.KindHealthData
+	case AssetWithdrawal:
+		return event.KindWithdrawal
+	}
+	return "unknown"
+}
+
+func (i *Inspector) deviations(kind string, b *bitmark.Bitmark, a *asset.Asset, txs []*tx.Tx) ([]string, error) {
+	protocol, ok := custodyProtocol[kind]
+	if !ok {
+		return []string{"asset type " + a.Metadata[metadataType] + " is not part of the consent protocol"}, nil
+	}
+	if len(txs) == 0 {
+		return []string{"no provenance"}, nil
+	}
+
+	// The sponsor of the trial the bitmark is about
+	var c *Consent
+	sponsor := a.Registrant
+	if kind != event.KindConsent {
+		consentID := a.Metadata[metadataTrialBitmark]
+		c = i.consents[consentID]
+		consent, err := i.ledger.GetBitmark(consentID)
+		if err != nil {
+			return []string{"refers to unknown consent " + consentID}, nil
+		}
+		trial, err := i.ledger.GetAsset(consent.AssetID)
+		if err != nil {
+			return nil, err
+		}
+		sponsor = trial.Registrant
+	} else {
+		c = i.consents[b.ID]
+	}
+
+	deviations := make([]string, 0)
+	if err := checkAsset(a); err != nil {
+		deviations = append(deviations, err.Error())
+	}
+	issuer := txs[0].Owner
+	switch kind {
+	case event.KindConsent:
+		if i.role(issuer) != event.RoleMatchingService {
+			deviations = append(deviations, "issued by "+i.name(issuer)+", not a matching service")
+		}
+		if i.role(sponsor) != event.RoleSponsor {
+			deviations = append(deviations, "trial registered by "+i.name(sponsor)+", not a sponsor")
+		}
+	default:
+		if i.role(issuer) != event.RoleParticipant || issuer != a.Registrant {
+			deviations = append(deviations, "issued by "+i.name(issuer)+", not the participant who registered it")
+		}
+	}
+
+	for n := 1; n < len(txs); n++ {
+		from, to := txs[n-1].Owner, txs[n].Owner
+		fromRole, toRole := i.role(from), i.role(to)
+		switch {
+		case toRole == "":
+			deviations = append(deviations, "transferred to unknown account "+to)
+		case toRole == event.RoleSponsor && to != sponsor:
+			deviations = append(deviations, "transferred to "+i.name(to)+", who did not register the trial")
+		case fromRole != "" && !protocol[[2]string{fromRole, toRole}]:
+			deviations = append(deviations, "unexpected transfer from "+i.name(from)+" to "+i.name(to))
+		}
+	}
+
+	if d := i.undisposed(kind, c, txs[len(txs)-1].Owner); d != "" {
+		deviations = append(deviations, d)
+	}
+	return deviations, nil
+}
+
+// undisposed reports a bitmark that is not where the configuration sends it
+// at the end of the journey of its consent, which only a checkpoint tells
+func (i *Inspector) undisposed(kind string, c *Consent, owner string) string {
+	if c == nil {
+		return ""
+	}
+
+	var disposal, trashBin string
+	switch {
+	case kind == event.KindConsent && c.State == ConsentRejectedByMS:
+		disposal, trashBin = i.conf.MatchingService.ConsentDisposal, i.conf.MatchingService.TrashBinAccount
+	case kind == event.KindConsent && (c.State == ConsentRejected || c.State == ConsentWaitlistReleased):
+		disposal, trashBin = i.conf.Sponsors.ConsentDisposal, i.sponsorTrashBin()
+	case kind == event.KindConsent && c.State == ConsentTampered && c.TamperedFrom == ConsentWithMS:
+		disposal, trashBin = i.conf.MatchingService.ConsentDisposal, i.conf.MatchingService.TrashBinAccount
+	case kind == event.KindConsent && c.State == ConsentTampered && c.TamperedFrom == ConsentWithSponsor:
+		disposal, trashBin = i.conf.Sponsors.ConsentDisposal, i.sponsorTrashBin()
+	case kind == event.KindConsent && c.State == ConsentExpired:
+		disposal, trashBin = DisposalReturn, i.conf.MatchingService.TrashBinAccount
+		if c.ExpiredFrom == ConsentApproved {
+			// Enrolment offers are released by the sponsor
+			trashBin = i.sponsorTrashBin()
+		}
+		if i.conf.Offers.OnExpiry == OnExpiryBurn {
+			disposal = DisposalBurn
+		}
+	case kind == event.KindConsent && c.State == ConsentWithdrawn && i.conf.Participants.WithdrawTo == WithdrawToTrashBin:
+		disposal, trashBin = DisposalBurn, i.conf.MatchingService.TrashBinAccount
+	case kind == event.KindHealthData && c.State == ConsentWithdrawn && i.conf.Sponsors.WithdrawnData == WithdrawnDataDispose:
+		disposal, trashBin = DisposalBurn, i.sponsorTrashBin()
+	default:
+		return ""
+	}
+
+	switch disposal {
+	case "", DisposalBurn:
+		if owner != trashBin {
+			return "never disposed of after the consent was " + string(c.State) + ", still with " + i.name(owner)
+		}
+	case DisposalReturn:
+		if owner != c.MatchingService {
+			return "never returned to " + i.name(c.MatchingService) + " after the consent was " + string(c.State) + ", still with " + i.name(owner)
+		}
+	}
+	return ""
+}
+
+func (i *Inspector) sponsorTrashBin() string {
+	if i.conf.Sponsors.TrashBinAccount != "" {
+		return i.conf.Sponsors.TrashBinAccount
+	}
+	return i.conf.MatchingService.TrashBinAccount
+}
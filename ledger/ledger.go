@@ -0,0 +1,76 @@
+package ledger
+
+import (
+	"errors"
+
+	"github.com/bitmark-inc/bitmark-sdk-go/account"
+	"github.com/bitmark-inc/bitmark-sdk-go/asset"
+	"github.com/bitmark-inc/bitmark-sdk-go/bitmark"
+	"github.com/bitmark-inc/bitmark-sdk-go/tx"
+	"github.com/bitmark-inc/bitmark-sdk-go/utils"
+)
+
+const (
+	SDK    = "sdk"
+	Memory = "memory"
+
+	// PageSize is the most bitmarks the API returns for one query
+	PageSize = 100
+)
+
+var (
+	ErrAssetNotFound   = errors.New("asset not found")
+	ErrBitmarkNotFound = errors.New("bitmark not found")
+	ErrTxNotFound      = errors.New("transaction not found")
+	ErrNotOwner        = errors.New("account is not the owner of the bitmark")
+	ErrOfferPending    = errors.New("bitmark already has a pending offer")
+	ErrNoOffer         = errors.New("bitmark has no pending offer")
+	ErrNotOfferee      = errors.New("account is not the receiver of the offer")
+	ErrNotOfferer      = errors.New("account is not the sender of the offer")
+	ErrUnknownLedger   = errors.New("unknown ledger type")
+)
+
+// Query selects bitmarks from a ledger. Empty fields are not filtered on.
+// At most Limit bitmarks (PageSize by default) are returned, starting at
+// the offset At and going To earlier (the default) or later offsets.
+type Query struct {
+	OwnedBy   string
+	OfferTo   string
+	OfferFrom string
+	IssuedBy  string
+	AssetID   string
+	LoadAsset bool
+
+	At    int
+	To    utils.Direction
+	Limit int
+}
+
+// Ledger is the set of bitmark operations the simulation needs
+type Ledger interface {
+	RegisterAsset(registrant account.Account, name string, metadata map[string]string, content []byte) (string, error)
+	Issue(issuer account.Account, assetID string, quantity int) ([]string, error)
+	Offer(sender account.Account, bitmarkID, receiver string) error
+	Respond(responder account.Account, b *bitmark.Bitmark, action bitmark.OfferResponseAction) (string, error)
+	Transfer(sender account.Account, bitmarkID, receiver string) (string, error)
+
+	GetAsset(assetID string) (*asset.Asset, error)
+	GetBitmark(bitmarkID string) (*bitmark.Bitmark, error)
+	ListBitmarks(q Query) ([]*bitmark.Bitmark, []*asset.Asset, error)
+	GetTx(txID string) (*tx.Tx, error)
+
+	// Provenance returns the transactions of a bitmark, oldest first
+	Provenance(bitmarkID string) ([]*tx.Tx, error)
+}
+
+// New returns the ledger backend of the given type
+func New(ledgerType string) (Ledger, error) {
+	switch ledgerType {
+	case "", SDK:
+		return NewSDKLedger(), nil
+	case Memory:
+		return NewMemoryLedger(), nil
+	default:
+		return nil, ErrUnknownLedger
+	}
+}
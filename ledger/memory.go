@@ -0,0 +1,468 @@
+package ledger
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bitmark-inc/bitmark-sdk-go/account"
+	"github.com/bitmark-inc/bitmark-sdk-go/asset"
+	"github.com/bitmark-inc/bitmark-sdk-go/bitmark"
+	"github.com/bitmark-inc/bitmark-sdk-go/tx"
+	"github.com/bitmark-inc/bitmark-sdk-go/utils"
+	"golang.org/x/crypto/sha3"
+)
+
+// MemoryLedger keeps assets, bitmarks, pending offers and provenance in
+// memory so a simulation can run without the network. Every record is
+// confirmed as soon as it is written.
+type MemoryLedger struct {
+	sync.Mutex
+
+	assets   map[string]*asset.Asset
+	bitmarks map[string]*bitmark.Bitmark
+	txs      map[string]*tx.Tx
+	history  map[string][]string // bitmark id -> tx ids, oldest first
+	offset   int
+}
+
+func NewMemoryLedger() *MemoryLedger {
+	return &MemoryLedger{
+		assets:   make(map[string]*asset.Asset),
+		bitmarks: make(map[string]*bitmark.Bitmark),
+		txs:      make(map[string]*tx.Tx),
+		history:  make(map[string][]string),
+	}
+}
+
+func (l *MemoryLedger) RegisterAsset(registrant account.Account, name string, metadata map[string]string, content []byte) (string, error) {
+	assetParam, err := asset.NewRegistrationParams(name, metadata)
+	if err != nil {
+		return "", err
+	}
+	if err := assetParam.SetFingerprintFromData(content); err != nil {
+		return "", err
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	return l.register(registrant.AccountNumber(), name, assetParam.Fingerprint, metadata), nil
+}
+
+func (l *MemoryLedger) Issue(issuer account.Account, assetID string, quantity int) ([]string, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	bitmarkIDs := make([]string, 0, quantity)
+	for i := 0; i < quantity; i++ {
+		bitmarkID, err := l.issue(issuer.AccountNumber(), assetID)
+		if err != nil {
+			return nil, err
+		}
+		bitmarkIDs = append(bitmarkIDs, bitmarkID)
+	}
+
+	return bitmarkIDs, nil
+}
+
+func (l *MemoryLedger) Offer(sender account.Account, bitmarkID, receiver string) error {
+	if err := account.ValidateAccountNumber(receiver); err != nil {
+		return err
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	return l.offer(sender.AccountNumber(), bitmarkID, receiver, "")
+}
+
+func (l *MemoryLedger) Respond(responder account.Account, b *bitmark.Bitmark, action bitmark.OfferResponseAction) (string, error) {
+	l.Lock()
+	defer l.Unlock()
+	return l.respond(responder.AccountNumber(), b.ID, action)
+}
+
+func (l *MemoryLedger) Transfer(sender account.Account, bitmarkID, receiver string) (string, error) {
+	if err := account.ValidateAccountNumber(receiver); err != nil {
+		return "", err
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	return l.directTransfer(sender.AccountNumber(), bitmarkID, receiver)
+}
+
+func (l *MemoryLedger) GetAsset(assetID string) (*asset.Asset, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	a, ok := l.assets[assetID]
+	if !ok {
+		return nil, ErrAssetNotFound
+	}
+	return copyAsset(a), nil
+}
+
+func (l *MemoryLedger) GetBitmark(bitmarkID string) (*bitmark.Bitmark, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	b, ok := l.bitmarks[bitmarkID]
+	if !ok {
+		return nil, ErrBitmarkNotFound
+	}
+	return copyBitmark(b), nil
+}
+
+// ListBitmarks returns a page of the matching bitmarks. Going to earlier
+// offsets, the most recently changed come first and At 0 starts from the
+// latest one.
+func (l *MemoryLedger) ListBitmarks(q Query) ([]*bitmark.Bitmark, []*asset.Asset, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	bitmarks := make([]*bitmark.Bitmark, 0)
+	for _, b := range l.bitmarks {
+		if q.OwnedBy != "" && b.Owner != q.OwnedBy {
+			continue
+		}
+		if q.OfferTo != "" && (b.Offer == nil || b.Offer.To != q.OfferTo) {
+			continue
+		}
+		if q.OfferFrom != "" && (b.Offer == nil || b.Offer.From != q.OfferFrom) {
+			continue
+		}
+		if q.IssuedBy != "" && b.Issuer != q.IssuedBy {
+			continue
+		}
+		if q.AssetID != "" && b.AssetID != q.AssetID {
+			continue
+		}
+		if q.At > 0 && (q.To == utils.Later && b.Offset < q.At || q.To != utils.Later && b.Offset > q.At) {
+			continue
+		}
+		bitmarks = append(bitmarks, copyBitmark(b))
+	}
+	sort.Slice(bitmarks, func(i, j int) bool {
+		if q.To == utils.Later {
+			return bitmarks[i].Offset < bitmarks[j].Offset
+		}
+		return bitmarks[i].Offset > bitmarks[j].Offset
+	})
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = PageSize
+	}
+	if len(bitmarks) > limit {
+		bitmarks = bitmarks[:limit]
+	}
+
+	assets := make([]*asset.Asset, 0)
+	if q.LoadAsset {
+		loaded := make(map[string]bool)
+		for _, b := range bitmarks {
+			if loaded[b.AssetID] {
+				continue
+			}
+			loaded[b.AssetID] = true
+			assets = append(assets, copyAsset(l.assets[b.AssetID]))
+		}
+	}
+
+	return bitmarks, assets, nil
+}
+
+func (l *MemoryLedger) GetTx(txID string) (*tx.Tx, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	t, ok := l.txs[txID]
+	if !ok {
+		return nil, ErrTxNotFound
+	}
+	copied := *t
+	return &copied, nil
+}
+
+func (l *MemoryLedger) Provenance(bitmarkID string) ([]*tx.Tx, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	txIDs, ok := l.history[bitmarkID]
+	if !ok {
+		return nil, ErrBitmarkNotFound
+	}
+
+	txs := make([]*tx.Tx, 0, len(txIDs))
+	for _, txID := range txIDs {
+		copied := *l.txs[txID]
+		txs = append(txs, &copied)
+	}
+	return txs, nil
+}
+
+// memoryState is how a MemoryLedger is saved, e.g. into a checkpoint
+type memoryState struct {
+	Assets   map[string]*asset.Asset     `json:"assets"`
+	Bitmarks map[string]*bitmark.Bitmark `json:"bitmarks"`
+	Txs      map[string]*tx.Tx           `json:"txs"`
+	History  map[string][]string         `json:"history"`
+	Offset   int                         `json:"offset"`
+}
+
+func (l *MemoryLedger) MarshalJSON() ([]byte, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	return json.Marshal(memoryState{
+		Assets:   l.assets,
+		Bitmarks: l.bitmarks,
+		Txs:      l.txs,
+		History:  l.history,
+		Offset:   l.offset,
+	})
+}
+
+func (l *MemoryLedger) UnmarshalJSON(data []byte) error {
+	restored := NewMemoryLedger()
+	state := memoryState{
+		Assets:   restored.assets,
+		Bitmarks: restored.bitmarks,
+		Txs:      restored.txs,
+		History:  restored.history,
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	l.assets = state.Assets
+	l.bitmarks = state.Bitmarks
+	l.txs = state.Txs
+	l.history = state.History
+	l.offset = state.Offset
+	return nil
+}
+
+// register stores an asset; registering the same fingerprint twice returns the existing asset
+func (l *MemoryLedger) register(registrant, name, fingerprint string, metadata map[string]string) string {
+	digest := sha3.Sum512([]byte(fingerprint))
+	assetID := hex.EncodeToString(digest[:])
+	if _, ok := l.assets[assetID]; ok {
+		return assetID
+	}
+
+	compacted := make(map[string]string)
+	for k, v := range metadata {
+		if k != "" && v != "" {
+			compacted[k] = v
+		}
+	}
+
+	now := time.Now().UTC()
+	l.offset++
+	l.assets[assetID] = &asset.Asset{
+		ID:          assetID,
+		Name:        name,
+		Metadata:    compacted,
+		Fingerprint: fingerprint,
+		Registrant:  registrant,
+		Status:      "confirmed",
+		BlockNumber: l.offset,
+		Offset:      l.offset,
+		CreatedAt:   &now,
+	}
+	return assetID
+}
+
+func (l *MemoryLedger) issue(issuer, assetID string) (string, error) {
+	if _, ok := l.assets[assetID]; !ok {
+		return "", ErrAssetNotFound
+	}
+
+	l.offset++
+	bitmarkID := l.newID("issue", assetID, issuer)
+	now := time.Now().UTC()
+
+	l.txs[bitmarkID] = &tx.Tx{
+		ID:          bitmarkID,
+		Owner:       issuer,
+		BitmarkID:   bitmarkID,
+		AssetID:     assetID,
+		Status:      "confirmed",
+		BlockNumber: l.offset,
+		Offset:      l.offset,
+	}
+	l.history[bitmarkID] = []string{bitmarkID}
+	l.bitmarks[bitmarkID] = &bitmark.Bitmark{
+		ID:          bitmarkID,
+		AssetID:     assetID,
+		LatestTxID:  bitmarkID,
+		Issuer:      issuer,
+		Owner:       issuer,
+		Status:      "settled",
+		BlockNumber: l.offset,
+		Offset:      l.offset,
+		CreatedAt:   now,
+		ConfirmedAt: now,
+	}
+	return bitmarkID, nil
+}
+
+func (l *MemoryLedger) directTransfer(sender, bitmarkID, receiver string) (string, error) {
+	b, ok := l.bitmarks[bitmarkID]
+	if !ok {
+		return "", ErrBitmarkNotFound
+	}
+	if b.Owner != sender {
+		return "", ErrNotOwner
+	}
+	if b.Offer != nil {
+		return "", ErrOfferPending
+	}
+
+	return l.transfer(b, receiver, false), nil
+}
+
+// offer records a pending two-signature transfer. The signature of the
+// sender is kept in the record so that the receiver can countersign it.
+func (l *MemoryLedger) offer(sender, bitmarkID, receiver, signature string) error {
+	b, ok := l.bitmarks[bitmarkID]
+	if !ok {
+		return ErrBitmarkNotFound
+	}
+	if b.Owner != sender {
+		return ErrNotOwner
+	}
+	if b.Offer != nil {
+		return ErrOfferPending
+	}
+
+	l.offset++
+	b.Offset = l.offset
+	b.Offer = &bitmark.TransferOffer{
+		ID:   l.newID("offer", bitmarkID, receiver),
+		From: sender,
+		To:   receiver,
+		Record: &bitmark.CountersignedTransferRequest{
+			Link:      b.LatestTxID,
+			Owner:     receiver,
+			Signature: signature,
+		},
+		CreatedAt: time.Now().UTC(),
+	}
+	return nil
+}
+
+func (l *MemoryLedger) respond(responder, bitmarkID string, action bitmark.OfferResponseAction) (string, error) {
+	b, ok := l.bitmarks[bitmarkID]
+	if !ok {
+		return "", ErrBitmarkNotFound
+	}
+	if b.Offer == nil {
+		return "", ErrNoOffer
+	}
+
+	switch action {
+	case bitmark.Accept:
+		if b.Offer.To != responder {
+			return "", ErrNotOfferee
+		}
+		receiver := b.Offer.To
+		b.Offer = nil
+		return l.transfer(b, receiver, true), nil
+	case bitmark.Reject:
+		if b.Offer.To != responder {
+			return "", ErrNotOfferee
+		}
+	case bitmark.Cancel:
+		if b.Offer.From != responder {
+			return "", ErrNotOfferer
+		}
+	default:
+		return "", fmt.Errorf("unknown offer response action: %s", action)
+	}
+
+	l.offset++
+	b.Offset = l.offset
+	b.Offer = nil
+	return "", nil
+}
+
+func (l *MemoryLedger) bitmarkByLatestTx(txID string) (*bitmark.Bitmark, bool) {
+	for _, b := range l.bitmarks {
+		if b.LatestTxID == txID {
+			return b, true
+		}
+	}
+	return nil, false
+}
+
+func (l *MemoryLedger) bitmarkByOffer(offerID string) (*bitmark.Bitmark, bool) {
+	for _, b := range l.bitmarks {
+		if b.Offer != nil && b.Offer.ID == offerID {
+			return b, true
+		}
+	}
+	return nil, false
+}
+
+func (l *MemoryLedger) transfer(b *bitmark.Bitmark, receiver string, countersign bool) string {
+	l.offset++
+	txID := l.newID("transfer", b.LatestTxID, receiver)
+
+	l.txs[txID] = &tx.Tx{
+		ID:            txID,
+		Owner:         receiver,
+		PreviousID:    b.LatestTxID,
+		PreviousOwner: b.Owner,
+		BitmarkID:     b.ID,
+		AssetID:       b.AssetID,
+		Countersign:   countersign,
+		Status:        "confirmed",
+		BlockNumber:   l.offset,
+		Offset:        l.offset,
+	}
+	l.history[b.ID] = append(l.history[b.ID], txID)
+
+	b.LatestTxID = txID
+	b.Owner = receiver
+	b.BlockNumber = l.offset
+	b.Offset = l.offset
+	b.ConfirmedAt = time.Now().UTC()
+	return txID
+}
+
+// newID derives a unique 32-byte hex id, the size the SDK expects for tx links
+func (l *MemoryLedger) newID(parts ...string) string {
+	h := sha3.New256()
+	for _, p := range parts {
+		h.Write([]byte(p))
+		h.Write([]byte{0})
+	}
+	fmt.Fprintf(h, "%d", l.offset)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func copyAsset(a *asset.Asset) *asset.Asset {
+	copied := *a
+	copied.Metadata = make(map[string]string, len(a.Metadata))
+	for k, v := range a.Metadata {
+		copied.Metadata[k] = v
+	}
+	return &copied
+}
+
+func copyBitmark(b *bitmark.Bitmark) *bitmark.Bitmark {
+	copied := *b
+	if b.Offer != nil {
+		offer := *b.Offer
+		copied.Offer = &offer
+	}
+	return &copied
+}
@@ -0,0 +1,209 @@
+package ledger
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	sdk "github.com/bitmark-inc/bitmark-sdk-go"
+	"github.com/bitmark-inc/bitmark-sdk-go/account"
+	"github.com/bitmark-inc/bitmark-sdk-go/bitmark"
+)
+
+func TestMain(m *testing.M) {
+	// Account numbers encode the network. Requests only go to the mock API.
+	sdk.Init(&sdk.Config{Network: sdk.Testnet, HTTPClient: &http.Client{Timeout: 10 * time.Second}})
+	os.Exit(m.Run())
+}
+
+func newTestAccount(t *testing.T) account.Account {
+	t.Helper()
+	acc, err := account.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return acc
+}
+
+var testAssets int
+
+// issueTestBitmark registers an asset of its own and issues one bitmark of it to owner
+func issueTestBitmark(t *testing.T, l Ledger, owner account.Account) string {
+	t.Helper()
+	testAssets++
+	content := []byte(fmt.Sprintf("test asset %d", testAssets))
+	assetID, err := l.RegisterAsset(owner, fmt.Sprintf("asset %d", testAssets), map[string]string{"Type": "Test"}, content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bitmarkIDs, err := l.Issue(owner, assetID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bitmarkIDs[0]
+}
+
+func TestMemoryLedgerOfferResponses(t *testing.T) {
+	tests := []struct {
+		name      string
+		action    bitmark.OfferResponseAction
+		responder string // sender, receiver or other
+		wantErr   error
+		wantOwner string // sender or receiver
+		wantTxs   int
+	}{
+		{"receiver accepts", bitmark.Accept, "receiver", nil, "receiver", 2},
+		{"receiver rejects", bitmark.Reject, "receiver", nil, "sender", 1},
+		{"sender cancels", bitmark.Cancel, "sender", nil, "sender", 1},
+		{"sender accepts", bitmark.Accept, "sender", ErrNotOfferee, "sender", 1},
+		{"other rejects", bitmark.Reject, "other", ErrNotOfferee, "sender", 1},
+		{"receiver cancels", bitmark.Cancel, "receiver", ErrNotOfferer, "sender", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewMemoryLedger()
+			accounts := map[string]account.Account{
+				"sender":   newTestAccount(t),
+				"receiver": newTestAccount(t),
+				"other":    newTestAccount(t),
+			}
+			bitmarkID := issueTestBitmark(t, l, accounts["sender"])
+			if err := l.Offer(accounts["sender"], bitmarkID, accounts["receiver"].AccountNumber()); err != nil {
+				t.Fatal(err)
+			}
+			b, err := l.GetBitmark(bitmarkID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = l.Respond(accounts[tt.responder], b, tt.action)
+			if err != tt.wantErr {
+				t.Fatalf("Respond() error = %v, want %v", err, tt.wantErr)
+			}
+
+			b, err = l.GetBitmark(bitmarkID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := accounts[tt.wantOwner].AccountNumber(); b.Owner != want {
+				t.Errorf("owner = %s, want the %s %s", b.Owner, tt.wantOwner, want)
+			}
+			if tt.wantErr == nil && b.Offer != nil {
+				t.Errorf("offer still pending after %s", tt.action)
+			}
+			if tt.wantErr != nil && b.Offer == nil {
+				t.Errorf("offer gone after a failed %s", tt.action)
+			}
+			txs, err := l.Provenance(bitmarkID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(txs) != tt.wantTxs {
+				t.Errorf("provenance has %d transactions, want %d", len(txs), tt.wantTxs)
+			}
+		})
+	}
+}
+
+func TestMemoryLedgerErrors(t *testing.T) {
+	l := NewMemoryLedger()
+	owner, receiver := newTestAccount(t), newTestAccount(t)
+	offered := issueTestBitmark(t, l, owner)
+	if err := l.Offer(owner, offered, receiver.AccountNumber()); err != nil {
+		t.Fatal(err)
+	}
+	held := issueTestBitmark(t, l, owner)
+
+	tests := []struct {
+		name    string
+		call    func() error
+		wantErr error
+	}{
+		{"offer by another account", func() error {
+			return l.Offer(receiver, held, owner.AccountNumber())
+		}, ErrNotOwner},
+		{"offer twice", func() error {
+			return l.Offer(owner, offered, receiver.AccountNumber())
+		}, ErrOfferPending},
+		{"transfer with a pending offer", func() error {
+			_, err := l.Transfer(owner, offered, receiver.AccountNumber())
+			return err
+		}, ErrOfferPending},
+		{"transfer by another account", func() error {
+			_, err := l.Transfer(receiver, held, owner.AccountNumber())
+			return err
+		}, ErrNotOwner},
+		{"respond without an offer", func() error {
+			_, err := l.Respond(receiver, &bitmark.Bitmark{ID: held}, bitmark.Accept)
+			return err
+		}, ErrNoOffer},
+		{"unknown bitmark", func() error {
+			_, err := l.GetBitmark("unknown")
+			return err
+		}, ErrBitmarkNotFound},
+		{"issue of an unknown asset", func() error {
+			_, err := l.Issue(owner, "unknown", 1)
+			return err
+		}, ErrAssetNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.call(); err != tt.wantErr {
+				t.Errorf("error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMemoryLedgerRegisterTwice(t *testing.T) {
+	l := NewMemoryLedger()
+	owner := newTestAccount(t)
+	first, err := l.RegisterAsset(owner, "asset", map[string]string{"Type": "Test"}, []byte("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := l.RegisterAsset(owner, "asset", map[string]string{"Type": "Test"}, []byte("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Errorf("the same content was registered as %s and %s", first, second)
+	}
+}
+
+func TestMemoryLedgerJSON(t *testing.T) {
+	l := NewMemoryLedger()
+	owner, receiver := newTestAccount(t), newTestAccount(t)
+	bitmarkID := issueTestBitmark(t, l, owner)
+	if err := l.Offer(owner, bitmarkID, receiver.AccountNumber()); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := NewMemoryLedger()
+	if err := json.Unmarshal(data, restored); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := restored.GetBitmark(bitmarkID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Offer == nil || b.Offer.To != receiver.AccountNumber() {
+		t.Fatalf("the pending offer was not restored: %+v", b.Offer)
+	}
+	if _, err := restored.Respond(receiver, b, bitmark.Accept); err != nil {
+		t.Fatal(err)
+	}
+	if next := issueTestBitmark(t, restored, owner); next == bitmarkID {
+		t.Errorf("the restored ledger issued bitmark %s again", next)
+	}
+}
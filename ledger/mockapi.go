@@ -0,0 +1,381 @@
+package ledger
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	sdk "github.com/bitmark-inc/bitmark-sdk-go"
+	"github.com/bitmark-inc/bitmark-sdk-go/account"
+	"github.com/bitmark-inc/bitmark-sdk-go/asset"
+	"github.com/bitmark-inc/bitmark-sdk-go/bitmark"
+	"github.com/bitmark-inc/bitmark-sdk-go/encoding"
+	"github.com/bitmark-inc/bitmark-sdk-go/utils"
+)
+
+const (
+	tagDirectTransfer        = uint64(4)
+	tagCountersignedTransfer = uint64(5)
+)
+
+var (
+	errInvalidSignature = errors.New("invalid signature")
+	errLinkNotFound     = errors.New("link does not point to the latest transaction of any bitmark")
+	errOfferNotFound    = errors.New("offer not found")
+)
+
+// MockAPI serves the subset of the Bitmark REST API used by bitmark-sdk-go
+// on top of a MemoryLedger. Signatures are checked the same way the real
+// API does so that the SDK's serialization paths are exercised.
+type MockAPI struct {
+	ledger *MemoryLedger
+}
+
+func NewMockAPI(l *MemoryLedger) *MockAPI {
+	return &MockAPI{
+		ledger: l,
+	}
+}
+
+func (m *MockAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	switch {
+	case r.Method == "POST" && path == "/v3/register-asset":
+		m.registerAsset(w, r)
+	case r.Method == "POST" && path == "/v3/issue":
+		m.issue(w, r)
+	case r.Method == "POST" && path == "/v3/transfer":
+		m.transfer(w, r)
+	case r.Method == "PATCH" && path == "/v3/transfer":
+		m.respond(w, r)
+	case r.Method == "GET" && path == "/v3/bitmarks":
+		m.listBitmarks(w, r)
+	case r.Method == "GET" && strings.HasPrefix(path, "/v3/bitmarks/"):
+		m.getBitmark(w, r, strings.TrimPrefix(path, "/v3/bitmarks/"))
+	case r.Method == "GET" && strings.HasPrefix(path, "/v3/assets/"):
+		m.getAsset(w, r, strings.TrimPrefix(path, "/v3/assets/"))
+	case r.Method == "GET" && strings.HasPrefix(path, "/v3/txs/"):
+		m.getTx(w, r, strings.TrimPrefix(path, "/v3/txs/"))
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("%s %s is not supported", r.Method, path))
+	}
+}
+
+func (m *MockAPI) registerAsset(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Assets []*asset.RegistrationParams `json:"assets"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	type registeredItem struct {
+		ID        string `json:"id"`
+		Duplicate bool   `json:"duplicate"`
+	}
+	items := make([]registeredItem, 0, len(req.Assets))
+
+	m.ledger.Lock()
+	defer m.ledger.Unlock()
+
+	for _, params := range req.Assets {
+		message, err := utils.Pack(params)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := verify(params.Registrant, message, params.Signature); err != nil {
+			writeError(w, http.StatusForbidden, err)
+			return
+		}
+
+		existing := len(m.ledger.assets)
+		assetID := m.ledger.register(params.Registrant, params.Name, params.Fingerprint, parseMetadata(params.Metadata))
+		items = append(items, registeredItem{
+			ID:        assetID,
+			Duplicate: existing == len(m.ledger.assets),
+		})
+	}
+
+	writeJSON(w, map[string]interface{}{"assets": items})
+}
+
+func (m *MockAPI) issue(w http.ResponseWriter, r *http.Request) {
+	var req bitmark.IssuanceParams
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	type issuedItem struct {
+		ID string `json:"id"`
+	}
+	items := make([]issuedItem, 0, len(req.Issuances))
+
+	m.ledger.Lock()
+	defer m.ledger.Unlock()
+
+	for _, issuance := range req.Issuances {
+		message, err := utils.Pack(issuance)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := verify(issuance.Owner, message, issuance.Signature); err != nil {
+			writeError(w, http.StatusForbidden, err)
+			return
+		}
+
+		bitmarkID, err := m.ledger.issue(issuance.Owner, issuance.AssetID)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		items = append(items, issuedItem{ID: bitmarkID})
+	}
+
+	writeJSON(w, map[string]interface{}{"bitmarks": items})
+}
+
+// transfer handles both one-signature transfers and two-signature offers
+func (m *MockAPI) transfer(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Transfer *bitmark.TransferRequest `json:"transfer"`
+		Offer    *struct {
+			Record *bitmark.TransferRequest `json:"record"`
+		} `json:"offer"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	record, tag := req.Transfer, tagDirectTransfer
+	if req.Offer != nil {
+		record, tag = req.Offer.Record, tagCountersignedTransfer
+	}
+	if record == nil {
+		writeError(w, http.StatusBadRequest, errors.New("missing transfer record"))
+		return
+	}
+
+	m.ledger.Lock()
+	defer m.ledger.Unlock()
+
+	b, ok := m.ledger.bitmarkByLatestTx(record.Link)
+	if !ok {
+		writeError(w, http.StatusBadRequest, errLinkNotFound)
+		return
+	}
+
+	message, err := packTransfer(tag, record.Link, record.Owner)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := verify(b.Owner, message, record.Signature); err != nil {
+		writeError(w, http.StatusForbidden, err)
+		return
+	}
+
+	if tag == tagCountersignedTransfer {
+		if err := m.ledger.offer(b.Owner, b.ID, record.Owner, record.Signature); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, map[string]interface{}{})
+		return
+	}
+
+	txID, err := m.ledger.directTransfer(b.Owner, b.ID, record.Owner)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, map[string]string{"txID": txID})
+}
+
+func (m *MockAPI) respond(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID               string                      `json:"id"`
+		Action           bitmark.OfferResponseAction `json:"action"`
+		Countersignature string                      `json:"countersignature"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	requester := r.Header.Get("requester")
+	message := strings.Join([]string{"updateOffer", req.ID, requester, r.Header.Get("timestamp")}, "|")
+	if err := verify(requester, []byte(message), r.Header.Get("signature")); err != nil {
+		writeError(w, http.StatusForbidden, err)
+		return
+	}
+
+	m.ledger.Lock()
+	defer m.ledger.Unlock()
+
+	b, ok := m.ledger.bitmarkByOffer(req.ID)
+	if !ok {
+		writeError(w, http.StatusNotFound, errOfferNotFound)
+		return
+	}
+
+	if req.Action == bitmark.Accept {
+		message, err := utils.Pack(b.Offer.Record)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := verify(b.Offer.To, message, req.Countersignature); err != nil {
+			writeError(w, http.StatusForbidden, err)
+			return
+		}
+	}
+
+	txID, err := m.ledger.respond(requester, b.ID, req.Action)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, map[string]string{"txID": txID})
+}
+
+func (m *MockAPI) listBitmarks(w http.ResponseWriter, r *http.Request) {
+	vals := r.URL.Query()
+	q := Query{
+		OwnedBy:   vals.Get("owner"),
+		OfferTo:   vals.Get("offer_to"),
+		OfferFrom: vals.Get("offer_from"),
+		IssuedBy:  vals.Get("issuer"),
+		AssetID:   vals.Get("asset_id"),
+		LoadAsset: vals.Get("asset") == "true",
+		To:        utils.Direction(vals.Get("to")),
+	}
+	for name, value := range map[string]*int{"at": &q.At, "limit": &q.Limit} {
+		if vals.Get(name) == "" {
+			continue
+		}
+		n, err := strconv.Atoi(vals.Get(name))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid %s: %s", name, vals.Get(name)))
+			return
+		}
+		*value = n
+	}
+	if q.Limit > PageSize {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit: max = %d", PageSize))
+		return
+	}
+
+	bitmarks, assets, err := m.ledger.ListBitmarks(q)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"bitmarks": bitmarks,
+		"assets":   assets,
+	})
+}
+
+func (m *MockAPI) getBitmark(w http.ResponseWriter, r *http.Request, bitmarkID string) {
+	b, err := m.ledger.GetBitmark(bitmarkID)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	result := map[string]interface{}{"bitmark": b}
+	if r.URL.Query().Get("asset") == "true" {
+		a, err := m.ledger.GetAsset(b.AssetID)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		result["asset"] = a
+	}
+	writeJSON(w, result)
+}
+
+func (m *MockAPI) getAsset(w http.ResponseWriter, r *http.Request, assetID string) {
+	a, err := m.ledger.GetAsset(assetID)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, map[string]interface{}{"asset": a})
+}
+
+func (m *MockAPI) getTx(w http.ResponseWriter, r *http.Request, txID string) {
+	t, err := m.ledger.GetTx(txID)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, map[string]interface{}{"tx": t})
+}
+
+// packTransfer packs a transfer record the same way the SDK does before signing
+func packTransfer(tag uint64, link, owner string) ([]byte, error) {
+	linkBytes, err := hex.DecodeString(link)
+	if err != nil || len(linkBytes) != 32 {
+		return nil, errors.New("invalid Link")
+	}
+	ownerBytes := encoding.FromBase58(owner)
+	if len(ownerBytes) != account.Base58AccountNumberLength {
+		return nil, errors.New("invalid Owner")
+	}
+	ownerBytes = ownerBytes[:len(ownerBytes)-account.ChecksumLength]
+
+	message := encoding.ToVarint64(tag)
+	message = append(message, encoding.ToVarint64(uint64(len(linkBytes)))...)
+	message = append(message, linkBytes...)
+	message = append(message, 0) // no escrow payment
+	message = append(message, encoding.ToVarint64(uint64(len(ownerBytes)))...)
+	message = append(message, ownerBytes...)
+	return message, nil
+}
+
+func verify(accountNumber string, message []byte, signature string) error {
+	sig, err := hex.DecodeString(signature)
+	if err != nil {
+		return errInvalidSignature
+	}
+	if err := account.Verify(accountNumber, message, sig); err != nil {
+		return errInvalidSignature
+	}
+	return nil
+}
+
+// parseMetadata reverses the compact form built by asset.NewRegistrationParams
+func parseMetadata(compact string) map[string]string {
+	metadata := make(map[string]string)
+	parts := strings.Split(compact, "\u0000")
+	for i := 0; i+1 < len(parts); i += 2 {
+		metadata[parts[i]] = parts[i+1]
+	}
+	return metadata
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(sdk.APIError{
+		Code:    code,
+		Message: http.StatusText(code),
+		Reason:  err.Error(),
+	})
+}
@@ -0,0 +1,200 @@
+package ledger
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	sdk "github.com/bitmark-inc/bitmark-sdk-go"
+	"github.com/bitmark-inc/bitmark-sdk-go/account"
+	"github.com/bitmark-inc/bitmark-sdk-go/bitmark"
+)
+
+// newTestAPI points the SDK to a mock API over a fresh in-memory ledger
+func newTestAPI(t *testing.T) (*MemoryLedger, string) {
+	t.Helper()
+	l := NewMemoryLedger()
+	server := httptest.NewServer(NewMockAPI(l))
+	client := sdk.GetAPIClient()
+	urlAuthority := client.URLAuthority
+	client.URLAuthority = server.URL
+	t.Cleanup(func() {
+		client.URLAuthority = urlAuthority
+		server.Close()
+	})
+	return l, server.URL
+}
+
+// apiErrorCode is the HTTP status of an error returned by the SDK, 0 for none
+func apiErrorCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if apiErr, ok := err.(*sdk.APIError); ok {
+		return apiErr.Code
+	}
+	return -1
+}
+
+func TestMockAPIOfferResponses(t *testing.T) {
+	tests := []struct {
+		name      string
+		action    bitmark.OfferResponseAction
+		responder string // sender, receiver or other
+		wantCode  int
+		wantOwner string // sender or receiver
+	}{
+		{"receiver accepts", bitmark.Accept, "receiver", 0, "receiver"},
+		{"receiver rejects", bitmark.Reject, "receiver", 0, "sender"},
+		{"sender cancels", bitmark.Cancel, "sender", 0, "sender"},
+		{"other accepts", bitmark.Accept, "other", http.StatusForbidden, "sender"},
+		{"other rejects", bitmark.Reject, "other", http.StatusBadRequest, "sender"},
+		{"receiver cancels", bitmark.Cancel, "receiver", http.StatusBadRequest, "sender"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			memory, _ := newTestAPI(t)
+			l := NewSDKLedger()
+			accounts := map[string]account.Account{
+				"sender":   newTestAccount(t),
+				"receiver": newTestAccount(t),
+				"other":    newTestAccount(t),
+			}
+			bitmarkID := issueTestBitmark(t, l, accounts["sender"])
+			if err := l.Offer(accounts["sender"], bitmarkID, accounts["receiver"].AccountNumber()); err != nil {
+				t.Fatal(err)
+			}
+			b, err := l.GetBitmark(bitmarkID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b.Offer == nil {
+				t.Fatal("the offer is not listed")
+			}
+
+			_, err = l.Respond(accounts[tt.responder], b, tt.action)
+			if code := apiErrorCode(err); code != tt.wantCode {
+				t.Fatalf("Respond() error = %v, want status %d", err, tt.wantCode)
+			}
+
+			b, err = memory.GetBitmark(bitmarkID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := accounts[tt.wantOwner].AccountNumber(); b.Owner != want {
+				t.Errorf("owner = %s, want the %s %s", b.Owner, tt.wantOwner, want)
+			}
+			if pending := b.Offer != nil; pending != (tt.wantCode != 0) {
+				t.Errorf("offer pending = %t after %s", pending, tt.action)
+			}
+		})
+	}
+}
+
+func TestMockAPISignatures(t *testing.T) {
+	tests := []struct {
+		name     string
+		call     func(l *SDKLedger, owner, other account.Account, bitmarkID string) error
+		wantCode int
+	}{
+		{"offer by the owner", func(l *SDKLedger, owner, other account.Account, bitmarkID string) error {
+			return l.Offer(owner, bitmarkID, other.AccountNumber())
+		}, 0},
+		{"offer by another account", func(l *SDKLedger, owner, other account.Account, bitmarkID string) error {
+			return l.Offer(other, bitmarkID, other.AccountNumber())
+		}, http.StatusForbidden},
+		{"transfer by the owner", func(l *SDKLedger, owner, other account.Account, bitmarkID string) error {
+			_, err := l.Transfer(owner, bitmarkID, other.AccountNumber())
+			return err
+		}, 0},
+		{"transfer by another account", func(l *SDKLedger, owner, other account.Account, bitmarkID string) error {
+			_, err := l.Transfer(other, bitmarkID, other.AccountNumber())
+			return err
+		}, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			memory, _ := newTestAPI(t)
+			l := NewSDKLedger()
+			owner, other := newTestAccount(t), newTestAccount(t)
+			bitmarkID := issueTestBitmark(t, l, owner)
+
+			err := tt.call(l, owner, other, bitmarkID)
+			if code := apiErrorCode(err); code != tt.wantCode {
+				t.Fatalf("error = %v, want status %d", err, tt.wantCode)
+			}
+
+			b, err := memory.GetBitmark(bitmarkID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantCode != 0 && (b.Owner != owner.AccountNumber() || b.Offer != nil) {
+				t.Errorf("the bitmark changed on a rejected request: owner %s, offer %+v", b.Owner, b.Offer)
+			}
+		})
+	}
+}
+
+func TestMockAPIIssueSignature(t *testing.T) {
+	memory, url := newTestAPI(t)
+	l := NewSDKLedger()
+	owner, other := newTestAccount(t), newTestAccount(t)
+	assetID, err := l.RegisterAsset(owner, "asset", map[string]string{"Type": "Test"}, []byte("issue signature"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params, err := bitmark.NewIssuanceParams(assetID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := params.Sign(owner); err != nil {
+		t.Fatal(err)
+	}
+	// Issue to another account with the signature of the owner
+	params.Issuances[0].Owner = other.AccountNumber()
+	body, err := json.Marshal(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Post(url+"/v3/issue", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+	if bitmarks, _, err := memory.ListBitmarks(Query{AssetID: assetID}); err != nil || len(bitmarks) != 0 {
+		t.Errorf("bitmarks issued = %d (%v), want none", len(bitmarks), err)
+	}
+}
+
+func TestMockAPIListLimit(t *testing.T) {
+	_, url := newTestAPI(t)
+	tests := []struct {
+		query    string
+		wantCode int
+	}{
+		{"", http.StatusOK},
+		{"?limit=100", http.StatusOK},
+		{"?limit=101", http.StatusBadRequest},
+		{"?at=x", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		resp, err := http.Get(url + "/v3/bitmarks" + tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.wantCode {
+			t.Errorf("GET /v3/bitmarks%s status = %d, want %d", tt.query, resp.StatusCode, tt.wantCode)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package ledger
+
+import (
+	"github.com/bitmark-inc/bitmark-sdk-go/asset"
+	"github.com/bitmark-inc/bitmark-sdk-go/bitmark"
+	"github.com/bitmark-inc/bitmark-sdk-go/utils"
+)
+
+// Each pages through every bitmark matching the query, oldest offset
+// first, and calls fn once per bitmark with its asset when the query
+// loads assets. The cursor fields of the query are ignored. A bitmark
+// that changes while paging moves to a later offset and may be seen
+// again on a later page, so it is skipped.
+func Each(l Ledger, q Query, fn func(b *bitmark.Bitmark, a *asset.Asset) error) error {
+	q.At = 0
+	q.To = utils.Later
+	switch {
+	case q.Limit <= 0 || q.Limit > PageSize:
+		q.Limit = PageSize
+	case q.Limit == 1:
+		// Every page after the first starts with the last bitmark of the page
+		// before, so one bitmark a page would never get past it
+		q.Limit = 2
+	}
+
+	seen := make(map[string]bool)
+	for {
+		page, assets, err := l.ListBitmarks(q)
+		if err != nil {
+			return err
+		}
+
+		assetByID := make(map[string]*asset.Asset, len(assets))
+		for _, a := range assets {
+			assetByID[a.ID] = a
+		}
+
+		found := false
+		for _, b := range page {
+			if b.Offset > q.At {
+				q.At = b.Offset
+			}
+			if seen[b.ID] {
+				continue
+			}
+			seen[b.ID] = true
+			found = true
+			if err := fn(b, assetByID[b.AssetID]); err != nil {
+				return err
+			}
+		}
+
+		if len(page) < q.Limit || !found {
+			return nil
+		}
+	}
+}
+
+// Inbox returns every bitmark with a pending offer to the account, and their assets
+func Inbox(l Ledger, account string) ([]*bitmark.Bitmark, map[string]*asset.Asset, error) {
+	return collect(l, Query{OfferTo: account, LoadAsset: true})
+}
+
+// Holdings returns every bitmark owned by the account, and their assets
+func Holdings(l Ledger, account string) ([]*bitmark.Bitmark, map[string]*asset.Asset, error) {
+	return collect(l, Query{OwnedBy: account, LoadAsset: true})
+}
+
+func collect(l Ledger, q Query) ([]*bitmark.Bitmark, map[string]*asset.Asset, error) {
+	bitmarks := make([]*bitmark.Bitmark, 0)
+	assets := make(map[string]*asset.Asset)
+	err := Each(l, q, func(b *bitmark.Bitmark, a *asset.Asset) error {
+		bitmarks = append(bitmarks, b)
+		if a != nil {
+			assets[a.ID] = a
+		}
+		return nil
+	})
+	return bitmarks, assets, err
+}
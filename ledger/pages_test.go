@@ -0,0 +1,200 @@
+package ledger
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/bitmark-inc/bitmark-sdk-go/account"
+	"github.com/bitmark-inc/bitmark-sdk-go/asset"
+	"github.com/bitmark-inc/bitmark-sdk-go/bitmark"
+	"github.com/bitmark-inc/bitmark-sdk-go/utils"
+)
+
+// issueTestBitmarks issues n bitmarks of a new asset to owner, oldest first
+func issueTestBitmarks(t *testing.T, l Ledger, owner account.Account, n int) (string, []string) {
+	t.Helper()
+	testAssets++
+	assetID, err := l.RegisterAsset(owner, "asset", map[string]string{"Type": "Test"}, []byte{byte(testAssets), byte(testAssets >> 8)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bitmarkIDs, err := l.Issue(owner, assetID, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Issued in one go, the bitmarks are ordered by their offsets
+	bitmarks, _, err := l.ListBitmarks(Query{AssetID: assetID, To: utils.Later})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bitmarks) != len(bitmarkIDs) {
+		t.Fatalf("%d bitmarks listed, %d issued", len(bitmarks), len(bitmarkIDs))
+	}
+	for i, b := range bitmarks {
+		bitmarkIDs[i] = b.ID
+	}
+	return assetID, bitmarkIDs
+}
+
+func eachIDs(t *testing.T, l Ledger, q Query) []string {
+	t.Helper()
+	ids := make([]string, 0)
+	err := Each(l, q, func(b *bitmark.Bitmark, a *asset.Asset) error {
+		if q.LoadAsset && (a == nil || a.ID != b.AssetID) {
+			t.Errorf("bitmark %s comes with asset %+v", b.ID, a)
+		}
+		ids = append(ids, b.ID)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+func TestEach(t *testing.T) {
+	l := NewMemoryLedger()
+	owner := newTestAccount(t)
+	assetID, bitmarkIDs := issueTestBitmarks(t, l, owner, 5)
+
+	tests := []struct {
+		name  string
+		query Query
+	}{
+		{"default page", Query{AssetID: assetID}},
+		{"one a page", Query{AssetID: assetID, Limit: 1}},
+		{"two a page", Query{AssetID: assetID, Limit: 2}},
+		{"pages end on the last bitmark", Query{AssetID: assetID, Limit: 5}},
+		{"over the page size", Query{AssetID: assetID, Limit: PageSize + 1}},
+		{"cursor ignored", Query{AssetID: assetID, At: 1 << 20, To: utils.Earlier, Limit: 3}},
+		{"with assets", Query{AssetID: assetID, Limit: 2, LoadAsset: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if ids := eachIDs(t, l, tt.query); !reflect.DeepEqual(ids, bitmarkIDs) {
+				t.Errorf("Each() = %v, want %v", ids, bitmarkIDs)
+			}
+		})
+	}
+}
+
+func TestEachChangesWhilePaging(t *testing.T) {
+	l := NewMemoryLedger()
+	owner, receiver := newTestAccount(t), newTestAccount(t)
+	_, bitmarkIDs := issueTestBitmarks(t, l, owner, 5)
+
+	// Every transfer moves the bitmark past the ones not seen yet
+	seen := make(map[string]int)
+	err := Each(l, Query{IssuedBy: owner.AccountNumber(), Limit: 2}, func(b *bitmark.Bitmark, a *asset.Asset) error {
+		seen[b.ID]++
+		if b.Owner != owner.AccountNumber() {
+			return nil
+		}
+		_, err := l.Transfer(owner, b.ID, receiver.AccountNumber())
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range bitmarkIDs {
+		if seen[id] != 1 {
+			t.Errorf("bitmark %s seen %d times", id, seen[id])
+		}
+	}
+}
+
+func TestEachThroughMockAPI(t *testing.T) {
+	newTestAPI(t)
+	l := NewSDKLedger()
+	owner := newTestAccount(t)
+	assetID, bitmarkIDs := issueTestBitmarks(t, l, owner, 5)
+
+	if ids := eachIDs(t, l, Query{AssetID: assetID, Limit: 2, LoadAsset: true}); !reflect.DeepEqual(ids, bitmarkIDs) {
+		t.Errorf("Each() = %v, want %v", ids, bitmarkIDs)
+	}
+}
+
+func TestListBitmarksCursor(t *testing.T) {
+	l := NewMemoryLedger()
+	owner := newTestAccount(t)
+	assetID, ids := issueTestBitmarks(t, l, owner, 5)
+	offsets := make([]int, len(ids))
+	for i, id := range ids {
+		b, err := l.GetBitmark(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets[i] = b.Offset
+	}
+
+	tests := []struct {
+		name  string
+		at    int
+		to    utils.Direction
+		limit int
+		want  []string
+	}{
+		{"later from the start", 0, utils.Later, 0, ids},
+		{"later from an offset", offsets[2], utils.Later, 0, ids[2:]},
+		{"later with a limit", offsets[1], utils.Later, 2, ids[1:3]},
+		{"earlier from the latest", 0, utils.Earlier, 0, []string{ids[4], ids[3], ids[2], ids[1], ids[0]}},
+		{"earlier from an offset", offsets[2], utils.Earlier, 0, []string{ids[2], ids[1], ids[0]}},
+		{"earlier with a limit", 0, utils.Earlier, 2, []string{ids[4], ids[3]}},
+		{"past the latest", offsets[4] + 1, utils.Later, 0, []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bitmarks, _, err := l.ListBitmarks(Query{AssetID: assetID, At: tt.at, To: tt.to, Limit: tt.limit})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]string, 0, len(bitmarks))
+			for _, b := range bitmarks {
+				got = append(got, b.ID)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ListBitmarks() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInboxAndHoldings(t *testing.T) {
+	l := NewMemoryLedger()
+	owner, receiver := newTestAccount(t), newTestAccount(t)
+	assetID, ids := issueTestBitmarks(t, l, owner, 5)
+	for _, id := range ids[:2] {
+		if err := l.Offer(owner, id, receiver.AccountNumber()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		list func(Ledger, string) ([]*bitmark.Bitmark, map[string]*asset.Asset, error)
+		of   string
+		want int
+	}{
+		{"inbox of the receiver", Inbox, receiver.AccountNumber(), 2},
+		{"inbox of the owner", Inbox, owner.AccountNumber(), 0},
+		{"holdings of the owner", Holdings, owner.AccountNumber(), 5},
+		{"holdings of the receiver", Holdings, receiver.AccountNumber(), 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bitmarks, assets, err := tt.list(l, tt.of)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(bitmarks) != tt.want {
+				t.Errorf("%d bitmarks, want %d", len(bitmarks), tt.want)
+			}
+			if tt.want > 0 && assets[assetID] == nil {
+				t.Errorf("asset %s not loaded", assetID)
+			}
+		})
+	}
+}
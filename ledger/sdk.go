@@ -0,0 +1,156 @@
+package ledger
+
+import (
+	"net/http"
+
+	sdk "github.com/bitmark-inc/bitmark-sdk-go"
+	"github.com/bitmark-inc/bitmark-sdk-go/account"
+	"github.com/bitmark-inc/bitmark-sdk-go/asset"
+	"github.com/bitmark-inc/bitmark-sdk-go/bitmark"
+	"github.com/bitmark-inc/bitmark-sdk-go/tx"
+)
+
+// SDKLedger talks to the Bitmark API through bitmark-sdk-go.
+// The SDK must be initialized with sdk.Init before use.
+type SDKLedger struct{}
+
+func NewSDKLedger() *SDKLedger {
+	return &SDKLedger{}
+}
+
+func (l *SDKLedger) RegisterAsset(registrant account.Account, name string, metadata map[string]string, content []byte) (string, error) {
+	assetParam, err := asset.NewRegistrationParams(name, metadata)
+	if err != nil {
+		return "", err
+	}
+	if err := assetParam.SetFingerprintFromData(content); err != nil {
+		return "", err
+	}
+	if err := assetParam.Sign(registrant); err != nil {
+		return "", err
+	}
+
+	return asset.Register(assetParam)
+}
+
+func (l *SDKLedger) Issue(issuer account.Account, assetID string, quantity int) ([]string, error) {
+	issueParam, err := bitmark.NewIssuanceParams(assetID, quantity)
+	if err != nil {
+		return nil, err
+	}
+	if err := issueParam.Sign(issuer); err != nil {
+		return nil, err
+	}
+
+	return bitmark.Issue(issueParam)
+}
+
+func (l *SDKLedger) Offer(sender account.Account, bitmarkID, receiver string) error {
+	offerParam, err := bitmark.NewOfferParams(receiver, nil)
+	if err != nil {
+		return err
+	}
+	if err := offerParam.FromBitmark(bitmarkID); err != nil {
+		return err
+	}
+	if err := offerParam.Sign(sender); err != nil {
+		return err
+	}
+
+	return bitmark.Offer(offerParam)
+}
+
+func (l *SDKLedger) Respond(responder account.Account, b *bitmark.Bitmark, action bitmark.OfferResponseAction) (string, error) {
+	responseParam := bitmark.NewTransferResponseParams(b, action)
+	if err := responseParam.Sign(responder); err != nil {
+		return "", err
+	}
+
+	return bitmark.Respond(responseParam)
+}
+
+func (l *SDKLedger) Transfer(sender account.Account, bitmarkID, receiver string) (string, error) {
+	transferParam, err := bitmark.NewTransferParams(receiver)
+	if err != nil {
+		return "", err
+	}
+	if err := transferParam.FromBitmark(bitmarkID); err != nil {
+		return "", err
+	}
+	if err := transferParam.Sign(sender); err != nil {
+		return "", err
+	}
+
+	return bitmark.Transfer(transferParam)
+}
+
+func (l *SDKLedger) GetAsset(assetID string) (*asset.Asset, error) {
+	return asset.Get(assetID)
+}
+
+func (l *SDKLedger) GetBitmark(bitmarkID string) (*bitmark.Bitmark, error) {
+	b, err := bitmark.Get(bitmarkID)
+	if apiErr, ok := err.(*sdk.APIError); ok && apiErr.Code == http.StatusNotFound {
+		return nil, ErrBitmarkNotFound
+	}
+	return b, err
+}
+
+func (l *SDKLedger) ListBitmarks(q Query) ([]*bitmark.Bitmark, []*asset.Asset, error) {
+	builder := bitmark.NewQueryParamsBuilder().LoadAsset(q.LoadAsset)
+	if q.OwnedBy != "" {
+		builder = builder.OwnedBy(q.OwnedBy)
+	}
+	if q.OfferTo != "" {
+		builder = builder.OfferTo(q.OfferTo)
+	}
+	if q.OfferFrom != "" {
+		builder = builder.OfferFrom(q.OfferFrom)
+	}
+	if q.IssuedBy != "" {
+		builder = builder.IssuedBy(q.IssuedBy)
+	}
+	if q.AssetID != "" {
+		builder = builder.ReferencedAsset(q.AssetID)
+	}
+	if q.At > 0 {
+		builder = builder.At(q.At)
+	}
+	if q.To != "" {
+		builder = builder.To(q.To)
+	}
+	if q.Limit > 0 {
+		builder = builder.Limit(q.Limit)
+	}
+
+	return bitmark.List(builder)
+}
+
+func (l *SDKLedger) GetTx(txID string) (*tx.Tx, error) {
+	return tx.Get(txID)
+}
+
+// Provenance walks back from the latest transaction of the bitmark to its issue
+func (l *SDKLedger) Provenance(bitmarkID string) ([]*tx.Tx, error) {
+	b, err := bitmark.Get(bitmarkID)
+	if err != nil {
+		return nil, err
+	}
+
+	txs := make([]*tx.Tx, 0)
+	txID := b.LatestTxID
+	for txID != "" {
+		t, err := tx.Get(txID)
+		if err != nil {
+			return nil, err
+		}
+		txs = append([]*tx.Tx{t}, txs...)
+
+		if t.ID == bitmarkID {
+			break
+		}
+		txID = t.PreviousID
+	}
+
+	return txs, nil
+}
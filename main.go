@@ -1,13 +1,27 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 
+	sdk "github.com/bitmark-inc/bitmark-sdk-go"
+	"github.com/bitmark-inc/ct-match/event"
+	"github.com/bitmark-inc/ct-match/ledger"
+	"github.com/bitmark-inc/ct-match/util"
 	cli "gopkg.in/urfave/cli.v1"
 )
 
 var (
-	configFile string
+	configFile     string
+	ledgerType     string
+	seed           int64
+	eventsFile     string
+	reportFile     string
+	checkpointFile string
 )
 
 func main() {
@@ -19,8 +33,32 @@ func main() {
 		if err != nil {
 			return err
 		}
-		s := newSimulator(conf)
-		return s.Simulate()
+		initSDK(conf)
+
+		configPath, err := filepath.Abs(configFile)
+		if err != nil {
+			return err
+		}
+		runID, err := newRunID()
+		if err != nil {
+			return err
+		}
+		run := Run{
+			ID:         runID,
+			ConfigFile: configPath,
+			Ledger:     ledgerType,
+		}
+		if c.IsSet("seed") {
+			util.Seed(seed)
+			run.Seed = &seed
+		}
+
+		l, err := ledger.New(ledgerType)
+		if err != nil {
+			return err
+		}
+
+		return simulate(conf, l, run, nil)
 	}
 
 	app.Flags = []cli.Flag{
@@ -30,6 +68,147 @@ func main() {
 			Usage:       "configuration file",
 			Destination: &configFile,
 		},
+		cli.StringFlag{
+			Name:        "ledger",
+			Value:       ledger.SDK,
+			Usage:       "ledger backend: sdk or memory",
+			Destination: &ledgerType,
+		},
+		cli.Int64Flag{
+			Name:        "seed",
+			Usage:       "seed for random decisions and participant accounts, to replay a run",
+			Destination: &seed,
+		},
+		cli.StringFlag{
+			Name:        "events",
+			Usage:       "write every simulation event to this file as JSON Lines",
+			Destination: &eventsFile,
+		},
+		cli.StringFlag{
+			Name:        "report",
+			Usage:       "write the recruitment funnel report to this file as JSON",
+			Destination: &reportFile,
+		},
+		cli.StringFlag{
+			Name:        "checkpoint",
+			Value:       "ct-match-checkpoint.json",
+			Usage:       "write a checkpoint to this file after every tick, empty to disable",
+			Destination: &checkpointFile,
+		},
+	}
+
+	app.Commands = []cli.Command{
+		{
+			Name:      "resume",
+			Usage:     "continue an interrupted simulation from its last checkpoint",
+			ArgsUsage: "<checkpoint>",
+			Action: func(c *cli.Context) error {
+				if c.NArg() != 1 {
+					return cli.NewExitError("a checkpoint file is required", 1)
+				}
+				checkpointFile = c.Args().First()
+
+				cp, err := loadCheckpoint(checkpointFile)
+				if err != nil {
+					return err
+				}
+
+				conf, err := loadConfig(cp.ConfigFile)
+				if err != nil {
+					return err
+				}
+				initSDK(conf)
+
+				if cp.Seed != nil {
+					util.Seed(*cp.Seed)
+				}
+
+				var l ledger.Ledger = cp.LedgerState
+				if cp.LedgerState == nil {
+					l, err = ledger.New(cp.Ledger)
+					if err != nil {
+						return err
+					}
+				}
+
+				return simulate(conf, l, cp.Run, cp)
+			},
+		},
+		{
+			Name:      "inspect",
+			Usage:     "show the custody chain of a bitmark and check it against the consent protocol",
+			ArgsUsage: "<bitmark-id>",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "checkpoint",
+					Usage: "checkpoint of the run, for its configuration, in-memory ledger, participants and consents",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if c.NArg() != 1 {
+					return cli.NewExitError("a bitmark id is required", 1)
+				}
+
+				i, err := inspectorFor(c.String("checkpoint"))
+				if err != nil {
+					return err
+				}
+				return i.Inspect(os.Stdout, c.Args().First())
+			},
+		},
+		{
+			Name:      "reconcile",
+			Usage:     "check the ledger against the custody of bitmarks in the events of a run",
+			ArgsUsage: "<events-file>",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "checkpoint",
+					Usage: "checkpoint of the run, for its configuration, in-memory ledger and participants",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if c.NArg() != 1 {
+					return cli.NewExitError("an events file is required", 1)
+				}
+
+				i, err := inspectorFor(c.String("checkpoint"))
+				if err != nil {
+					return err
+				}
+
+				custody := newCustody()
+				if err := event.ReadJSONLines(c.Args().First(), custody); err != nil {
+					return err
+				}
+				reconciliation, err := custody.Reconcile(i.ledger)
+				if err != nil {
+					return err
+				}
+				return reconciliation.WriteText(os.Stdout, i.name)
+			},
+		},
+		{
+			Name:  "mock-api",
+			Usage: "serve a local in-memory Bitmark API for the SDK to talk to",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "listen, l",
+					Value: "127.0.0.1:8087",
+					Usage: "address to listen on",
+				},
+				cli.StringFlag{
+					Name:  "network, n",
+					Value: string(sdk.Testnet),
+					Usage: "bitmark network of the accounts to accept",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				sdk.Init(&sdk.Config{Network: sdk.Network(c.String("network"))})
+
+				fmt.Printf("Mock Bitmark API is listening on http://%s\n", c.String("listen"))
+				return http.ListenAndServe(c.String("listen"), ledger.NewMockAPI(ledger.NewMemoryLedger()))
+			},
+		},
 	}
 
 	err := app.Run(os.Args)
@@ -37,3 +216,96 @@ func main() {
 		panic(err)
 	}
 }
+
+// simulate runs the simulation until it completes, from the checkpoint cp if
+// it is not nil, and writes the events and the report that were asked for
+func simulate(conf *Configuration, l ledger.Ledger, run Run, cp *Checkpoint) error {
+	// Stop waiting on the ledger when interrupted
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		cancel()
+	}()
+
+	var sink event.Sink
+	var events *event.JSONLines
+	if eventsFile != "" {
+		var err error
+		if cp == nil {
+			events, err = event.CreateJSONLines(eventsFile)
+		} else {
+			// A resumed run continues the events of the interrupted one
+			events, err = event.AppendJSONLines(eventsFile)
+		}
+		if err != nil {
+			return err
+		}
+		sink = events
+	}
+
+	s := newSimulator(conf, l, sink)
+	s.SaveCheckpoints(checkpointFile, run)
+	if cp != nil {
+		s.Restore(cp)
+	}
+
+	err := s.Simulate(ctx)
+	if events != nil {
+		if closeErr := events.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if reportFile != "" {
+		return writeReport(reportFile, s.Report())
+	}
+	return nil
+}
+
+// inspectorFor looks at the run of a checkpoint, or at the configured
+// ledger when checkpointFile is empty
+func inspectorFor(checkpointFile string) (*Inspector, error) {
+	var cp *Checkpoint
+	if checkpointFile != "" {
+		var err error
+		cp, err = loadCheckpoint(checkpointFile)
+		if err != nil {
+			return nil, err
+		}
+		configFile = cp.ConfigFile
+		ledgerType = cp.Ledger
+	}
+
+	conf, err := loadConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+	initSDK(conf)
+
+	var l ledger.Ledger
+	if cp != nil && cp.LedgerState != nil {
+		l = cp.LedgerState
+	} else if ledgerType == ledger.Memory {
+		return nil, cli.NewExitError("the in-memory ledger of a run is only in its checkpoint", 1)
+	} else if l, err = ledger.New(ledgerType); err != nil {
+		return nil, err
+	}
+
+	return newInspector(conf, l, cp)
+}
+
+func writeReport(fileName string, r *FunnelReport) error {
+	f, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return r.WriteJSON(f)
+}
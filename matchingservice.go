@@ -2,23 +2,38 @@ package main
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/bitmark-inc/bitmark-sdk-go/account"
-	"github.com/bitmark-inc/bitmark-sdk-go/asset"
 	"github.com/bitmark-inc/bitmark-sdk-go/bitmark"
-	"github.com/bitmark-inc/ct-match/util"
+	"github.com/bitmark-inc/ct-match/event"
+	"github.com/bitmark-inc/ct-match/ledger"
+	"github.com/bitmark-inc/ct-match/store"
 )
 
 type MatchingService struct {
-	Account             account.Account
-	Name                string
-	conf                MatchingServiceConf
-	Participants        []*Participant
-	issueMoreBitmarkIDs map[string]*Participant
-	Identities          map[string]string
+	Account      account.Account
+	Name         string
+	conf         MatchingServiceConf
+	ledger       ledger.Ledger
+	events       event.Sink
+	Participants []*Participant
+	Identities   map[string]string
+	policies     MatchingServicePolicies
+	verifier     *Verifier
+	store        *store.Store
 }
 
-func newMatchingService(name, seed string, conf MatchingServiceConf) (*MatchingService, error) {
+func newMatchingService(name, seed string, conf MatchingServiceConf, l ledger.Ledger, events event.Sink) (*MatchingService, error) {
+	switch conf.Matching {
+	case "", MatchingProbability, MatchingEligibility:
+	default:
+		return nil, fmt.Errorf("unknown matching: %s", conf.Matching)
+	}
+	if err := validateDisposal(conf.ConsentDisposal); err != nil {
+		return nil, err
+	}
+
 	acc, err := account.FromSeed(seed)
 	if err != nil {
 		return nil, err
@@ -27,186 +42,263 @@ func newMatchingService(name, seed string, conf MatchingServiceConf) (*MatchingS
 	// fmt.Println(tag + "Initialize matching service with bitmark account: " + acc.AccountNumber())
 
 	return &MatchingService{
-		Account:             acc,
-		conf:                conf,
-		Name:                name,
-		issueMoreBitmarkIDs: make(map[string]*Participant),
+		Account: acc,
+		conf:    conf,
+		ledger:  l,
+		events:  events,
+		Name:    name,
 	}, nil
 }
 
-func (m *MatchingService) IssueMoreTrial(assetIDs []string) ([]string, error) {
-	totalBitmarkIDs := make([]string, 0)
-	for _, assetID := range assetIDs {
-		assetInfo, err := asset.Get(assetID)
+func (m *MatchingService) emit(e event.Event) {
+	e.Time = time.Now().UTC()
+	e.Actor = m.Account.AccountNumber()
+	e.ActorRole = event.RoleMatchingService
+	m.events.Emit(e)
+}
+
+// IssueConsents considers the participants for a trial and issues a
+// consent bitmark for every match. Closed trials are not considered.
+func (m *MatchingService) IssueConsents(t *Trial) ([]*Consent, error) {
+	consents := make([]*Consent, 0)
+	if t.Status == TrialClosed {
+		return consents, nil
+	}
+	if selected, _ := m.policies.SelectTrial.Decide(Decision{
+		Point: DecideSelectTrial,
+		Actor: m.Account.AccountNumber(),
+		Trial: t.Name,
+	}); !selected {
+		return consents, nil
+	}
+
+	trialAsset, err := m.ledger.GetAsset(t.AssetID)
+	if err != nil {
+		return nil, err
+	}
+	criteria, err := criteriaFromMetadata(trialAsset.Metadata)
+	if err != nil {
+		return nil, fmt.Errorf("trial %s: %s", t.AssetID, err)
+	}
+
+	for _, p := range m.Participants {
+		match, reason := m.policies.Match.Decide(Decision{
+			Point:    DecideMatch,
+			Actor:    m.Account.AccountNumber(),
+			Trial:    t.Name,
+			Criteria: criteria,
+			Profile:  p.Profile,
+		})
+
+		if !match {
+			m.emit(event.Event{
+				Type:         event.NoMatch,
+				Counterparty: p.Account.AccountNumber(),
+				Participant:  p.Account.AccountNumber(),
+				Kind:         event.KindTrial,
+				AssetID:      t.AssetID,
+				Asset:        t.Name,
+				TrialID:      t.AssetID,
+				Trial:        t.Name,
+				Reason:       reason,
+			})
+			continue
+		}
+
+		bitmarkIDs, err := m.ledger.Issue(m.Account, t.AssetID, 1)
 		if err != nil {
 			return nil, err
 		}
 
-		if util.RandWithProb(m.conf.SelectAssetProb) {
-			for _, p := range m.Participants {
-				if util.RandWithProb(m.conf.MatchProb) {
-					issueParam, _ := bitmark.NewIssuanceParams(assetID, 1)
-					issueParam.Sign(m.Account)
-
-					bitmarkIDs, err := bitmark.Issue(issueParam)
-					if err != nil {
-						return nil, err
-					}
-
-					bitmarkID := bitmarkIDs[0]
-					totalBitmarkIDs = append(totalBitmarkIDs, bitmarkID)
-					m.issueMoreBitmarkIDs[bitmarkID] = p
-					fmt.Printf("%s considered %s for %s and found a match. %s issued consent bitmark for %s and sent it to %s for acceptance.\n", m.Name, p.Name, assetInfo.Name, m.Name, assetInfo.Name, p.Name)
-				} else {
-					fmt.Printf("%s considered %s for %s and found no match.\n", m.Name, p.Name, assetInfo.Name)
-				}
-			}
-		}
+		bitmarkID := bitmarkIDs[0]
+		consents = append(consents, &Consent{
+			ID:              bitmarkID,
+			State:           ConsentIssued,
+			TrialID:         t.AssetID,
+			Trial:           t.Name,
+			Sponsor:         t.Sponsor,
+			MatchingService: m.Account.AccountNumber(),
+			Participant:     p.Account.AccountNumber(),
+		})
+		m.emit(event.Event{
+			Type:         event.ConsentIssued,
+			Counterparty: p.Account.AccountNumber(),
+			Participant:  p.Account.AccountNumber(),
+			Kind:         event.KindConsent,
+			AssetID:      t.AssetID,
+			Asset:        t.Name,
+			BitmarkID:    bitmarkID,
+			ConsentID:    bitmarkID,
+			TrialID:      t.AssetID,
+			Trial:        t.Name,
+		})
 	}
 
-	return totalBitmarkIDs, nil
+	return consents, nil
 }
 
-func (m *MatchingService) SendTrialToParticipant() error {
-	for issueMoreBitmarkID, pp := range m.issueMoreBitmarkIDs {
-		offerParam, _ := bitmark.NewOfferParams(pp.Account.AccountNumber(), nil)
-		offerParam.FromBitmark(issueMoreBitmarkID)
-		offerParam.Sign(m.Account)
-		if err := bitmark.Offer(offerParam); err != nil {
-			return err
-		}
+// OfferConsent sends the consent bitmark to the participant for acceptance
+func (m *MatchingService) OfferConsent(c *Consent) error {
+	if err := m.ledger.Offer(m.Account, c.ID, c.Participant); err != nil {
+		return err
 	}
-
+	m.emit(event.Event{
+		Type:         event.ConsentOffered,
+		Counterparty: c.Participant,
+		Participant:  c.Participant,
+		Kind:         event.KindConsent,
+		AssetID:      c.TrialID,
+		Asset:        c.Trial,
+		BitmarkID:    c.ID,
+		ConsentID:    c.ID,
+		TrialID:      c.TrialID,
+		Trial:        c.Trial,
+	})
 	return nil
 }
 
-func (m *MatchingService) AcceptTrialBackAndMedicalData() ([]string, error) {
-	builder := bitmark.NewQueryParamsBuilder().
-		OfferTo(m.Account.AccountNumber()).
-		LoadAsset(true)
+// VerifyOffer rejects the offered bitmarks of a consent unless they pass verification
+func (m *MatchingService) VerifyOffer(c *Consent, sender string, bitmarks ...*bitmark.Bitmark) (bool, error) {
+	return verifyOffer(m.verifier, m.ledger, m.Account, m.emit, c, sender, bitmarks...)
+}
 
-	bitmarks, assets, err := bitmark.List(builder)
-	if err != nil {
-		return nil, err
+// AcceptHealthData signs for the health data and consent bitmarks offered by the participant
+func (m *MatchingService) AcceptHealthData(c *Consent, healthData, consent *bitmark.Bitmark) error {
+	if _, err := m.ledger.Respond(m.Account, healthData, bitmark.Accept); err != nil {
+		return err
 	}
-	referencedAssets := make(map[string]*asset.Asset)
-	for _, asset := range assets {
-		referencedAssets[asset.ID] = asset
+	if _, err := m.ledger.Respond(m.Account, consent, bitmark.Accept); err != nil {
+		return err
 	}
 
-	bitmarkIDs := make([]string, 0)
+	accepted := event.Event{
+		Type:         event.OfferAccepted,
+		Counterparty: c.Participant,
+		Participant:  c.Participant,
+		Kind:         event.KindHealthData,
+		AssetID:      c.HealthDataAssetID,
+		Asset:        c.HealthData,
+		BitmarkID:    c.HealthDataID,
+		ConsentID:    c.ID,
+		TrialID:      c.TrialID,
+		Trial:        c.Trial,
+	}
+	m.emit(accepted)
 
-	for _, b := range bitmarks {
-		params := bitmark.NewTransferResponseParams(b, bitmark.Accept)
-		params.Sign(m.Account)
-		if _, err := bitmark.Respond(params); err != nil {
-			return nil, err
-		}
+	accepted.Kind = event.KindConsent
+	accepted.AssetID = c.TrialID
+	accepted.Asset = c.Trial
+	accepted.BitmarkID = c.ID
+	m.emit(accepted)
 
-		bitmarkIDs = append(bitmarkIDs, b.ID)
-
-		assetType, ok := referencedAssets[b.AssetID].Metadata["Type"]
-		if ok {
-			switch assetType {
-			case "Trial":
-				fmt.Printf("%s signed for acceptance of consent data bitmark for %s from %s.\n", m.Name, referencedAssets[b.AssetID].Name, m.Identities[b.Offer.From])
-			case "Health Data":
-				fmt.Printf("%s signed for acceptance of health data bitmark for %s from %s and is evaluating it.\n", m.Name, referencedAssets[b.AssetID].Name, m.Identities[b.Offer.From])
-			default:
-				fmt.Println("Unknow bitmark")
-			}
-		}
+	return nil
+}
+
+// VerifyHealthData checks the health data of a consent against the
+// fingerprint of its asset and returns the profile the intact health data
+// describes. Tampered health data is returned to the participant and the
+// consent is disposed.
+func (m *MatchingService) VerifyHealthData(c *Consent) (Profile, bool, error) {
+	return verifyHealthData(m.ledger, m.store, m.Account, m.emit, c, m.conf.ConsentDisposal, m.conf.TrashBinAccount)
+}
+
+// Evaluate decides on the health data of a consent. Approved health data
+// is forwarded to the sponsor of the trial along with the consent, the
+// other is returned to the participant and the consent is disposed.
+func (m *MatchingService) Evaluate(c *Consent, profile Profile) (bool, error) {
+	if approved, _ := m.policies.ApproveData.Decide(Decision{
+		Point:   DecideApproveData,
+		Actor:   m.Account.AccountNumber(),
+		Trial:   c.Trial,
+		Profile: profile,
+		Consent: c,
+	}); approved {
+		m.emit(event.Event{
+			Type:         event.EvaluationApproved,
+			Counterparty: c.Sponsor,
+			Participant:  c.Participant,
+			Kind:         event.KindHealthData,
+			AssetID:      c.HealthDataAssetID,
+			Asset:        c.HealthData,
+			BitmarkID:    c.HealthDataID,
+			ConsentID:    c.ID,
+			TrialID:      c.TrialID,
+			Trial:        c.Trial,
+		})
+		return true, m.ForwardToSponsor(c)
+	}
+
+	// Send to health data bitmark to participant with one signature transfer
+	if _, err := m.ledger.Transfer(m.Account, c.HealthDataID, c.Participant); err != nil {
+		return false, err
+	}
+
+	rejected := event.Event{
+		Type:         event.EvaluationRejected,
+		Counterparty: c.Participant,
+		Participant:  c.Participant,
+		Kind:         event.KindHealthData,
+		AssetID:      c.HealthDataAssetID,
+		Asset:        c.HealthData,
+		BitmarkID:    c.HealthDataID,
+		ConsentID:    c.ID,
+		TrialID:      c.TrialID,
+		Trial:        c.Trial,
 	}
+	m.emit(rejected)
 
-	return bitmarkIDs, nil
+	returned := rejected
+	returned.Type = event.HealthDataReturned
+	m.emit(returned)
+
+	return false, disposeConsent(m.ledger, m.Account, m.emit, c, m.conf.ConsentDisposal, m.conf.TrashBinAccount, "health data was rejected")
 }
 
-func (m *MatchingService) EvaluateTrialFromParticipant() error {
-	// Query all owning bitmarks
-	builder := bitmark.NewQueryParamsBuilder().
-		OwnedBy(m.Account.AccountNumber()).
-		LoadAsset(true)
+// ForwardToSponsor offers approved health data to the sponsor that registered the trial, along with the consent
+func (m *MatchingService) ForwardToSponsor(c *Consent) error {
+	// Send to the sponsor with two signatures transfer
+	if err := m.ledger.Offer(m.Account, c.HealthDataID, c.Sponsor); err != nil {
+		return err
+	}
 
-	bitmarks, assets, err := bitmark.List(builder)
-	if err != nil {
+	// Also transfer the consent bitmark
+	if err := m.ledger.Offer(m.Account, c.ID, c.Sponsor); err != nil {
 		return err
 	}
-	referencedAssets := make(map[string]*asset.Asset)
-	for _, asset := range assets {
-		referencedAssets[asset.ID] = asset
-	}
-
-	for _, b := range bitmarks {
-		assetType, ok := referencedAssets[b.AssetID].Metadata["Type"]
-		if ok && assetType == "Health Data" {
-			consentBitmarkID, ok := referencedAssets[b.AssetID].Metadata["Trial Bitmark"]
-			if !ok {
-				continue // Continue if cannot find consent bitmark
-			}
-
-			consentBitmark, err := bitmark.Get(consentBitmarkID)
-			if err != nil {
-				return err
-			}
-			consentAsset, err := asset.Get(consentBitmark.AssetID)
-			if err != nil {
-				return err
-			}
-
-			if util.RandWithProb(m.conf.MatchDataApprovalProb) {
-				// Send to sponsor with two signatures transfer
-				sponsorAccountNumber := referencedAssets[b.AssetID].Registrant
-
-				// Transfer medical bitmark
-				medicalOfferParam, _ := bitmark.NewOfferParams(sponsorAccountNumber, nil)
-				medicalOfferParam.FromBitmark(b.ID)
-				medicalOfferParam.Sign(m.Account)
-				if err := bitmark.Offer(medicalOfferParam); err != nil {
-					return err
-				}
-
-				// Also transfer the consent bitmark
-				consentOfferParam, _ := bitmark.NewOfferParams(sponsorAccountNumber, nil)
-				consentOfferParam.FromBitmark(consentBitmark.ID)
-				consentOfferParam.Sign(m.Account)
-				if err := bitmark.Offer(consentOfferParam); err != nil {
-					return err
-				}
-
-				fmt.Printf("%s approved health data bitmark for %s and sent it to %s for evaluation.\n", m.Name, referencedAssets[b.AssetID].Name, m.Identities[sponsorAccountNumber])
-				fmt.Printf("%s sent consent bitmark for %s to %s.\n", m.Name, consentAsset.Name, m.Identities[sponsorAccountNumber])
-			} else {
-				// Send to health data bitmark to participant with one signature transfer
-				participantAccountNumber := referencedAssets[b.AssetID].Registrant
-
-				medicalTransferParam, _ := bitmark.NewTransferParams(participantAccountNumber)
-				medicalTransferParam.FromBitmark(b.ID)
-				medicalTransferParam.Sign(m.Account)
-				_, err := bitmark.Transfer(medicalTransferParam)
-				if err != nil {
-					return err
-				}
-
-				// Send consent into trash bin account (all-zero pubkey account)
-				consentTransferParam, _ := bitmark.NewTransferParams(m.conf.TrashBinAccount)
-				consentTransferParam.FromBitmark(consentBitmarkID)
-				consentTransferParam.Sign(m.Account)
-				_, err = bitmark.Transfer(consentTransferParam)
-				if err != nil {
-					return err
-				}
-
-				fmt.Printf("%s rejected health data bitmark for %s from %s. %s has sent the rejected health data bitmark back to %s.\n",
-					m.Name,
-					referencedAssets[b.AssetID].Name,
-					m.Identities[b.Issuer],
-					m.Name,
-					m.Identities[b.Issuer])
-			}
-		}
+
+	offered := event.Event{
+		Type:         event.HealthDataOffered,
+		Counterparty: c.Sponsor,
+		Participant:  c.Participant,
+		Kind:         event.KindHealthData,
+		AssetID:      c.HealthDataAssetID,
+		Asset:        c.HealthData,
+		BitmarkID:    c.HealthDataID,
+		ConsentID:    c.ID,
+		TrialID:      c.TrialID,
+		Trial:        c.Trial,
 	}
+	m.emit(offered)
 
-	return nil
+	offered.Type = event.ConsentOffered
+	offered.Kind = event.KindConsent
+	offered.AssetID = c.TrialID
+	offered.Asset = c.Trial
+	offered.BitmarkID = c.ID
+	m.emit(offered)
+
+	return grantAccess(m.store, m.Account, m.emit, c, c.Sponsor)
+}
+
+// CancelOffers cancels the expired offers of a consent
+func (m *MatchingService) CancelOffers(c *Consent, ttl time.Duration, bitmarks ...*bitmark.Bitmark) error {
+	return cancelOffers(m.ledger, m.Account, m.emit, c, ttl, bitmarks...)
+}
+
+// ReleaseExpired returns the health data of a consent whose offer expired
+// to the participant and disposes of the consent
+func (m *MatchingService) ReleaseExpired(c *Consent, disposal string) error {
+	return releaseExpired(m.ledger, m.Account, m.emit, c, disposal, m.conf.TrashBinAccount)
 }
 
 func (m *MatchingService) print(a ...interface{}) {
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/bitmark-inc/ct-match/event"
+)
+
+// narrative renders the event stream as the human readable story of the simulation
+type narrative struct {
+	w          io.Writer
+	identities map[string]string
+}
+
+func newNarrative(w io.Writer, identities map[string]string) *narrative {
+	return &narrative{
+		w:          w,
+		identities: identities,
+	}
+}
+
+func (n *narrative) Emit(e event.Event) {
+	if line := n.render(e); line != "" {
+		fmt.Fprintln(n.w, line)
+	}
+}
+
+func (n *narrative) render(e event.Event) string {
+	actor := n.identities[e.Actor]
+	counterparty := n.identities[e.Counterparty]
+	participant := n.identities[e.Participant]
+
+	switch e.Type {
+	case event.TrialRegistered:
+		return fmt.Sprintf("%s announced %s by adding the trial asset and bitmark to the blockchain.", actor, e.Trial)
+	case event.ConsentIssued:
+		return fmt.Sprintf("%s considered %s for %s and found a match. %s issued consent bitmark for %s and sent it to %s for acceptance.", actor, participant, e.Trial, actor, e.Trial, participant)
+	case event.SuspiciousOffer:
+		return fmt.Sprintf("%s rejected %s bitmark %s offered by %s as suspicious: %s.", actor, e.Kind, e.BitmarkID, counterparty, e.Reason)
+	case event.ForeignOffer:
+		// Accounts of other runs may not be known
+		if counterparty == "" {
+			counterparty = e.Counterparty
+		}
+		return fmt.Sprintf("%s left bitmark %s of %s offered by %s untouched, it belongs to %s.", actor, e.BitmarkID, e.Asset, counterparty, e.Reason)
+	case event.ForeignHolding:
+		return fmt.Sprintf("%s holds bitmark %s of %s, which belongs to %s.", actor, e.BitmarkID, e.Asset, e.Reason)
+	case event.NoMatch:
+		if e.Reason != "" {
+			return fmt.Sprintf("%s considered %s for %s and found no match: %s.", actor, participant, e.Trial, e.Reason)
+		}
+		return fmt.Sprintf("%s considered %s for %s and found no match.", actor, participant, e.Trial)
+	case event.OfferAccepted:
+		switch {
+		case e.ActorRole == event.RoleParticipant:
+			return fmt.Sprintf("%s accepted consent bitmark for %s from %s and is considering participation.", actor, e.Asset, counterparty)
+		case e.ActorRole == event.RoleMatchingService && e.Kind == event.KindConsent:
+			return fmt.Sprintf("%s signed for acceptance of consent data bitmark for %s from %s.", actor, e.Asset, counterparty)
+		case e.ActorRole == event.RoleMatchingService && e.Kind == event.KindHealthData:
+			return fmt.Sprintf("%s signed for acceptance of health data bitmark for %s from %s and is evaluating it.", actor, e.Asset, counterparty)
+		case e.ActorRole == event.RoleSponsor && e.Kind == event.KindConsent:
+			return fmt.Sprintf("%s signed for acceptance of consent bitmark for %s from %s.", actor, e.Asset, counterparty)
+		case e.ActorRole == event.RoleSponsor && e.Kind == event.KindHealthData:
+			return fmt.Sprintf("%s signed for acceptance of health data bitmark for %s from %s for %s and is evaluating it.", actor, e.Asset, counterparty, participant)
+		}
+	case event.OfferRejected:
+		if e.Preference != "" {
+			return fmt.Sprintf("%s rejected consent bitmark for %s from %s. %s %s.", actor, e.Asset, counterparty, actor, e.Reason)
+		}
+		return fmt.Sprintf("%s rejected consent bitmark for %s from %s.", actor, e.Asset, counterparty)
+	case event.HealthDataWithheld:
+		if e.Preference != "" {
+			return fmt.Sprintf("%s kept their health data for %s. %s %s, which %s is evaluated on.", actor, e.Trial, actor, e.Reason, e.Trial)
+		}
+		return fmt.Sprintf("%s decided to keep their health data for %s.", actor, e.Trial)
+	case event.HealthDataOffered:
+		if e.ActorRole == event.RoleParticipant {
+			return fmt.Sprintf("%s issued health data bitmark for %s and sent it to %s for evaluation along with consent bitmark.", actor, e.Asset, counterparty)
+		}
+	case event.EvaluationApproved:
+		switch e.ActorRole {
+		case event.RoleMatchingService:
+			return fmt.Sprintf("%s approved health data bitmark for %s and sent it to %s for evaluation.\n%s sent consent bitmark for %s to %s.", actor, e.Asset, counterparty, actor, e.Trial, counterparty)
+		case event.RoleSponsor:
+			if e.Reason == "waitlisted" {
+				return fmt.Sprintf("%s approved health data bitmark for %s from %s, but %s is full and %s is on its waitlist.", actor, e.Asset, participant, e.Trial, participant)
+			}
+			return fmt.Sprintf("%s approved health data bitmark for %s from %s for acceptance into %s and sent consent bitmark to %s for acceptance into %s.", actor, e.Asset, participant, e.Asset, participant, e.Trial)
+		}
+	case event.EvaluationRejected:
+		if e.Reason != "" {
+			return fmt.Sprintf("%s turned down health data bitmark for %s from %s because the %s. %s has sent the health data bitmark back to %s.", actor, e.Asset, participant, e.Reason, actor, participant)
+		}
+		return fmt.Sprintf("%s rejected health data bitmark for %s from %s. %s has sent the rejected health data bitmark back to %s.", actor, e.Asset, participant, actor, participant)
+	case event.Enrolled:
+		return fmt.Sprintf("%s signed for acceptance of consent bitmark from %s and has been successfully entered as a participant in %s.", actor, counterparty, e.Asset)
+	case event.EnrollmentDeclined:
+		return fmt.Sprintf("%s has opted to reject acceptance of consent bitmark from %s and refused the invitation to participate in %s.", actor, counterparty, e.Asset)
+	case event.WithdrawalIssued:
+		return fmt.Sprintf("%s decided to withdraw from %s and issued a withdrawal bitmark for the consent.", actor, e.Trial)
+	case event.ConsentWithdrawn:
+		if counterparty == "" {
+			return fmt.Sprintf("%s withdrew from %s, sent the withdrawal bitmark to the sponsor and disposed of consent bitmark into the trash bin.", actor, e.Trial)
+		}
+		return fmt.Sprintf("%s withdrew from %s and sent consent bitmark back to %s along with the withdrawal bitmark.", actor, e.Trial, counterparty)
+	case event.HealthDataReturned:
+		switch e.Reason {
+		case "withdrawal":
+			return fmt.Sprintf("%s returned health data bitmark %s to %s, who withdrew from %s.", actor, e.Asset, participant, e.Trial)
+		case "offer expired":
+			return fmt.Sprintf("%s returned health data bitmark %s to %s after the offer for %s expired.", actor, e.Asset, participant, e.Trial)
+		case "tampered":
+			return fmt.Sprintf("%s returned tampered health data bitmark %s to %s.", actor, e.Asset, participant)
+		case "trial is full":
+			return fmt.Sprintf("%s returned health data bitmark %s to %s, who waited for a seat in %s that never freed up.", actor, e.Asset, participant, e.Trial)
+		}
+	case event.TrialStatusChanged:
+		status := strings.Replace(e.Status, "_", " ", -1)
+		if e.Reason != "" {
+			return fmt.Sprintf("%s set the recruitment status of %s to %s: %s.", actor, e.Trial, status, e.Reason)
+		}
+		return fmt.Sprintf("%s set the recruitment status of %s to %s.", actor, e.Trial, status)
+	case event.WaitlistPromoted:
+		return fmt.Sprintf("%s took %s off the waitlist of %s, a seat is free, and sent consent bitmark to %s for acceptance into %s.", actor, participant, e.Trial, participant, e.Trial)
+	case event.AccessGranted:
+		return fmt.Sprintf("%s sealed the key of health data %s for %s, who can decrypt it once it accepts the transfer.", actor, e.Asset, counterparty)
+	case event.HealthDataRead:
+		return fmt.Sprintf("%s decrypted health data %s of %s with its access grant.", actor, e.Asset, participant)
+	case event.TamperedHealthData:
+		return fmt.Sprintf("%s found that health data %s of %s was tampered with: its %s.", actor, e.Asset, participant, e.Reason)
+	case event.OfferExpired:
+		return fmt.Sprintf("%s cancelled the offer of %s bitmark for %s to %s, %s.", actor, e.Kind, e.Trial, counterparty, e.Reason)
+	case event.ConsentDisposed:
+		switch e.Disposal {
+		case "return":
+			return fmt.Sprintf("%s returned consent bitmark for %s to %s, which issued it, because the %s.", actor, e.Trial, counterparty, e.Reason)
+		case "keep":
+			return fmt.Sprintf("%s kept consent bitmark for %s for audit because the %s.", actor, e.Trial, e.Reason)
+		default:
+			return fmt.Sprintf("%s disposed of consent bitmark for %s into the trash bin because the %s.", actor, e.Trial, e.Reason)
+		}
+	case event.HealthDataDisposed:
+		return fmt.Sprintf("%s disposed of health data bitmark %s of %s, who withdrew from %s, into the trash bin.", actor, e.Asset, participant, e.Trial)
+	}
+
+	return ""
+}
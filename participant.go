@@ -2,196 +2,355 @@ package main
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/bitmark-inc/bitmark-sdk-go/account"
-	"github.com/bitmark-inc/bitmark-sdk-go/asset"
 	"github.com/bitmark-inc/bitmark-sdk-go/bitmark"
+	"github.com/bitmark-inc/ct-match/event"
+	"github.com/bitmark-inc/ct-match/ledger"
+	"github.com/bitmark-inc/ct-match/store"
 	"github.com/bitmark-inc/ct-match/util"
 )
 
-const (
-	ProcessReceivingTrialBitmarkFromMatchingService int = iota
-	ProcessReceivingTrialBitmarkFromSponsor         int = iota
-)
-
 type Participant struct {
-	Account                  account.Account
-	Name                     string
-	conf                     ParticipantsConf
-	Identities               map[string]string
-	HoldingConsentBitmarkIDs []string
-	IssuedMedicalData        map[string]string // Map between a consent tx and a bitmark id of medical data
+	Account     account.Account
+	Name        string
+	conf        ParticipantsConf
+	ledger      ledger.Ledger
+	events      event.Sink
+	Identities  map[string]string
+	Profile     Profile
+	Preferences Preferences
+	policies    ParticipantPolicies
+	runID       string
+	verifier    *Verifier
+	trashBin    string
+	store       *store.Store
 }
 
-func newParticipant(conf ParticipantsConf) (*Participant, error) {
-	acc, err := account.New()
+func newParticipant(conf ParticipantsConf, l ledger.Ledger, events event.Sink) (*Participant, error) {
+	acc, err := util.NewAccount()
 	if err != nil {
 		return nil, err
 	}
 
-	return &Participant{
-		Account:           acc,
-		Name:              "Participant " + util.ShortenAccountNumber(acc.AccountNumber()),
-		conf:              conf,
-		IssuedMedicalData: make(map[string]string),
-	}, nil
+	p := newParticipantWithAccount(acc, conf, l, events)
+	p.Profile = newProfile(conf.Profiles)
+	p.Preferences = newPreferences(conf.Preferences)
+	return p, nil
 }
 
-func (p *Participant) ProcessRecevingTrialBitmark(fromcase int) ([]string, error) {
-	// p.print("Participant has " + strconv.Itoa(len(p.waitingTransferOffer)) + " transfer requests")
-	bitmarkIDs := make([]string, 0)
-	var prob float64
-	switch fromcase {
-	case ProcessReceivingTrialBitmarkFromMatchingService:
-		prob = p.conf.AcceptTrialInviteProb
-	case ProcessReceivingTrialBitmarkFromSponsor:
-		prob = p.conf.AcceptMatchProb
+func newParticipantWithAccount(acc account.Account, conf ParticipantsConf, l ledger.Ledger, events event.Sink) *Participant {
+	return &Participant{
+		Account: acc,
+		Name:    "Participant " + util.ShortenAccountNumber(acc.AccountNumber()),
+		conf:    conf,
+		ledger:  l,
+		events:  events,
 	}
+}
 
-	builder := bitmark.NewQueryParamsBuilder().
-		OfferTo(p.Account.AccountNumber()).
-		LoadAsset(true)
+func (p *Participant) emit(e event.Event) {
+	e.Time = time.Now().UTC()
+	e.Actor = p.Account.AccountNumber()
+	e.ActorRole = event.RoleParticipant
+	p.events.Emit(e)
+}
 
-	bitmarks, assets, err := bitmark.List(builder)
+// AnswerInvitation accepts or rejects the consent offered by a matching
+// service. A consent for a trial against the preferences of the participant,
+// already taking part in trials others, is rejected.
+func (p *Participant) AnswerInvitation(c *Consent, b *bitmark.Bitmark, trials int) (bool, error) {
+	preference, reason, err := p.checkTrial(c, trials)
 	if err != nil {
-		return nil, err
-	}
-	referencedAssets := make(map[string]*asset.Asset)
-	for _, asset := range assets {
-		referencedAssets[asset.ID] = asset
-	}
-
-	for _, b := range bitmarks {
-		willAccept := util.RandWithProb(prob)
-
-		if willAccept {
-			offerResponseParam := bitmark.NewTransferResponseParams(b, bitmark.Accept)
-			offerResponseParam.Sign(p.Account)
-			if _, err := bitmark.Respond(offerResponseParam); err != nil {
-				return nil, err
-			}
-
-			switch fromcase {
-			case ProcessReceivingTrialBitmarkFromMatchingService:
-				fmt.Printf("%s accepted consent bitmark for %s from %s and is considering participation.\n", p.Name, referencedAssets[b.AssetID].Name, p.Identities[b.Offer.From])
-				bitmarkIDs = append(bitmarkIDs, b.ID)
-			case ProcessReceivingTrialBitmarkFromSponsor:
-				fmt.Printf("%s signed for acceptance of consent bitmark from %s and has been successfully entered as a participant in %s.\n", p.Name, p.Identities[b.Offer.From], referencedAssets[b.AssetID].Name)
-			}
-		} else {
-			offerResponseParam := bitmark.NewTransferResponseParams(b, bitmark.Reject)
-			offerResponseParam.Sign(p.Account)
-			if _, err := bitmark.Respond(offerResponseParam); err != nil {
-				return nil, err
-			}
-
-			switch fromcase {
-			case ProcessReceivingTrialBitmarkFromMatchingService:
-				fmt.Printf("%s rejected consent bitmark for %s from %s.\n", p.Name, referencedAssets[b.AssetID].Name, p.Identities[b.Offer.From])
-			case ProcessReceivingTrialBitmarkFromSponsor:
-				fmt.Printf("%s has opted to reject acceptance of consent bitmark from %s and refused the invitation to participate in %s.\n", p.Name, p.Identities[b.Offer.From], referencedAssets[b.AssetID].Name)
-			}
-		}
+		return false, err
 	}
+	return p.answer(c, b, DecideAcceptInvitation, p.policies.AcceptInvitation, event.OfferAccepted, event.OfferRejected, preference, reason)
+}
 
-	p.HoldingConsentBitmarkIDs = bitmarkIDs
-
-	return bitmarkIDs, nil
+// AnswerEnrolment accepts or rejects the consent offered back by the sponsor
+func (p *Participant) AnswerEnrolment(c *Consent, b *bitmark.Bitmark) (bool, error) {
+	return p.answer(c, b, DecideAcceptEnrolment, p.policies.AcceptEnrolment, event.Enrolled, event.EnrollmentDeclined, "", "")
 }
 
-func (p *Participant) SendBackTrialBitmark() error {
-	for consentBitmarkID, medicalBitmarkID := range p.IssuedMedicalData {
-		consentBitmarkInfo, err := bitmark.Get(consentBitmarkID)
+// checkTrial checks a trial against the preferences of the participant. The
+// trial asset is only read for preferences on its phase or locations.
+func (p *Participant) checkTrial(c *Consent, trials int) (string, string, error) {
+	var phase string
+	var locations []string
+	if len(p.Preferences.Phases) > 0 || p.Preferences.TravelRadius > 0 {
+		a, err := p.ledger.GetAsset(c.TrialID)
 		if err != nil {
-			return err
+			return "", "", err
 		}
+		phase = a.Metadata[metadataPhase]
+		locations = list(a.Metadata, metadataLocations)
+	}
+	preference, reason := p.Preferences.CheckTrial(p.Identities[c.Sponsor], phase, locations, trials, p.Profile.Location)
+	return preference, reason, nil
+}
 
-		matchingServiceAccountNumber := consentBitmarkInfo.Issuer
+// answer rejects the offer for a preference, otherwise as the policy decides
+func (p *Participant) answer(c *Consent, b *bitmark.Bitmark, point string, policy DecisionPolicy, acceptedType, rejectedType event.Type, preference, reason string) (bool, error) {
+	e := event.Event{
+		Counterparty: b.Offer.From,
+		Participant:  p.Account.AccountNumber(),
+		Kind:         event.KindConsent,
+		AssetID:      c.TrialID,
+		Asset:        c.Trial,
+		BitmarkID:    c.ID,
+		ConsentID:    c.ID,
+		TrialID:      c.TrialID,
+		Trial:        c.Trial,
+	}
 
-		// Transfer medical bitmark
-		medicalOfferParam, _ := bitmark.NewOfferParams(matchingServiceAccountNumber, nil)
-		medicalOfferParam.FromBitmark(medicalBitmarkID)
-		medicalOfferParam.Sign(p.Account)
-		if err := bitmark.Offer(medicalOfferParam); err != nil {
-			return err
+	willAccept := preference == ""
+	if willAccept {
+		willAccept, _ = policy.Decide(p.decision(point, c))
+	}
+	if willAccept {
+		if _, err := p.ledger.Respond(p.Account, b, bitmark.Accept); err != nil {
+			return false, err
 		}
-
-		// Also transfer the consent bitmark
-		consentOfferParam, _ := bitmark.NewOfferParams(matchingServiceAccountNumber, nil)
-		consentOfferParam.FromBitmark(consentBitmarkID)
-		consentOfferParam.Sign(p.Account)
-		if err := bitmark.Offer(consentOfferParam); err != nil {
-			return err
+		e.Type = acceptedType
+	} else {
+		if _, err := p.ledger.Respond(p.Account, b, bitmark.Reject); err != nil {
+			return false, err
 		}
+		e.Type = rejectedType
+		e.Preference = preference
+		e.Reason = reason
+	}
+	p.emit(e)
 
-		// Get bitmark info of trial
-		medicalBitmarkInfo, err := bitmark.Get(medicalBitmarkID)
+	return willAccept, nil
+}
+
+// VerifyOffer rejects the offered bitmarks of a consent unless they pass verification
+func (p *Participant) VerifyOffer(c *Consent, sender string, bitmarks ...*bitmark.Bitmark) (bool, error) {
+	return verifyOffer(p.verifier, p.ledger, p.Account, p.emit, c, sender, bitmarks...)
+}
+
+func (p *Participant) decision(point string, c *Consent) Decision {
+	return Decision{
+		Point:   point,
+		Actor:   p.Account.AccountNumber(),
+		Trial:   c.Trial,
+		Profile: p.Profile,
+		Consent: c,
+	}
+}
+
+// SubmitHealthData issues a health data bitmark for the consent, unless the
+// participant decides to keep their data or the trial is evaluated on data
+// they do not share. Categories they do not share are left out of the record.
+func (p *Participant) SubmitHealthData(c *Consent) (bool, error) {
+	withheld := event.Event{
+		Type:         event.HealthDataWithheld,
+		Counterparty: c.MatchingService,
+		Participant:  p.Account.AccountNumber(),
+		Kind:         event.KindConsent,
+		AssetID:      c.TrialID,
+		Asset:        c.Trial,
+		BitmarkID:    c.ID,
+		ConsentID:    c.ID,
+		TrialID:      c.TrialID,
+		Trial:        c.Trial,
+	}
+	if len(p.Preferences.WithheldData) > 0 {
+		a, err := p.ledger.GetAsset(c.TrialID)
 		if err != nil {
-			return err
+			return false, err
 		}
-
-		medicalAsset, err := asset.Get(medicalBitmarkInfo.AssetID)
+		criteria, err := criteriaFromMetadata(a.Metadata)
 		if err != nil {
-			return err
+			return false, fmt.Errorf("trial %s: %s", c.TrialID, err)
 		}
+		if withheld.Preference, withheld.Reason = p.Preferences.CheckData(criteria); withheld.Preference != "" {
+			p.emit(withheld)
+			return false, nil
+		}
+	}
+	if submit, _ := p.policies.SubmitData.Decide(p.decision(DecideSubmitData, c)); !submit {
+		p.emit(withheld)
+		return false, nil
+	}
+
+	shared, vitals := p.Preferences.Shared(p.Profile)
+	record, err := newHealthRecord(p.Account.AccountNumber(), shared, vitals, time.Now().UTC())
+	if err != nil {
+		return false, err
+	}
+	assetName := "health_data_" + p.Name + "_" + p.Identities[c.Sponsor]
+
+	metadata := newMetadata(AssetHealthData)
+	metadata[metadataTrialBitmark] = c.ID
+	metadata[RunIDKey] = p.runID
+	assetID, err := registerAsset(
+		p.ledger,
+		p.Account,
+		assetName,
+		metadata,
+		record,
+	)
+	if err != nil {
+		return false, err
+	}
 
-		identityForReceiver := p.Identities[matchingServiceAccountNumber]
+	bitmarkIDs, err := p.ledger.Issue(p.Account, assetID, 1)
+	if err != nil {
+		return false, err
+	}
+
+	c.HealthDataAssetID = assetID
+	c.HealthData = assetName
+	c.HealthDataID = bitmarkIDs[0]
 
-		fmt.Printf("%s issued health data bitmark for %s and sent it to %s for evaluation along with consent bitmark.\n", p.Name, medicalAsset.Name, identityForReceiver)
+	// Only the fingerprint goes on the ledger, the data itself is kept encrypted off-chain
+	content := record
+	if tamper, _ := p.policies.TamperData.Decide(p.decision(DecideTamperData, c)); tamper {
+		content = append([]byte("ALTERED "), record...)
 	}
-	return nil
+	if err := p.store.Put(p.Account, assetID, content); err != nil {
+		return false, err
+	}
+
+	p.emit(event.Event{
+		Type:         event.HealthDataIssued,
+		Counterparty: c.MatchingService,
+		Participant:  p.Account.AccountNumber(),
+		Kind:         event.KindHealthData,
+		AssetID:      assetID,
+		Asset:        assetName,
+		BitmarkID:    c.HealthDataID,
+		ConsentID:    c.ID,
+		TrialID:      c.TrialID,
+		Trial:        c.Trial,
+	})
+
+	return true, nil
 }
 
-func (p *Participant) IssueMedicalDataBitmark() ([]string, error) {
-	medicalBitmarkIDs := make([]string, 0)
-	for _, consentBitmarkID := range p.HoldingConsentBitmarkIDs {
-		if !util.RandWithProb(p.conf.SubmitDataProb) {
-			continue
-		}
+// IgnoreOffer decides whether the participant leaves an offered consent unanswered
+func (p *Participant) IgnoreOffer(c *Consent) bool {
+	ignore, _ := p.policies.IgnoreOffer.Decide(p.decision(DecideIgnoreOffer, c))
+	return ignore
+}
 
-		consentBitmarkInfo, err := bitmark.Get(consentBitmarkID)
-		if err != nil {
-			return nil, err
-		}
-		consentAsset, err := asset.Get(consentBitmarkInfo.AssetID)
-		if err != nil {
-			return nil, err
-		}
+// Withdrawal destinations of the consent bitmark
+const (
+	WithdrawToSponsor  = "sponsor"
+	WithdrawToTrashBin = "trash_bin"
+)
 
-		medicalContent := "MEDICAL DATA\n" + util.RandStringBytesMaskImprSrc(1000)
+// IssueWithdrawal issues a withdrawal bitmark for an enrolled consent if
+// the participant decides to leave the trial. The withdrawal bitmark is
+// the on-ledger marker telling the sponsor why the consent comes back.
+func (p *Participant) IssueWithdrawal(c *Consent) (bool, error) {
+	if withdraw, _ := p.policies.Withdraw.Decide(p.decision(DecideWithdraw, c)); !withdraw {
+		return false, nil
+	}
 
-		assetParam, err := asset.NewRegistrationParams(
-			"health_data_"+p.Name+"_"+p.Identities[consentAsset.Registrant],
-			map[string]string{
-				"Type":          "Health Data",
-				"Trial Bitmark": consentBitmarkID,
-			},
-		)
+	assetName := "withdrawal_" + p.Name + "_" + p.Identities[c.Sponsor]
+	metadata := newMetadata(AssetWithdrawal)
+	metadata[metadataTrialBitmark] = c.ID
+	metadata[RunIDKey] = p.runID
+	assetID, err := registerAsset(
+		p.ledger,
+		p.Account,
+		assetName,
+		metadata,
+		[]byte("WITHDRAWAL\n"+c.ID),
+	)
+	if err != nil {
+		return false, err
+	}
 
-		assetParam.SetFingerprintFromData([]byte(medicalContent))
-		assetParam.Sign(p.Account)
-		assetID, err := asset.Register(assetParam)
-		if err != nil {
-			return nil, err
-		}
+	bitmarkIDs, err := p.ledger.Issue(p.Account, assetID, 1)
+	if err != nil {
+		return false, err
+	}
+	c.WithdrawalID = bitmarkIDs[0]
+
+	p.emit(event.Event{
+		Type:         event.WithdrawalIssued,
+		Counterparty: c.Sponsor,
+		Participant:  p.Account.AccountNumber(),
+		Kind:         event.KindWithdrawal,
+		AssetID:      assetID,
+		Asset:        assetName,
+		BitmarkID:    c.WithdrawalID,
+		ConsentID:    c.ID,
+		TrialID:      c.TrialID,
+		Trial:        c.Trial,
+	})
+	return true, nil
+}
 
-		issueParam, _ := bitmark.NewIssuanceParams(
-			assetID,
-			1,
-		)
-		issueParam.Sign(p.Account)
-		bitmarkIDs, err := bitmark.Issue(issueParam)
-		if err != nil {
-			return nil, err
-		}
+// SendWithdrawal sends the withdrawal bitmark to the sponsor and the
+// consent bitmark to the sponsor or into the trash bin
+func (p *Participant) SendWithdrawal(c *Consent) error {
+	c.WithdrawnTo = c.Sponsor
+	if p.conf.WithdrawTo == WithdrawToTrashBin {
+		c.WithdrawnTo = p.trashBin
+	}
 
-		bitmarkID := bitmarkIDs[0]
-		medicalBitmarkIDs = append(medicalBitmarkIDs, bitmarkID)
+	if _, err := p.ledger.Transfer(p.Account, c.WithdrawalID, c.Sponsor); err != nil {
+		return err
+	}
+	if _, err := p.ledger.Transfer(p.Account, c.ID, c.WithdrawnTo); err != nil {
+		return err
+	}
 
-		p.IssuedMedicalData[consentBitmarkID] = bitmarkID
+	p.emit(event.Event{
+		Type:         event.ConsentWithdrawn,
+		Counterparty: c.WithdrawnTo,
+		Participant:  p.Account.AccountNumber(),
+		Kind:         event.KindConsent,
+		AssetID:      c.TrialID,
+		Asset:        c.Trial,
+		BitmarkID:    c.ID,
+		ConsentID:    c.ID,
+		TrialID:      c.TrialID,
+		Trial:        c.Trial,
+	})
+	return nil
+}
+
+// SendBackHealthData offers the health data and the consent to the matching service for evaluation
+func (p *Participant) SendBackHealthData(c *Consent) error {
+	// Transfer medical bitmark
+	if err := p.ledger.Offer(p.Account, c.HealthDataID, c.MatchingService); err != nil {
+		return err
+	}
+
+	// Also transfer the consent bitmark
+	if err := p.ledger.Offer(p.Account, c.ID, c.MatchingService); err != nil {
+		return err
+	}
+
+	offered := event.Event{
+		Type:         event.HealthDataOffered,
+		Counterparty: c.MatchingService,
+		Participant:  p.Account.AccountNumber(),
+		Kind:         event.KindHealthData,
+		AssetID:      c.HealthDataAssetID,
+		Asset:        c.HealthData,
+		BitmarkID:    c.HealthDataID,
+		ConsentID:    c.ID,
+		TrialID:      c.TrialID,
+		Trial:        c.Trial,
 	}
+	p.emit(offered)
+
+	offered.Type = event.ConsentOffered
+	offered.Kind = event.KindConsent
+	offered.AssetID = c.TrialID
+	offered.Asset = c.Trial
+	offered.BitmarkID = c.ID
+	p.emit(offered)
 
-	return medicalBitmarkIDs, nil
+	return grantAccess(p.store, p.Account, p.emit, c, c.MatchingService)
 }
 
 func (p *Participant) print(a ...interface{}) {
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/bitmark-inc/ct-match/util"
+)
+
+// Roles as named in the policies configuration
+const (
+	policyRoleMatchingService = "matching_service"
+	policyRoleParticipant     = "participant"
+	policyRoleSponsor         = "sponsor"
+)
+
+// Decision points
+const (
+	DecideSelectTrial      = "select_trial"
+	DecideMatch            = "match"
+	DecideApproveData      = "approve_data"
+	DecideAcceptInvitation = "accept_invitation"
+	DecideSubmitData       = "submit_data"
+	DecideAcceptEnrolment  = "accept_enrolment"
+	DecideWithdraw         = "withdraw"
+	DecideIgnoreOffer      = "ignore_offer"
+	DecideTamperData       = "tamper_data"
+)
+
+// Policy types
+const (
+	PolicyProbability = "probability"
+	PolicyEligibility = "eligibility"
+	PolicyRules       = "rules"
+	PolicyScript      = "script"
+)
+
+// decisionPoints are the decision points of each role
+var decisionPoints = map[string][]string{
+	policyRoleMatchingService: {DecideSelectTrial, DecideMatch, DecideApproveData},
+	policyRoleParticipant:     {DecideAcceptInvitation, DecideSubmitData, DecideAcceptEnrolment, DecideWithdraw, DecideIgnoreOffer, DecideTamperData},
+	policyRoleSponsor:         {DecideApproveData, DecideIgnoreOffer},
+}
+
+// Decision is what a role decides on
+type Decision struct {
+	Point    string
+	Actor    string   // account number of the deciding role
+	Trial    string   // trial name
+	Criteria Criteria // of the trial, when matching
+	Profile  Profile  // of the participant concerned
+	Consent  *Consent // nil until a consent is issued
+}
+
+// DecisionPolicy makes one kind of decision. The reason explains a
+// negative decision and may be empty.
+type DecisionPolicy interface {
+	Decide(d Decision) (bool, string)
+}
+
+// PolicyFactory builds a policy from its configuration. prob is the
+// probability configured for the decision point.
+type PolicyFactory func(conf PolicyConf, prob float64) (DecisionPolicy, error)
+
+var policyFactories = map[string]PolicyFactory{
+	PolicyProbability: func(conf PolicyConf, prob float64) (DecisionPolicy, error) {
+		return probabilityPolicy(prob), nil
+	},
+	PolicyEligibility: func(conf PolicyConf, prob float64) (DecisionPolicy, error) {
+		return eligibilityPolicy(prob), nil
+	},
+	PolicyRules:  newRulesPolicy,
+	PolicyScript: newScriptPolicy,
+}
+
+// RegisterPolicy makes a policy type available to the configuration
+func RegisterPolicy(policyType string, factory PolicyFactory) {
+	policyFactories[policyType] = factory
+}
+
+// probabilityPolicy decides yes with a fixed probability
+type probabilityPolicy float64
+
+func (p probabilityPolicy) Decide(d Decision) (bool, string) {
+	return util.RandWithProb(float64(p)), ""
+}
+
+// eligibilityPolicy matches participants against the criteria of the trial.
+// Trials without criteria are matched with the probability.
+type eligibilityPolicy float64
+
+func (p eligibilityPolicy) Decide(d Decision) (bool, string) {
+	if d.Criteria.Empty() {
+		return util.RandWithProb(float64(p)), ""
+	}
+	return d.Criteria.Check(d.Profile)
+}
+
+// Rule decides when an attribute of the decision equals a value or, for
+// the age, is within bounds
+type Rule struct {
+	Attribute string `hcl:"attribute"` // age, sex, condition, medication, location or trial
+	Equals    string `hcl:"equals"`
+	Min       int    `hcl:"min"`
+	Max       int    `hcl:"max"`
+	Decide    bool   `hcl:"decide"`
+}
+
+func (r Rule) matches(d Decision) bool {
+	if r.Attribute == "age" {
+		return (r.Min == 0 || d.Profile.Age >= r.Min) && (r.Max == 0 || d.Profile.Age <= r.Max)
+	}
+
+	var values []string
+	switch r.Attribute {
+	case "sex":
+		values = []string{d.Profile.Sex}
+	case "condition":
+		values = d.Profile.Conditions
+	case "medication":
+		values = d.Profile.Medications
+	case "location":
+		values = []string{d.Profile.Location}
+	case "trial":
+		values = []string{d.Trial}
+	}
+	return containsAny(values, []string{r.Equals})
+}
+
+func (r Rule) String() string {
+	if r.Attribute == "age" {
+		return fmt.Sprintf("age %d..%d", r.Min, r.Max)
+	}
+	return r.Attribute + " " + r.Equals
+}
+
+// rulesPolicy decides with the first matching rule, or the default
+type rulesPolicy struct {
+	rules []Rule
+	dflt  bool
+}
+
+func newRulesPolicy(conf PolicyConf, prob float64) (DecisionPolicy, error) {
+	for _, r := range conf.Rules {
+		switch r.Attribute {
+		case "age":
+			if r.Min == 0 && r.Max == 0 {
+				return nil, fmt.Errorf("age rule needs min or max")
+			}
+		case "sex", "condition", "medication", "location", "trial":
+			if r.Equals == "" {
+				return nil, fmt.Errorf("%s rule needs equals", r.Attribute)
+			}
+		default:
+			return nil, fmt.Errorf("unknown rule attribute: %s", r.Attribute)
+		}
+	}
+	return &rulesPolicy{
+		rules: conf.Rules,
+		dflt:  conf.Default,
+	}, nil
+}
+
+func (p *rulesPolicy) Decide(d Decision) (bool, string) {
+	for _, r := range p.rules {
+		if r.matches(d) {
+			return r.Decide, "rule " + r.String()
+		}
+	}
+	return p.dflt, ""
+}
+
+// scriptPolicy replays the same answers for every actor, then the default
+type scriptPolicy struct {
+	sync.Mutex
+	answers   []bool
+	dflt      bool
+	positions map[string]int // next answer of each actor
+}
+
+func newScriptPolicy(conf PolicyConf, prob float64) (DecisionPolicy, error) {
+	return &scriptPolicy{
+		answers:   conf.Script,
+		dflt:      conf.Default,
+		positions: make(map[string]int),
+	}, nil
+}
+
+func (p *scriptPolicy) Decide(d Decision) (bool, string) {
+	p.Lock()
+	defer p.Unlock()
+
+	position := p.positions[d.Actor]
+	p.positions[d.Actor]++
+	if position < len(p.answers) {
+		return p.answers[position], "scripted"
+	}
+	return p.dflt, ""
+}
+
+type MatchingServicePolicies struct {
+	SelectTrial DecisionPolicy
+	Match       DecisionPolicy
+	ApproveData DecisionPolicy
+}
+
+type ParticipantPolicies struct {
+	AcceptInvitation DecisionPolicy
+	SubmitData       DecisionPolicy
+	AcceptEnrolment  DecisionPolicy
+	Withdraw         DecisionPolicy
+	IgnoreOffer      DecisionPolicy
+	TamperData       DecisionPolicy
+}
+
+type SponsorPolicies struct {
+	ApproveData DecisionPolicy
+	IgnoreOffer DecisionPolicy
+}
+
+// Policies are the decision policies of every role
+type Policies struct {
+	MatchingService MatchingServicePolicies
+	Participant     ParticipantPolicies
+	Sponsor         SponsorPolicies
+}
+
+func newPolicies(conf *Configuration) (*Policies, error) {
+	if err := conf.Policies.validate(); err != nil {
+		return nil, err
+	}
+
+	p := &Policies{}
+	var err error
+	for _, target := range p.targets() {
+		if *target.policy, err = newPolicy(conf, target.role, target.point); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+type policyTarget struct {
+	role   string
+	point  string
+	policy *DecisionPolicy
+}
+
+func (p *Policies) targets() []policyTarget {
+	return []policyTarget{
+		{policyRoleMatchingService, DecideSelectTrial, &p.MatchingService.SelectTrial},
+		{policyRoleMatchingService, DecideMatch, &p.MatchingService.Match},
+		{policyRoleMatchingService, DecideApproveData, &p.MatchingService.ApproveData},
+		{policyRoleParticipant, DecideAcceptInvitation, &p.Participant.AcceptInvitation},
+		{policyRoleParticipant, DecideSubmitData, &p.Participant.SubmitData},
+		{policyRoleParticipant, DecideAcceptEnrolment, &p.Participant.AcceptEnrolment},
+		{policyRoleParticipant, DecideWithdraw, &p.Participant.Withdraw},
+		{policyRoleParticipant, DecideIgnoreOffer, &p.Participant.IgnoreOffer},
+		{policyRoleParticipant, DecideTamperData, &p.Participant.TamperData},
+		{policyRoleSponsor, DecideApproveData, &p.Sponsor.ApproveData},
+		{policyRoleSponsor, DecideIgnoreOffer, &p.Sponsor.IgnoreOffer},
+	}
+}
+
+func newPolicy(conf *Configuration, role, point string) (DecisionPolicy, error) {
+	policyConf := conf.policyConf(role, point)
+	factory, ok := policyFactories[policyConf.Type]
+	if !ok {
+		return nil, fmt.Errorf("%s %s: unknown policy type: %s", role, point, policyConf.Type)
+	}
+
+	policy, err := factory(policyConf, conf.decisionProb(role, point))
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %s", role, point, err)
+	}
+	return policy, nil
+}
+
+// policyConf returns the configured policy of a decision point. Without
+// one, decisions are made with the configured probability, and matches
+// follow the `matching` setting of the matching services.
+func (c *Configuration) policyConf(role, point string) PolicyConf {
+	var configured map[string]PolicyConf
+	switch role {
+	case policyRoleMatchingService:
+		configured = c.Policies.MatchingService
+	case policyRoleParticipant:
+		configured = c.Policies.Participant
+	case policyRoleSponsor:
+		configured = c.Policies.Sponsor
+	}
+
+	if policyConf, ok := configured[point]; ok && policyConf.Type != "" {
+		return policyConf
+	}
+	if role == policyRoleMatchingService && point == DecideMatch && c.MatchingService.Matching == MatchingEligibility {
+		return PolicyConf{Type: PolicyEligibility}
+	}
+	return PolicyConf{Type: PolicyProbability}
+}
+
+// decisionProb returns the probability configured for a decision point
+func (c *Configuration) decisionProb(role, point string) float64 {
+	switch role + "." + point {
+	case policyRoleMatchingService + "." + DecideSelectTrial:
+		return c.MatchingService.SelectAssetProb
+	case policyRoleMatchingService + "." + DecideMatch:
+		return c.MatchingService.MatchProb
+	case policyRoleMatchingService + "." + DecideApproveData:
+		return c.MatchingService.MatchDataApprovalProb
+	case policyRoleParticipant + "." + DecideAcceptInvitation:
+		return c.Participants.AcceptTrialInviteProb
+	case policyRoleParticipant + "." + DecideSubmitData:
+		return c.Participants.SubmitDataProb
+	case policyRoleParticipant + "." + DecideAcceptEnrolment:
+		return c.Participants.AcceptMatchProb
+	case policyRoleParticipant + "." + DecideWithdraw:
+		return c.Participants.WithdrawProb
+	case policyRoleParticipant + "." + DecideIgnoreOffer:
+		return c.Participants.IgnoreOfferProb
+	case policyRoleParticipant + "." + DecideTamperData:
+		return c.Participants.TamperDataProb
+	case policyRoleSponsor + "." + DecideIgnoreOffer:
+		return c.Sponsors.IgnoreOfferProb
+	case policyRoleSponsor + "." + DecideApproveData:
+		return c.Sponsors.DataApprovalProb
+	}
+	return 0
+}
+
+// validate rejects decision points that do not exist
+func (c PoliciesConf) validate() error {
+	configured := map[string]map[string]PolicyConf{
+		policyRoleMatchingService: c.MatchingService,
+		policyRoleParticipant:     c.Participant,
+		policyRoleSponsor:         c.Sponsor,
+	}
+	for role, policies := range configured {
+		for point := range policies {
+			if !contains(decisionPoints[role], point) {
+				return fmt.Errorf("%s has no decision point %s, expected one of: %s", role, point, strings.Join(decisionPoints[role], ", "))
+			}
+		}
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// scriptPositions returns how far every scripted policy got, to be checkpointed
+func (p *Policies) scriptPositions() map[string]map[string]int {
+	positions := make(map[string]map[string]int)
+	for _, target := range p.targets() {
+		if script, ok := (*target.policy).(*scriptPolicy); ok {
+			script.Lock()
+			copied := make(map[string]int, len(script.positions))
+			for actor, position := range script.positions {
+				copied[actor] = position
+			}
+			script.Unlock()
+			positions[target.role+"."+target.point] = copied
+		}
+	}
+	return positions
+}
+
+func (p *Policies) restoreScriptPositions(positions map[string]map[string]int) {
+	for _, target := range p.targets() {
+		if script, ok := (*target.policy).(*scriptPolicy); ok {
+			if restored, ok := positions[target.role+"."+target.point]; ok && restored != nil {
+				script.positions = restored
+			}
+		}
+	}
+}
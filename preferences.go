@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/bitmark-inc/ct-match/util"
+)
+
+// Preferences a participant declines a consent or keeps their health data for
+const (
+	PreferenceMaxConcurrentTrials = "max_concurrent_trials"
+	PreferenceExcludedSponsors    = "excluded_sponsors"
+	PreferencePhases              = "phases"
+	PreferenceTravelRadius        = "travel_radius"
+	PreferenceWithheldData        = "withheld_data"
+)
+
+// Categories of the health data a participant may keep to themselves
+const (
+	DataConditions  = "conditions"
+	DataMedications = "medications"
+	DataVitalSigns  = "vital_signs"
+)
+
+// Preferences are the constraints a participant puts on the trials they
+// take part in. Empty fields do not restrict.
+type Preferences struct {
+	MaxConcurrentTrials int      `json:"max_concurrent_trials,omitempty"`
+	ExcludedSponsors    []string `json:"excluded_sponsors,omitempty"`
+	Phases              []string `json:"phases,omitempty"`        // acceptable phases, trials without a phase always are
+	TravelRadius        int      `json:"travel_radius,omitempty"` // km to the nearest location of the trial
+	WithheldData        []string `json:"withheld_data,omitempty"` // data categories not shared
+}
+
+// newPreferences draws random preferences from the configured pools.
+// Nothing is drawn for a preference that is not configured.
+func newPreferences(conf PreferencesConf) Preferences {
+	var p Preferences
+	if conf.MaxConcurrentTrialsMax > 0 {
+		p.MaxConcurrentTrials = util.RandWithRange(conf.MaxConcurrentTrialsMin, conf.MaxConcurrentTrialsMax+1)
+	}
+	for _, sponsor := range conf.Sponsors {
+		if util.RandWithProb(conf.ExcludedSponsorProb) {
+			p.ExcludedSponsors = append(p.ExcludedSponsors, sponsor)
+		}
+	}
+	for _, phase := range conf.Phases {
+		if util.RandWithProb(conf.PhaseProb) {
+			p.Phases = append(p.Phases, phase)
+		}
+	}
+	if conf.TravelRadiusMax > 0 {
+		p.TravelRadius = util.RandWithRange(conf.TravelRadiusMin, conf.TravelRadiusMax+1)
+	}
+	for _, category := range conf.DataCategories {
+		if util.RandWithProb(conf.WithholdDataProb) {
+			p.WithheldData = append(p.WithheldData, category)
+		}
+	}
+	return p
+}
+
+func (c PreferencesConf) validate() error {
+	if c.MaxConcurrentTrialsMax > 0 && c.MaxConcurrentTrialsMax < c.MaxConcurrentTrialsMin {
+		return fmt.Errorf("max_concurrent_trials_max %d is under max_concurrent_trials_min %d", c.MaxConcurrentTrialsMax, c.MaxConcurrentTrialsMin)
+	}
+	if c.TravelRadiusMax > 0 && c.TravelRadiusMax < c.TravelRadiusMin {
+		return fmt.Errorf("travel_radius_max %d is under travel_radius_min %d", c.TravelRadiusMax, c.TravelRadiusMin)
+	}
+	for _, category := range c.DataCategories {
+		switch category {
+		case DataConditions, DataMedications, DataVitalSigns:
+		default:
+			return fmt.Errorf("unknown data category: %s", category)
+		}
+	}
+	return nil
+}
+
+// CheckTrial tells whether a participant would join a trial of sponsor with
+// the phase and locations of its asset. trials is the number of other trials
+// they take part in and location where they live. If they would not, it
+// returns the preference the trial goes against and why.
+func (p Preferences) CheckTrial(sponsor, phase string, locations []string, trials int, location string) (string, string) {
+	if p.MaxConcurrentTrials > 0 && trials >= p.MaxConcurrentTrials {
+		if trials == 1 {
+			return PreferenceMaxConcurrentTrials, "already takes part in a trial"
+		}
+		return PreferenceMaxConcurrentTrials, fmt.Sprintf("already takes part in %d trials", trials)
+	}
+	if containsAny([]string{sponsor}, p.ExcludedSponsors) {
+		return PreferenceExcludedSponsors, "does not take part in trials of " + sponsor
+	}
+	if phase != "" && len(p.Phases) > 0 && !containsAny(strings.Split(phase, "/"), p.Phases) {
+		return PreferencePhases, "does not take part in " + phase + " trials"
+	}
+	if p.TravelRadius > 0 && location != "" && len(locations) > 0 {
+		if !withinReach(location, locations, float64(p.TravelRadius)) {
+			return PreferenceTravelRadius, fmt.Sprintf("does not travel further than %d km from %s", p.TravelRadius, location)
+		}
+	}
+	return "", ""
+}
+
+// CheckData tells whether the participant shares what the criteria of a
+// trial are evaluated on, and if not, why
+func (p Preferences) CheckData(criteria Criteria) (string, string) {
+	needed := make([]string, 0, 2)
+	if len(criteria.Conditions) > 0 || len(criteria.ExcludedConditions) > 0 {
+		needed = append(needed, DataConditions)
+	}
+	if len(criteria.ExcludedMedications) > 0 {
+		needed = append(needed, DataMedications)
+	}
+	for _, category := range needed {
+		if containsAny([]string{category}, p.WithheldData) {
+			return PreferenceWithheldData, "does not share " + strings.Replace(category, "_", " ", -1)
+		}
+	}
+	return "", ""
+}
+
+// Shared is the part of a profile the participant shares, and whether they
+// share their vital signs
+func (p Preferences) Shared(profile Profile) (Profile, bool) {
+	if containsAny([]string{DataConditions}, p.WithheldData) {
+		profile.Conditions = make([]string, 0)
+	}
+	if containsAny([]string{DataMedications}, p.WithheldData) {
+		profile.Medications = make([]string, 0)
+	}
+	return profile, !containsAny([]string{DataVitalSigns}, p.WithheldData)
+}
+
+// Coordinates of the locations of the sample configuration, in degrees
+var cityCoordinates = map[string][2]float64{
+	"los angeles":   {34.0522, -118.2437},
+	"san francisco": {37.7749, -122.4194},
+	"palo alto":     {37.4419, -122.1430},
+	"stanford":      {37.4275, -122.1697},
+	"san diego":     {32.7157, -117.1611},
+	"la jolla":      {32.8328, -117.2713},
+	"cypress":       {33.8170, -118.0373},
+	"irvine":        {33.6846, -117.8265},
+	"orange":        {33.7879, -117.8531},
+	"sacramento":    {38.5816, -121.4944},
+	"oakland":       {37.8044, -122.2712},
+}
+
+// withinReach reports whether any of the locations is within radius km of
+// from. The distance to a location without coordinates is unknown, so it
+// may be within reach.
+func withinReach(from string, locations []string, radius float64) bool {
+	a, ok := cityCoordinates[strings.ToLower(from)]
+	for _, to := range locations {
+		if strings.EqualFold(from, to) {
+			return true
+		}
+		b, ok2 := cityCoordinates[strings.ToLower(to)]
+		if !ok || !ok2 || distance(a, b) <= radius {
+			return true
+		}
+	}
+	return false
+}
+
+// distance is the great-circle distance between two coordinates in km
+func distance(a, b [2]float64) float64 {
+	const earthRadius = 6371
+	rad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat, dLon := rad(b[0]-a[0]), rad(b[1]-a[1])
+	h := math.Pow(math.Sin(dLat/2), 2) + math.Cos(rad(a[0]))*math.Cos(rad(b[0]))*math.Pow(math.Sin(dLon/2), 2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(h))
+}
+
+// concurrentTrials counts the other trials a participant takes part in:
+// those of consents accepted and neither declined, rejected nor withdrawn
+func (s *Simulator) concurrentTrials(participant, trialID string) int {
+	trials := make(map[string]bool)
+	for _, c := range s.consents {
+		if c.Participant != participant || c.TrialID == trialID {
+			continue
+		}
+		switch {
+		case c.State == ConsentIssued, c.State == ConsentOffered:
+		case c.State == ConsentOfferExpired && c.ExpiredFrom == ConsentOffered:
+		case c.State == ConsentParticipating, !c.State.Final():
+			trials[c.TrialID] = true
+		}
+	}
+	return len(trials)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"github.com/bitmark-inc/ct-match/util"
+)
+
+// Profile is what a matching service knows about a participant
+type Profile struct {
+	Age         int      `json:"age"`
+	Sex         string   `json:"sex"`
+	Conditions  []string `json:"conditions"`
+	Medications []string `json:"medications"`
+	Location    string   `json:"location"`
+}
+
+// newProfile draws a random profile from the configured pools
+func newProfile(conf ProfilesConf) Profile {
+	p := Profile{
+		Age:         util.RandWithRange(conf.AgeMin, conf.AgeMax+1),
+		Sex:         "female",
+		Conditions:  make([]string, 0),
+		Medications: make([]string, 0),
+	}
+	if util.RandWithProb(0.5) {
+		p.Sex = "male"
+	}
+
+	for _, condition := range conf.Conditions {
+		if util.RandWithProb(conf.ConditionProb) {
+			p.Conditions = append(p.Conditions, condition)
+		}
+	}
+	for _, medication := range conf.Medications {
+		if util.RandWithProb(conf.MedicationProb) {
+			p.Medications = append(p.Medications, medication)
+		}
+	}
+	if len(conf.Locations) > 0 {
+		p.Location = conf.Locations[util.RandWithRange(0, len(conf.Locations))]
+	}
+
+	return p
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/bitmark-inc/ct-match/event"
+	"github.com/bitmark-inc/ct-match/ledger"
+)
+
+// custody is an event sink working out who should hold every consent and
+// health data bitmark of the run, and which offers should be pending
+type custody struct {
+	sync.Mutex
+
+	Order    []string          `json:"order"`    // bitmark ids, in the order they were issued
+	Kinds    map[string]string `json:"kinds"`    // bitmark id -> kind
+	Consents map[string]string `json:"consents"` // bitmark id -> consent id
+	Owners   map[string]string `json:"owners"`   // bitmark id -> account
+	Offers   map[string]string `json:"offers"`   // bitmark id -> receiver of the pending offer
+}
+
+func newCustody() *custody {
+	return &custody{
+		Order:    make([]string, 0),
+		Kinds:    make(map[string]string),
+		Consents: make(map[string]string),
+		Owners:   make(map[string]string),
+		Offers:   make(map[string]string),
+	}
+}
+
+func (c *custody) Emit(e event.Event) {
+	c.Lock()
+	defer c.Unlock()
+
+	switch e.Type {
+	case event.ConsentIssued, event.HealthDataIssued:
+		c.Order = append(c.Order, e.BitmarkID)
+		c.Kinds[e.BitmarkID] = e.Kind
+		c.Consents[e.BitmarkID] = e.ConsentID
+		c.Owners[e.BitmarkID] = e.Actor
+	case event.ConsentOffered, event.HealthDataOffered:
+		c.Offers[e.BitmarkID] = e.Counterparty
+	case event.OfferAccepted, event.Enrolled:
+		c.Owners[e.BitmarkID] = e.Actor
+		delete(c.Offers, e.BitmarkID)
+	case event.OfferRejected, event.EnrollmentDeclined, event.OfferExpired:
+		delete(c.Offers, e.BitmarkID)
+	case event.SuspiciousOffer:
+		// Every bitmark offered for the consent was rejected
+		for id, consentID := range c.Consents {
+			if consentID == e.ConsentID && c.Offers[id] == e.Actor {
+				delete(c.Offers, id)
+			}
+		}
+	case event.HealthDataReturned, event.HealthDataDisposed, event.ConsentDisposed, event.ConsentWithdrawn:
+		c.Owners[e.BitmarkID] = e.Counterparty
+	}
+}
+
+// Mismatch is a bitmark whose ledger state differs from what the events say
+type Mismatch struct {
+	BitmarkID string `json:"bitmark_id"`
+	Kind      string `json:"kind"`
+	ConsentID string `json:"consent_id"`
+	Problem   string `json:"problem"` // ReconcileOwner, ReconcileOffer or ReconcileLost
+	Expected  string `json:"expected,omitempty"`
+	Actual    string `json:"actual,omitempty"`
+}
+
+// Problems reconciliation finds
+const (
+	ReconcileOwner = "owner"         // held by another account than expected
+	ReconcileOffer = "pending_offer" // an offer is left pending, or is not there when expected
+	ReconcileLost  = "lost"          // not found on the ledger
+)
+
+type Reconciliation struct {
+	Checked    int        `json:"checked"`
+	Mismatches []Mismatch `json:"mismatches"`
+}
+
+// Reconcile compares the ledger with the custody the events worked out.
+// The run is over, so every offer still pending is orphaned.
+func (c *custody) Reconcile(l ledger.Ledger) (*Reconciliation, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	r := &Reconciliation{Mismatches: make([]Mismatch, 0)}
+	for _, id := range c.Order {
+		r.Checked++
+		m := Mismatch{BitmarkID: id, Kind: c.Kinds[id], ConsentID: c.Consents[id]}
+
+		b, err := l.GetBitmark(id)
+		if err == ledger.ErrBitmarkNotFound {
+			m.Problem, m.Expected = ReconcileLost, c.Owners[id]
+			r.Mismatches = append(r.Mismatches, m)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bitmark %s: %s", id, err)
+		}
+
+		if b.Owner != c.Owners[id] {
+			m.Problem, m.Expected, m.Actual = ReconcileOwner, c.Owners[id], b.Owner
+			r.Mismatches = append(r.Mismatches, m)
+		}
+
+		offer := c.Offers[id]
+		if b.Offer != nil {
+			m.Problem, m.Expected, m.Actual = ReconcileOffer, offer, b.Offer.To
+			r.Mismatches = append(r.Mismatches, m)
+		} else if offer != "" {
+			m.Problem, m.Expected, m.Actual = ReconcileOffer, offer, ""
+			r.Mismatches = append(r.Mismatches, m)
+		}
+	}
+	return r, nil
+}
+
+// WriteText writes the mismatches with the accounts named by name
+func (r *Reconciliation) WriteText(w io.Writer, name func(account string) string) error {
+	if len(r.Mismatches) == 0 {
+		_, err := fmt.Fprintf(w, "%d bitmarks are where the events say\n", r.Checked)
+		return err
+	}
+
+	fmt.Fprintf(w, "%d mismatches with the events among %d bitmarks\n", len(r.Mismatches), r.Checked)
+	for _, m := range r.Mismatches {
+		var err error
+		switch m.Problem {
+		case ReconcileLost:
+			_, err = fmt.Fprintf(w, "  lost: %s bitmark %s, expected with %s\n", m.Kind, m.BitmarkID, name(m.Expected))
+		case ReconcileOwner:
+			_, err = fmt.Fprintf(w, "  owner: %s bitmark %s is with %s, expected with %s\n", m.Kind, m.BitmarkID, name(m.Actual), name(m.Expected))
+		case ReconcileOffer:
+			if m.Actual == "" {
+				_, err = fmt.Fprintf(w, "  pending offer: %s bitmark %s has no offer, expected one to %s\n", m.Kind, m.BitmarkID, name(m.Expected))
+			} else {
+				_, err = fmt.Fprintf(w, "  pending offer: %s bitmark %s is left offered to %s\n", m.Kind, m.BitmarkID, name(m.Actual))
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TrialStatus is the recruitment status of a trial
+type TrialStatus string
+
+const (
+	TrialRecruiting     TrialStatus = "recruiting"
+	TrialEnrollmentFull TrialStatus = "enrollment_full" // approved participants go to the waitlist
+	TrialClosed         TrialStatus = "closed"          // no more consents or approvals
+)
+
+// Reasons the recruitment status gives for closing a trial and rejecting
+// health data, which the funnel leaves out of the conversions of the policies
+const (
+	reasonNotRecruiting = "the study is not recruiting"
+	reasonTrialClosed   = "trial is closed"
+)
+
+// Overall statuses of ClinicalTrials.gov studies that still recruit
+var recruitingStudies = map[string]bool{
+	"RECRUITING":              true,
+	"NOT_YET_RECRUITING":      true,
+	"ENROLLING_BY_INVITATION": true,
+}
+
+// Recruiting reports whether the study is open to new participants. Studies
+// without a status are.
+func (s *Study) Recruiting() bool {
+	if s.Status == "" {
+		return true
+	}
+	status := strings.ToUpper(strings.Replace(strings.TrimSpace(s.Status), " ", "_", -1))
+	return recruitingStudies[status]
+}
+
+// holdsSeat reports whether a consent takes up a seat of its trial: the
+// sponsor offered enrolment, or the participant enrolled and did not
+// withdraw yet
+func (c *Consent) holdsSeat() bool {
+	switch c.State {
+	case ConsentApproved, ConsentEnrolled, ConsentParticipating, ConsentWithdrawing, ConsentWithdrawalSent:
+		return true
+	case ConsentOfferExpired:
+		return c.ExpiredFrom == ConsentApproved
+	}
+	return false
+}
+
+// full reports whether taken seats reach the capacity of the trial
+func (t *Trial) full(taken int) bool {
+	return t.Capacity > 0 && taken >= t.Capacity
+}
+
+// seats counts the seats taken in a trial, and how many of them may still
+// be given back by a declined enrolment, an expiry or a withdrawal
+func (s *Simulator) seats(t *Trial) (taken, releasable int) {
+	for _, c := range s.consents {
+		if c.TrialID != t.AssetID || !c.holdsSeat() {
+			continue
+		}
+		taken++
+		if c.State != ConsentParticipating {
+			releasable++
+		}
+	}
+	return taken, releasable
+}
+
+func (s *Simulator) trial(assetID string) (*Trial, error) {
+	for _, t := range s.trials {
+		if t.AssetID == assetID {
+			return t, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown trial %s", assetID)
+}
+
+// updateRecruitment works out the recruitment status of a trial from its
+// seats and waitlist, and has the sponsor announce a change. A closed
+// trial stays closed.
+func (s *Simulator) updateRecruitment(t *Trial) error {
+	if t.Status == TrialClosed {
+		return nil
+	}
+
+	status := TrialRecruiting
+	taken, _ := s.seats(t)
+	waitlistSize := s.conf.Sponsors.WaitlistSize
+	switch {
+	case t.full(taken) && waitlistSize > 0 && len(t.Waitlist) >= waitlistSize:
+		status = TrialClosed
+	case t.full(taken):
+		status = TrialEnrollmentFull
+	}
+	if status == t.Status || status == TrialRecruiting && t.Status == "" {
+		return nil
+	}
+
+	t.Status = status
+	ss, ok := s.sponsorByAccount[t.Sponsor]
+	if !ok {
+		return fmt.Errorf("trial %s: unknown sponsor %s", t.AssetID, t.Sponsor)
+	}
+	reason := ""
+	if status == TrialClosed {
+		reason = "the waitlist is full"
+	}
+	ss.AnnounceStatus(t, reason)
+	return nil
+}
+
+func removeConsent(ids []string, id string) []string {
+	kept := make([]string, 0, len(ids))
+	for _, i := range ids {
+		if i != id {
+			kept = append(kept, i)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,108 @@
+package main
+
+import "testing"
+
+func TestHoldsSeat(t *testing.T) {
+	tests := []struct {
+		state       ConsentState
+		expiredFrom ConsentState
+		want        bool
+	}{
+		{ConsentForwardedToSponsor, "", false},
+		{ConsentWaitlisted, "", false},
+		{ConsentApproved, "", true},
+		{ConsentEnrolled, "", true},
+		{ConsentParticipating, "", true},
+		{ConsentWithdrawing, "", true},
+		{ConsentWithdrawalSent, "", true},
+		{ConsentWithdrawn, "", false},
+		{ConsentEnrollmentDeclined, "", false},
+		{ConsentOfferExpired, ConsentApproved, true},
+		{ConsentOfferExpired, ConsentOffered, false},
+		{ConsentExpired, ConsentApproved, false},
+	}
+
+	for _, tt := range tests {
+		c := &Consent{State: tt.state, ExpiredFrom: tt.expiredFrom}
+		if got := c.holdsSeat(); got != tt.want {
+			t.Errorf("holdsSeat() of %s expired from %q = %t, want %t", tt.state, tt.expiredFrom, got, tt.want)
+		}
+	}
+}
+
+func TestSeats(t *testing.T) {
+	trial := &Trial{AssetID: "trial", Capacity: 3}
+	s := &Simulator{consents: []*Consent{
+		{TrialID: "trial", State: ConsentParticipating},
+		{TrialID: "trial", State: ConsentApproved},
+		{TrialID: "trial", State: ConsentOfferExpired, ExpiredFrom: ConsentApproved},
+		{TrialID: "trial", State: ConsentWaitlisted},
+		{TrialID: "trial", State: ConsentWithdrawn},
+		{TrialID: "other", State: ConsentParticipating},
+	}}
+
+	taken, releasable := s.seats(trial)
+	if taken != 3 || releasable != 2 {
+		t.Errorf("seats() = %d, %d, want 3, 2", taken, releasable)
+	}
+
+	tests := []struct {
+		capacity int
+		taken    int
+		want     bool
+	}{
+		{0, 10, false},
+		{3, 2, false},
+		{3, 3, true},
+		{3, 4, true},
+	}
+	for _, tt := range tests {
+		trial.Capacity = tt.capacity
+		if got := trial.full(tt.taken); got != tt.want {
+			t.Errorf("full(%d) of a trial of %d = %t, want %t", tt.taken, tt.capacity, got, tt.want)
+		}
+	}
+}
+
+func TestWaitlist(t *testing.T) {
+	tests := []struct {
+		name            string
+		waitlistSize    int
+		acceptEnrolment float64
+		wantStatus      TrialStatus
+		wantStates      map[ConsentState]int
+		wantPromoted    int
+	}{
+		{"released once the seat is taken", 0, 1, TrialEnrollmentFull,
+			map[ConsentState]int{ConsentParticipating: 1, ConsentWaitlistReleased: 2}, 0},
+		{"released when the trial closes", 1, 1, TrialClosed,
+			map[ConsentState]int{ConsentParticipating: 1, ConsentWaitlistReleased: 2}, 0},
+		{"promoted when enrolment is declined", 0, 0, TrialRecruiting,
+			map[ConsentState]int{ConsentEnrollmentDeclined: 3}, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Three participants approved for a single seat
+			conf := newTestConfig(t, 3)
+			conf.Sponsors.EnrollmentTarget = 1
+			conf.Sponsors.WaitlistSize = tt.waitlistSize
+			conf.Participants.AcceptMatchProb = tt.acceptEnrolment
+
+			s := runTestSimulation(t, conf)
+			states := consentStates(s)
+			for state, want := range tt.wantStates {
+				if states[state] != want {
+					t.Errorf("consents = %v, want %v", states, tt.wantStates)
+					break
+				}
+			}
+			if status := s.trials[0].Status; status != tt.wantStatus {
+				t.Errorf("trial is %s, want %s", status, tt.wantStatus)
+			}
+			if promoted := s.Report().Total.Promoted; promoted != tt.wantPromoted {
+				t.Errorf("%d promoted from the waitlist, want %d", promoted, tt.wantPromoted)
+			}
+		})
+	}
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/bitmark-inc/ct-match/event"
+)
+
+// FunnelCounts are the number of consents that reached each recruitment stage
+type FunnelCounts struct {
+	Trials               int `json:"trials_announced"`
+	NotRecruiting        int `json:"trials_not_recruiting"` // closed when registered, never considered
+	Considered           int `json:"participants_considered"`
+	Consents             int `json:"consents_issued"`
+	Accepted             int `json:"invitations_accepted"`
+	Rejected             int `json:"invitations_rejected"`
+	RejectedByPreference int `json:"invitations_rejected_by_preference"`
+	Submitted            int `json:"health_data_submitted"`
+	WithheldByPreference int `json:"health_data_withheld_by_preference"`
+	MSApproved           int `json:"ms_approvals"`
+	MSRejected           int `json:"ms_rejections"`
+	SponsorApproved      int `json:"sponsor_approvals"`
+	SponsorRejected      int `json:"sponsor_rejections"`
+	RejectedAsClosed     int `json:"sponsor_rejections_trial_closed"`
+	Enrolled             int `json:"enrolments"`
+	EnrollmentDeclined   int `json:"enrolments_declined"`
+	Suspicious           int `json:"suspicious_offers"`
+	Tampered             int `json:"tampered_health_data"`
+	Waitlisted           int `json:"waitlisted"`
+	Promoted             int `json:"promoted_from_waitlist"`
+	Withdrawn            int `json:"withdrawals"`
+	Expired              int `json:"expired_offers"`
+}
+
+type FunnelRow struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	FunnelCounts
+}
+
+// ForeignCounts are the bitmarks of other runs found with an account
+type ForeignCounts struct {
+	Offered int `json:"offered"`
+	Held    int `json:"held"`
+}
+
+type ForeignRow struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	ForeignCounts
+}
+
+// Conversion compares an observed conversion rate with the probability configured for it
+type Conversion struct {
+	Stage      string   `json:"stage"`
+	Knob       string   `json:"knob"`
+	Configured *float64 `json:"configured,omitempty"` // nil when the stage is not decided by a probability
+	Observed   float64  `json:"observed"`
+	Samples    int      `json:"samples"`
+}
+
+type FunnelReport struct {
+	Total            FunnelCounts `json:"total"`
+	Conversions      []Conversion `json:"conversions"`
+	Trials           []FunnelRow  `json:"trials"`
+	Sponsors         []FunnelRow  `json:"sponsors"`
+	MatchingServices []FunnelRow  `json:"matching_services"`
+	Foreign          []ForeignRow `json:"foreign_bitmarks,omitempty"`
+}
+
+type consentOrigin struct {
+	Trial           string `json:"trial"`
+	MatchingService string `json:"matching_service"`
+}
+
+// funnel is an event sink counting how far every consent got
+type funnel struct {
+	sync.Mutex
+	conf *Configuration
+
+	trialNames   map[string]string
+	trialSponsor map[string]string
+	consents     map[string]consentOrigin
+	selected     map[string]bool // matching service + trial pairs considered
+
+	total            FunnelCounts
+	trials           map[string]*FunnelCounts
+	sponsors         map[string]*FunnelCounts
+	matchingServices map[string]*FunnelCounts
+	foreign          map[string]*ForeignCounts
+}
+
+func newFunnel(conf *Configuration) *funnel {
+	return &funnel{
+		conf:             conf,
+		trialNames:       make(map[string]string),
+		trialSponsor:     make(map[string]string),
+		consents:         make(map[string]consentOrigin),
+		selected:         make(map[string]bool),
+		trials:           make(map[string]*FunnelCounts),
+		sponsors:         make(map[string]*FunnelCounts),
+		matchingServices: make(map[string]*FunnelCounts),
+		foreign:          make(map[string]*ForeignCounts),
+	}
+}
+
+func (f *funnel) Emit(e event.Event) {
+	f.Lock()
+	defer f.Unlock()
+
+	switch e.Type {
+	case event.TrialRegistered:
+		f.trialNames[e.TrialID] = e.Trial
+		f.trialSponsor[e.TrialID] = e.Actor
+		f.count(e.TrialID, "", func(c *FunnelCounts) { c.Trials++ })
+	case event.ConsentIssued, event.NoMatch:
+		key := e.Actor + "|" + e.TrialID
+		if !f.selected[key] {
+			f.selected[key] = true
+			counts(f.matchingServices, e.Actor).Trials++
+		}
+		if e.Type == event.ConsentIssued {
+			f.consents[e.ConsentID] = consentOrigin{Trial: e.TrialID, MatchingService: e.Actor}
+			f.count(e.TrialID, e.Actor, func(c *FunnelCounts) { c.Considered++; c.Consents++ })
+		} else {
+			f.count(e.TrialID, e.Actor, func(c *FunnelCounts) { c.Considered++ })
+		}
+	case event.OfferAccepted:
+		if e.ActorRole == event.RoleParticipant {
+			f.countConsent(e, func(c *FunnelCounts) { c.Accepted++ })
+		}
+	case event.OfferRejected:
+		if e.ActorRole == event.RoleParticipant {
+			f.countConsent(e, func(c *FunnelCounts) { c.Rejected++ })
+			if e.Preference != "" {
+				f.countConsent(e, func(c *FunnelCounts) { c.RejectedByPreference++ })
+			}
+		}
+	case event.HealthDataWithheld:
+		if e.Preference != "" {
+			f.countConsent(e, func(c *FunnelCounts) { c.WithheldByPreference++ })
+		}
+	case event.HealthDataOffered:
+		if e.ActorRole == event.RoleParticipant {
+			f.countConsent(e, func(c *FunnelCounts) { c.Submitted++ })
+		}
+	case event.EvaluationApproved:
+		switch e.ActorRole {
+		case event.RoleMatchingService:
+			f.countConsent(e, func(c *FunnelCounts) { c.MSApproved++ })
+		case event.RoleSponsor:
+			f.countConsent(e, func(c *FunnelCounts) { c.SponsorApproved++ })
+			if e.Reason == "waitlisted" {
+				f.countConsent(e, func(c *FunnelCounts) { c.Waitlisted++ })
+			}
+		}
+	case event.EvaluationRejected:
+		switch e.ActorRole {
+		case event.RoleMatchingService:
+			f.countConsent(e, func(c *FunnelCounts) { c.MSRejected++ })
+		case event.RoleSponsor:
+			f.countConsent(e, func(c *FunnelCounts) { c.SponsorRejected++ })
+			if e.Reason == reasonTrialClosed {
+				f.countConsent(e, func(c *FunnelCounts) { c.RejectedAsClosed++ })
+			}
+		}
+	case event.TrialStatusChanged:
+		if e.Status == string(TrialClosed) && e.Reason == reasonNotRecruiting {
+			f.count(e.TrialID, "", func(c *FunnelCounts) { c.NotRecruiting++ })
+		}
+	case event.Enrolled:
+		f.countConsent(e, func(c *FunnelCounts) { c.Enrolled++ })
+	case event.EnrollmentDeclined:
+		f.countConsent(e, func(c *FunnelCounts) { c.EnrollmentDeclined++ })
+	case event.OfferExpired:
+		if e.Kind == event.KindConsent {
+			f.countConsent(e, func(c *FunnelCounts) { c.Expired++ })
+		}
+	case event.ConsentWithdrawn:
+		f.countConsent(e, func(c *FunnelCounts) { c.Withdrawn++ })
+	case event.SuspiciousOffer:
+		f.countConsent(e, func(c *FunnelCounts) { c.Suspicious++ })
+	case event.TamperedHealthData:
+		f.countConsent(e, func(c *FunnelCounts) { c.Tampered++ })
+	case event.WaitlistPromoted:
+		f.countConsent(e, func(c *FunnelCounts) { c.Promoted++ })
+	case event.ForeignOffer:
+		f.foreignCounts(e.Actor).Offered++
+	case event.ForeignHolding:
+		f.foreignCounts(e.Actor).Held++
+	}
+}
+
+// countConsent attributes an event to the trial and matching service of its consent
+func (f *funnel) countConsent(e event.Event, inc func(*FunnelCounts)) {
+	origin, ok := f.consents[e.ConsentID]
+	if !ok {
+		origin = consentOrigin{Trial: e.TrialID}
+	}
+	f.count(origin.Trial, origin.MatchingService, inc)
+}
+
+func (f *funnel) count(trialID, matchingService string, inc func(*FunnelCounts)) {
+	inc(&f.total)
+	if trialID != "" {
+		inc(counts(f.trials, trialID))
+		if sponsor, ok := f.trialSponsor[trialID]; ok {
+			inc(counts(f.sponsors, sponsor))
+		}
+	}
+	if matchingService != "" {
+		inc(counts(f.matchingServices, matchingService))
+	}
+}
+
+func (f *funnel) foreignCounts(account string) *ForeignCounts {
+	c, ok := f.foreign[account]
+	if !ok {
+		c = &ForeignCounts{}
+		f.foreign[account] = c
+	}
+	return c
+}
+
+func counts(m map[string]*FunnelCounts, id string) *FunnelCounts {
+	c, ok := m[id]
+	if !ok {
+		c = &FunnelCounts{}
+		m[id] = c
+	}
+	return c
+}
+
+// funnelState is how the counts are saved into a checkpoint
+type funnelState struct {
+	TrialNames       map[string]string         `json:"trial_names"`
+	TrialSponsor     map[string]string         `json:"trial_sponsor"`
+	Consents         map[string]consentOrigin  `json:"consents"`
+	Selected         map[string]bool           `json:"selected"`
+	Total            FunnelCounts              `json:"total"`
+	Trials           map[string]*FunnelCounts  `json:"trials"`
+	Sponsors         map[string]*FunnelCounts  `json:"sponsors"`
+	MatchingServices map[string]*FunnelCounts  `json:"matching_services"`
+	Foreign          map[string]*ForeignCounts `json:"foreign,omitempty"`
+}
+
+func (f *funnel) MarshalJSON() ([]byte, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	return json.Marshal(funnelState{
+		TrialNames:       f.trialNames,
+		TrialSponsor:     f.trialSponsor,
+		Consents:         f.consents,
+		Selected:         f.selected,
+		Total:            f.total,
+		Trials:           f.trials,
+		Sponsors:         f.sponsors,
+		MatchingServices: f.matchingServices,
+		Foreign:          f.foreign,
+	})
+}
+
+func (f *funnel) UnmarshalJSON(data []byte) error {
+	restored := newFunnel(nil)
+	state := funnelState{
+		TrialNames:       restored.trialNames,
+		TrialSponsor:     restored.trialSponsor,
+		Consents:         restored.consents,
+		Selected:         restored.selected,
+		Trials:           restored.trials,
+		Sponsors:         restored.sponsors,
+		MatchingServices: restored.matchingServices,
+		Foreign:          restored.foreign,
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	f.trialNames = state.TrialNames
+	f.trialSponsor = state.TrialSponsor
+	f.consents = state.Consents
+	f.selected = state.Selected
+	f.total = state.Total
+	f.trials = state.Trials
+	f.sponsors = state.Sponsors
+	f.matchingServices = state.MatchingServices
+	f.foreign = state.Foreign
+	return nil
+}
+
+// Report builds the funnel report, naming accounts from the identities
+func (f *funnel) Report(identities map[string]string) *FunnelReport {
+	f.Lock()
+	defer f.Unlock()
+
+	t := f.total
+	report := &FunnelReport{
+		Total: t,
+		Conversions: []Conversion{
+			// Matching services skip trials that are not recruiting
+			conversion("trial selection", "select_asset_prob", f.conf.MatchingService.SelectAssetProb, len(f.selected), (t.Trials-t.NotRecruiting)*len(f.conf.MatchingService.Accounts)),
+			conversion("match", "match_prob", f.conf.MatchingService.MatchProb, t.Consents, t.Considered),
+			// Declines for a preference are not decided by the probabilities
+			conversion("invitation acceptance", "participant_accept_trial_invite_prob", f.conf.Participants.AcceptTrialInviteProb, t.Accepted, t.Accepted+t.Rejected-t.RejectedByPreference),
+			conversion("health data submission", "participant_submit_data_prob", f.conf.Participants.SubmitDataProb, t.Submitted, t.Accepted-t.WithheldByPreference),
+			conversion("matching service approval", "match_data_approval_prob", f.conf.MatchingService.MatchDataApprovalProb, t.MSApproved, t.MSApproved+t.MSRejected),
+			// Health data for a closed trial is rejected without a decision
+			conversion("sponsor approval", "sponsor_data_approval_prob", f.conf.Sponsors.DataApprovalProb, t.SponsorApproved, t.SponsorApproved+t.SponsorRejected-t.RejectedAsClosed),
+			conversion("enrolment", "participant_accept_match_prob", f.conf.Participants.AcceptMatchProb, t.Enrolled, t.Enrolled+t.EnrollmentDeclined),
+			conversion("withdrawal", "participant_withdraw_prob", f.conf.Participants.WithdrawProb, t.Withdrawn, t.Enrolled),
+		},
+		Trials:           rows(f.trials, f.trialNames),
+		Sponsors:         rows(f.sponsors, identities),
+		MatchingServices: rows(f.matchingServices, identities),
+		Foreign:          foreignRows(f.foreign, identities),
+	}
+
+	// Stages decided by another policy than a probability have nothing configured to compare with
+	for i, stage := range conversionPolicies {
+		if policy := f.conf.policyConf(stage[0], stage[1]); policy.Type != PolicyProbability {
+			report.Conversions[i].Knob = policy.Type
+			report.Conversions[i].Configured = nil
+		}
+	}
+	return report
+}
+
+// conversionPolicies are the role and decision point behind each conversion, in report order
+var conversionPolicies = [][2]string{
+	{policyRoleMatchingService, DecideSelectTrial},
+	{policyRoleMatchingService, DecideMatch},
+	{policyRoleParticipant, DecideAcceptInvitation},
+	{policyRoleParticipant, DecideSubmitData},
+	{policyRoleMatchingService, DecideApproveData},
+	{policyRoleSponsor, DecideApproveData},
+	{policyRoleParticipant, DecideAcceptEnrolment},
+	{policyRoleParticipant, DecideWithdraw},
+}
+
+func conversion(stage, knob string, configured float64, converted, samples int) Conversion {
+	c := Conversion{
+		Stage:      stage,
+		Knob:       knob,
+		Configured: &configured,
+		Samples:    samples,
+	}
+	if samples > 0 {
+		c.Observed = float64(converted) / float64(samples)
+	}
+	return c
+}
+
+func rows(m map[string]*FunnelCounts, names map[string]string) []FunnelRow {
+	result := make([]FunnelRow, 0, len(m))
+	for id, c := range m {
+		result = append(result, FunnelRow{
+			ID:           id,
+			Name:         names[id],
+			FunnelCounts: *c,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Name != result[j].Name {
+			return result[i].Name < result[j].Name
+		}
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+func foreignRows(m map[string]*ForeignCounts, names map[string]string) []ForeignRow {
+	result := make([]ForeignRow, 0, len(m))
+	for id, c := range m {
+		result = append(result, ForeignRow{
+			ID:            id,
+			Name:          names[id],
+			ForeignCounts: *c,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Name != result[j].Name {
+			return result[i].Name < result[j].Name
+		}
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+func (r *FunnelReport) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+func (r *FunnelReport) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+
+	writeRows := func(title string, rows []FunnelRow) {
+		fmt.Fprintf(tw, "\n%s\tTrials\tConsidered\tConsents\tAccepted\tSubmitted\tMS approved\tSponsor approved\tEnrolled\tWithdrawn\t\n", title)
+		for _, row := range rows {
+			writeCounts(tw, row.Name, row.FunnelCounts)
+		}
+		writeCounts(tw, "Total", r.Total)
+	}
+	writeRows("Trial", r.Trials)
+	writeRows("Sponsor", r.Sponsors)
+	writeRows("Matching service", r.MatchingServices)
+
+	fmt.Fprintf(tw, "\nStage\tConfigured\tObserved\tSamples\tKnob\t\n")
+	for _, c := range r.Conversions {
+		configured := "-"
+		if c.Configured != nil {
+			configured = fmt.Sprintf("%.2f", *c.Configured)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%.2f\t%d\t%s\t\n", c.Stage, configured, c.Observed, c.Samples, c.Knob)
+	}
+
+	// Bitmarks left by other runs were not touched and are not counted above
+	if len(r.Foreign) > 0 {
+		fmt.Fprintf(tw, "\nForeign bitmarks\tOffered\tHeld\t\n")
+		for _, row := range r.Foreign {
+			fmt.Fprintf(tw, "%s\t%d\t%d\t\n", row.Name, row.Offered, row.Held)
+		}
+	}
+
+	return tw.Flush()
+}
+
+func writeCounts(w io.Writer, name string, c FunnelCounts) {
+	fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t\n",
+		name, c.Trials, c.Considered, c.Consents, c.Accepted, c.Submitted, c.MSApproved, c.SponsorApproved, c.Enrolled, c.Withdrawn)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/bitmark-inc/ct-match/event"
+)
+
+// conversionOf returns the conversion of a stage of the report
+func conversionOf(t *testing.T, r *FunnelReport, stage string) Conversion {
+	t.Helper()
+	for _, c := range r.Conversions {
+		if c.Stage == stage {
+			return c
+		}
+	}
+	t.Fatalf("no %s conversion", stage)
+	return Conversion{}
+}
+
+func TestFunnelLeavesOutClosedTrials(t *testing.T) {
+	conf := &Configuration{}
+	conf.MatchingService.Accounts = []Account{{Identity: "MS 1"}, {Identity: "MS 2"}}
+	f := newFunnel(conf)
+
+	sponsor := func(e event.Event) event.Event {
+		e.Actor, e.ActorRole = "sponsor", event.RoleSponsor
+		return e
+	}
+	events := []event.Event{
+		sponsor(event.Event{Type: event.TrialRegistered, TrialID: "open"}),
+		sponsor(event.Event{Type: event.TrialRegistered, TrialID: "not recruiting"}),
+		sponsor(event.Event{Type: event.TrialStatusChanged, TrialID: "not recruiting", Status: string(TrialClosed), Reason: reasonNotRecruiting}),
+		{Type: event.ConsentIssued, Actor: "ms1", TrialID: "open", ConsentID: "c1"},
+		{Type: event.ConsentIssued, Actor: "ms1", TrialID: "open", ConsentID: "c2"},
+		{Type: event.ConsentIssued, Actor: "ms1", TrialID: "open", ConsentID: "c3"},
+		{Type: event.ConsentIssued, Actor: "ms1", TrialID: "open", ConsentID: "c4"},
+		sponsor(event.Event{Type: event.EvaluationApproved, TrialID: "open", ConsentID: "c1"}),
+		sponsor(event.Event{Type: event.EvaluationRejected, TrialID: "open", ConsentID: "c2"}),
+		sponsor(event.Event{Type: event.EvaluationApproved, TrialID: "open", ConsentID: "c3", Reason: "waitlisted"}),
+		sponsor(event.Event{Type: event.TrialStatusChanged, TrialID: "open", Status: string(TrialClosed), Reason: "the waitlist is full"}),
+		sponsor(event.Event{Type: event.EvaluationRejected, TrialID: "open", ConsentID: "c4", Reason: reasonTrialClosed}),
+	}
+	for _, e := range events {
+		f.Emit(e)
+	}
+	r := f.Report(nil)
+
+	if r.Total.NotRecruiting != 1 || r.Total.RejectedAsClosed != 1 {
+		t.Errorf("%d trials not recruiting and %d rejections as closed, want 1 and 1", r.Total.NotRecruiting, r.Total.RejectedAsClosed)
+	}
+	tests := []struct {
+		stage       string
+		wantSamples int
+		wantRate    float64
+	}{
+		// Only the open trial could be selected, by either matching service
+		{"trial selection", 2, 0.5},
+		// Health data for the closed trial was not decided on
+		{"sponsor approval", 3, 2.0 / 3},
+	}
+	for _, tt := range tests {
+		c := conversionOf(t, r, tt.stage)
+		if c.Samples != tt.wantSamples || c.Observed != tt.wantRate {
+			t.Errorf("%s: %.2f of %d samples, want %.2f of %d", tt.stage, c.Observed, c.Samples, tt.wantRate, tt.wantSamples)
+		}
+	}
+}
+
+func TestReportClosedFullTrial(t *testing.T) {
+	// One seat and a waitlist of one. The sponsor leaves the health data of
+	// the third participant unanswered, so it is offered again once the
+	// trial is closed.
+	conf := newTestConfig(t, 3)
+	conf.Confirmation.MaxWait = 10
+	conf.Sponsors.EnrollmentTarget = 1
+	conf.Sponsors.WaitlistSize = 1
+	conf.Offers = OffersConf{SponsorReviewTTL: 1, OnExpiry: OnExpiryReoffer}
+	conf.Policies.Sponsor = map[string]PolicyConf{
+		DecideIgnoreOffer: {Type: PolicyScript, Script: []bool{false, false, true}},
+	}
+
+	s := runTestSimulation(t, conf)
+	states := consentStates(s)
+	if states[ConsentParticipating] != 1 || states[ConsentWaitlistReleased] != 1 || states[ConsentRejected] != 1 {
+		t.Fatalf("consents = %v, want 1 participating, 1 released from the waitlist and 1 rejected", states)
+	}
+	if status := s.trials[0].Status; status != TrialClosed {
+		t.Errorf("trial is %s, want closed", status)
+	}
+
+	r := s.Report()
+	if r.Total.SponsorRejected != 1 || r.Total.RejectedAsClosed != 1 {
+		t.Errorf("%d sponsor rejections, %d as closed, want 1 and 1", r.Total.SponsorRejected, r.Total.RejectedAsClosed)
+	}
+	// Every decision of the sponsor was an approval
+	if c := conversionOf(t, r, "sponsor approval"); c.Samples != 2 || c.Observed != 1 {
+		t.Errorf("sponsor approval: %.2f of %d samples, want 1.00 of 2", c.Observed, c.Samples)
+	}
+}
+
+func TestSeededFunnelReport(t *testing.T) {
+	conf := newTestConfig(t, 20)
+	conf.MatchingService.SelectAssetProb = 1
+	conf.MatchingService.MatchProb = 0.8
+	conf.MatchingService.MatchDataApprovalProb = 0.8
+	conf.Sponsors.DataApprovalProb = 0.7
+	conf.Sponsors.EnrollmentTarget = 4
+	conf.Sponsors.WaitlistSize = 2
+	conf.Participants.AcceptTrialInviteProb = 0.8
+	conf.Participants.SubmitDataProb = 0.9
+	conf.Participants.AcceptMatchProb = 0.7
+	conf.Participants.WithdrawProb = 0.2
+
+	s := runTestSimulation(t, conf)
+	r := s.Report()
+	states := consentStates(s)
+
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"every consent is counted", r.Total.Consents == len(s.consents)},
+		{"invitations are answered once", r.Total.Accepted+r.Total.Rejected+r.Total.RejectedByPreference <= r.Total.Consents},
+		{"sponsors decide on approved health data", r.Total.SponsorApproved+r.Total.SponsorRejected <= r.Total.MSApproved},
+		{"enrolments are offered by sponsors", r.Total.Enrolled+r.Total.EnrollmentDeclined <= r.Total.SponsorApproved},
+		{"participants are enrolled", states[ConsentParticipating]+states[ConsentWithdrawn] == r.Total.Enrolled},
+		{"withdrawals are counted", states[ConsentWithdrawn] == r.Total.Withdrawn},
+		{"trial seats are kept", states[ConsentParticipating] <= conf.Sponsors.EnrollmentTarget},
+	}
+	for _, tt := range tests {
+		if !tt.ok {
+			t.Errorf("%s: %+v, consents %v", tt.name, r.Total, states)
+		}
+	}
+
+	// The same seed gives the same funnel
+	again := runTestSimulation(t, conf).Report()
+	if !reflect.DeepEqual(again.Total, r.Total) {
+		t.Errorf("second run = %+v, want %+v", again.Total, r.Total)
+	}
+	if !reflect.DeepEqual(again.Conversions, r.Conversions) {
+		t.Errorf("second run conversions = %+v, want %+v", again.Conversions, r.Conversions)
+	}
+}
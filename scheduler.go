@@ -0,0 +1,609 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bitmark-inc/bitmark-sdk-go/asset"
+	"github.com/bitmark-inc/bitmark-sdk-go/bitmark"
+	"github.com/bitmark-inc/ct-match/event"
+	"github.com/bitmark-inc/ct-match/ledger"
+	"github.com/bitmark-inc/ct-match/util"
+)
+
+// step runs one tick of the scheduler: the first tick registers the trials,
+// then every trial and consent whose ledger preconditions are met moves
+// one state forward. It reports whether anything moved.
+func (s *Simulator) step(ctx context.Context) (bool, error) {
+	if s.tick == 0 {
+		return true, s.registerTrials()
+	}
+
+	progressed := false
+	s.inboxes = make(map[string]map[string]*bitmark.Bitmark)
+	s.pending = make(map[string]bool)
+	s.failed = make(map[string]error)
+
+	for _, t := range s.trials {
+		if t.Announced {
+			continue
+		}
+		settled, err := s.settled(ctx, holding{t.BitmarkID, t.Sponsor})
+		if err != nil {
+			return progressed, err
+		}
+		if !settled {
+			continue
+		}
+		for _, ms := range s.matchingServices {
+			consents, err := ms.IssueConsents(t)
+			if err != nil {
+				return progressed, err
+			}
+			s.consents = append(s.consents, consents...)
+		}
+		t.Announced = true
+		progressed = true
+	}
+
+	// Consents issued during this tick wait for the next one
+	consents := s.consents
+	for _, c := range consents {
+		if c.State.Final() {
+			continue
+		}
+		advanced, err := s.advance(ctx, c)
+		if err != nil {
+			return progressed, err
+		}
+		progressed = progressed || advanced
+	}
+
+	for _, t := range s.trials {
+		if err := s.updateRecruitment(t); err != nil {
+			return progressed, err
+		}
+	}
+
+	return progressed, nil
+}
+
+func (s *Simulator) registerTrials() error {
+	for _, ss := range s.sponsors {
+		trials, err := ss.RegisterNewTrial()
+		if err != nil {
+			return err
+		}
+		s.trials = append(s.trials, trials...)
+	}
+	return nil
+}
+
+// advance moves a consent to its next state if the ledger allows it
+func (s *Simulator) advance(ctx context.Context, c *Consent) (bool, error) {
+	ms, ok := s.matchingServiceByAccount[c.MatchingService]
+	if !ok {
+		return false, fmt.Errorf("consent %s: unknown matching service %s", c.ID, c.MatchingService)
+	}
+	pp, ok := s.participantByAccount[c.Participant]
+	if !ok {
+		return false, fmt.Errorf("consent %s: unknown participant %s", c.ID, c.Participant)
+	}
+	ss, ok := s.sponsorByAccount[c.Sponsor]
+	if !ok {
+		return false, fmt.Errorf("consent %s: unknown sponsor %s", c.ID, c.Sponsor)
+	}
+
+	switch c.State {
+	case ConsentIssued:
+		if settled, err := s.settled(ctx, holding{c.ID, c.MatchingService}); err != nil || !settled {
+			return false, err
+		}
+		if err := ms.OfferConsent(c); err != nil {
+			return false, err
+		}
+		c.State = ConsentOffered
+
+	case ConsentOffered:
+		b, ok, err := s.offered(c.ID, c.Participant)
+		if err != nil || !ok {
+			return false, err
+		}
+		if c.Ignored {
+			return s.expire(c, ms, b)
+		}
+		genuine, err := pp.VerifyOffer(c, c.MatchingService, b)
+		if err != nil {
+			return false, err
+		}
+		if !genuine {
+			c.State = ConsentSuspicious
+			return true, nil
+		}
+		if c.Ignored = s.mayIgnore(c) && pp.IgnoreOffer(c); c.Ignored {
+			return s.expire(c, ms, b)
+		}
+		accepted, err := pp.AnswerInvitation(c, b, s.concurrentTrials(c.Participant, c.TrialID))
+		if err != nil {
+			return false, err
+		}
+		c.State = next(accepted, ConsentAccepted, ConsentDeclined)
+
+	case ConsentAccepted:
+		if settled, err := s.settled(ctx, holding{c.ID, c.Participant}); err != nil || !settled {
+			return false, err
+		}
+		submitted, err := pp.SubmitHealthData(c)
+		if err != nil {
+			return false, err
+		}
+		c.State = next(submitted, ConsentDataSubmitted, ConsentDataWithheld)
+
+	case ConsentDataSubmitted:
+		if settled, err := s.settled(ctx, holding{c.HealthDataID, c.Participant}); err != nil || !settled {
+			return false, err
+		}
+		if err := pp.SendBackHealthData(c); err != nil {
+			return false, err
+		}
+		c.State = ConsentReturnedToMS
+
+	case ConsentReturnedToMS:
+		healthData, consent, ok, err := s.offeredBoth(c, c.MatchingService)
+		if err != nil || !ok {
+			return false, err
+		}
+		genuine, err := ms.VerifyOffer(c, c.Participant, healthData, consent)
+		if err != nil {
+			return false, err
+		}
+		if !genuine {
+			c.State = ConsentSuspicious
+			return true, nil
+		}
+		if err := ms.AcceptHealthData(c, healthData, consent); err != nil {
+			return false, err
+		}
+		c.State = ConsentWithMS
+
+	case ConsentWithMS:
+		if settled, err := s.settled(ctx, holding{c.HealthDataID, c.MatchingService}, holding{c.ID, c.MatchingService}); err != nil || !settled {
+			return false, err
+		}
+		record, intact, err := ms.VerifyHealthData(c)
+		if err != nil {
+			return false, err
+		}
+		if !intact {
+			c.State, c.TamperedFrom = ConsentTampered, c.State
+			return true, nil
+		}
+		approved, err := ms.Evaluate(c, record)
+		if err != nil {
+			return false, err
+		}
+		c.State = next(approved, ConsentForwardedToSponsor, ConsentRejectedByMS)
+
+	case ConsentForwardedToSponsor:
+		healthData, consent, ok, err := s.offeredBoth(c, c.Sponsor)
+		if err != nil || !ok {
+			return false, err
+		}
+		if c.Ignored {
+			return s.expire(c, ms, healthData, consent)
+		}
+		genuine, err := ss.VerifyOffer(c, c.MatchingService, healthData, consent)
+		if err != nil {
+			return false, err
+		}
+		if !genuine {
+			c.State = ConsentSuspicious
+			return true, nil
+		}
+		if c.Ignored = s.mayIgnore(c) && ss.IgnoreOffer(c, pp.Profile); c.Ignored {
+			return s.expire(c, ms, healthData, consent)
+		}
+		if err := ss.AcceptHealthData(c, healthData, consent); err != nil {
+			return false, err
+		}
+		c.State = ConsentWithSponsor
+
+	case ConsentWithSponsor:
+		if settled, err := s.settled(ctx, holding{c.HealthDataID, c.Sponsor}, holding{c.ID, c.Sponsor}); err != nil || !settled {
+			return false, err
+		}
+		record, intact, err := ss.VerifyHealthData(c)
+		if err != nil {
+			return false, err
+		}
+		if !intact {
+			c.State, c.TamperedFrom = ConsentTampered, c.State
+			return true, nil
+		}
+		t, err := s.trial(c.TrialID)
+		if err != nil {
+			return false, err
+		}
+		taken, _ := s.seats(t)
+		approved, err := ss.Evaluate(c, record, t, t.full(taken))
+		if err != nil {
+			return false, err
+		}
+		c.State = next(approved, ConsentApproved, ConsentRejected)
+		if approved && t.full(taken) {
+			c.State = ConsentWaitlisted
+			t.Waitlist = append(t.Waitlist, c.ID)
+		}
+
+	case ConsentWaitlisted:
+		t, err := s.trial(c.TrialID)
+		if err != nil {
+			return false, err
+		}
+		taken, releasable := s.seats(t)
+		switch {
+		case !t.full(taken) && t.Waitlist[0] == c.ID:
+			if err := ss.PromoteFromWaitlist(c); err != nil {
+				return false, err
+			}
+			t.Waitlist = t.Waitlist[1:]
+			c.State = ConsentApproved
+		case t.full(taken) && releasable == 0:
+			// Nothing can give a seat back any more
+			if err := ss.ReleaseWaitlisted(c); err != nil {
+				return false, err
+			}
+			t.Waitlist = removeConsent(t.Waitlist, c.ID)
+			c.State = ConsentWaitlistReleased
+		default:
+			return false, nil
+		}
+
+	case ConsentApproved:
+		b, ok, err := s.offered(c.ID, c.Participant)
+		if err != nil || !ok {
+			return false, err
+		}
+		if c.Ignored {
+			return s.expire(c, ss, b)
+		}
+		genuine, err := pp.VerifyOffer(c, c.Sponsor, b)
+		if err != nil {
+			return false, err
+		}
+		if !genuine {
+			c.State = ConsentSuspicious
+			return true, nil
+		}
+		if c.Ignored = s.mayIgnore(c) && pp.IgnoreOffer(c); c.Ignored {
+			return s.expire(c, ss, b)
+		}
+		enrolled, err := pp.AnswerEnrolment(c, b)
+		if err != nil {
+			return false, err
+		}
+		c.State = next(enrolled, ConsentEnrolled, ConsentEnrollmentDeclined)
+
+	case ConsentEnrolled:
+		if settled, err := s.settled(ctx, holding{c.ID, c.Participant}); err != nil || !settled {
+			return false, err
+		}
+		withdrawing, err := pp.IssueWithdrawal(c)
+		if err != nil {
+			return false, err
+		}
+		c.State = next(withdrawing, ConsentWithdrawing, ConsentParticipating)
+
+	case ConsentWithdrawing:
+		if settled, err := s.settled(ctx, holding{c.WithdrawalID, c.Participant}); err != nil || !settled {
+			return false, err
+		}
+		if err := pp.SendWithdrawal(c); err != nil {
+			return false, err
+		}
+		c.State = ConsentWithdrawalSent
+
+	case ConsentWithdrawalSent:
+		if settled, err := s.settled(ctx, holding{c.WithdrawalID, c.Sponsor}, holding{c.ID, c.WithdrawnTo}, holding{c.HealthDataID, c.Sponsor}); err != nil || !settled {
+			return false, err
+		}
+		if err := ss.ReleaseHealthData(c); err != nil {
+			return false, err
+		}
+		c.State = ConsentWithdrawn
+
+	case ConsentOfferExpired:
+		// The sender of the cancelled offer holds everything again
+		sender := c.MatchingService
+		if c.ExpiredFrom == ConsentApproved {
+			sender = c.Sponsor
+		}
+		holdings := []holding{{c.ID, sender}}
+		if c.HealthDataID != "" {
+			holdings = append(holdings, holding{c.HealthDataID, sender})
+		}
+		if settled, err := s.settled(ctx, holdings...); err != nil || !settled {
+			return false, err
+		}
+		if err := s.recover(c, ms, ss); err != nil {
+			return false, err
+		}
+
+	default:
+		return false, fmt.Errorf("consent %s: unknown state %s", c.ID, c.State)
+	}
+
+	return true, nil
+}
+
+// offerer is a role whose offers can expire
+type offerer interface {
+	CancelOffers(c *Consent, ttl time.Duration, bitmarks ...*bitmark.Bitmark) error
+	ReleaseExpired(c *Consent, disposal string) error
+}
+
+// mayIgnore reports whether the offers of a consent in its state can be left
+// unanswered: only offers with a TTL expire, the others would stay pending
+// for ever
+func (s *Simulator) mayIgnore(c *Consent) bool {
+	return s.conf.Offers.ttl(c.State) > 0
+}
+
+// expire cancels the offers of a consent left unanswered for longer than
+// the TTL of its state. It reports whether they were cancelled.
+func (s *Simulator) expire(c *Consent, sender offerer, bitmarks ...*bitmark.Bitmark) (bool, error) {
+	ttl := s.conf.Offers.ttl(c.State)
+	for _, b := range bitmarks {
+		if !expired(b, ttl) {
+			return false, nil
+		}
+	}
+
+	if err := sender.CancelOffers(c, ttl, bitmarks...); err != nil {
+		return false, err
+	}
+	c.Ignored = false
+	c.ExpiredFrom = c.State
+	c.State = ConsentOfferExpired
+	return true, nil
+}
+
+// recover applies the configured recovery to a consent whose offer expired
+func (s *Simulator) recover(c *Consent, ms *MatchingService, ss *Sponsor) error {
+	var sender offerer = ms
+	if c.ExpiredFrom == ConsentApproved {
+		sender = ss
+	}
+
+	switch s.conf.Offers.OnExpiry {
+	case OnExpiryReturn, OnExpiryBurn:
+		disposal := DisposalReturn
+		if s.conf.Offers.OnExpiry == OnExpiryBurn {
+			disposal = DisposalBurn
+		}
+		if err := sender.ReleaseExpired(c, disposal); err != nil {
+			return err
+		}
+		c.State = ConsentExpired
+		return nil
+	}
+
+	var err error
+	switch c.ExpiredFrom {
+	case ConsentOffered:
+		err = ms.OfferConsent(c)
+	case ConsentForwardedToSponsor:
+		err = ms.ForwardToSponsor(c)
+	case ConsentApproved:
+		err = ss.OfferEnrolment(c)
+	default:
+		err = fmt.Errorf("consent %s: cannot offer again from %s", c.ID, c.ExpiredFrom)
+	}
+	if err != nil {
+		return err
+	}
+	c.State, c.ExpiredFrom = c.ExpiredFrom, ""
+	return nil
+}
+
+func next(ok bool, yes, no ConsentState) ConsentState {
+	if ok {
+		return yes
+	}
+	return no
+}
+
+// holding is a bitmark and the account expected to own it
+type holding struct {
+	bitmarkID string
+	owner     string
+}
+
+// settled reports whether every bitmark is confirmed as owned by its owner
+// with no pending offer. Bitmarks not settled yet and failed lookups are
+// kept for the tick, to report them if the run stalls. Lookups stop at the
+// first bitmark not settled.
+func (s *Simulator) settled(ctx context.Context, holdings ...holding) (bool, error) {
+	for _, h := range holdings {
+		settled, err := s.confirmer.Settled(ctx, h.bitmarkID, h.owner)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return false, ctxErr
+		}
+		if err != nil {
+			s.failed[h.bitmarkID] = err
+			return false, nil
+		}
+		if !settled {
+			s.pending[h.bitmarkID] = true
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// offered returns a bitmark if it has a pending offer to the account
+func (s *Simulator) offered(bitmarkID, to string) (*bitmark.Bitmark, bool, error) {
+	inbox, err := s.inbox(to)
+	if err != nil {
+		return nil, false, err
+	}
+	b, ok := inbox[bitmarkID]
+	return b, ok, nil
+}
+
+// inbox returns the bitmarks of this run offered to the account, listed
+// once per tick. A bitmark is only offered and answered by a step of its
+// own consent, so the list does not go stale during the tick.
+func (s *Simulator) inbox(account string) (map[string]*bitmark.Bitmark, error) {
+	if inbox, ok := s.inboxes[account]; ok {
+		return inbox, nil
+	}
+
+	bitmarks, assets, err := ledger.Inbox(s.ledger, account)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list the offers to %s: %s", account, err)
+	}
+
+	inbox := make(map[string]*bitmark.Bitmark, len(bitmarks))
+	for _, b := range bitmarks {
+		if s.ownRun(assets[b.AssetID]) {
+			inbox[b.ID] = b
+		}
+	}
+	s.inboxes[account] = inbox
+	return inbox, nil
+}
+
+// ownRun reports whether an asset was registered by this run
+func (s *Simulator) ownRun(a *asset.Asset) bool {
+	return a != nil && a.Metadata[RunIDKey] == s.run.ID
+}
+
+// reportForeign emits an event for every bitmark of another run offered to
+// or owned by the sponsors and matching services. Their accounts come from
+// the configuration, so earlier or concurrent runs share them.
+func (s *Simulator) reportForeign(events event.Sink) error {
+	roles := make(map[string]string)
+	accounts := make([]string, 0, len(s.sponsors)+len(s.matchingServices))
+	for _, ss := range s.sponsors {
+		roles[ss.Account.AccountNumber()] = event.RoleSponsor
+		accounts = append(accounts, ss.Account.AccountNumber())
+	}
+	for _, ms := range s.matchingServices {
+		roles[ms.Account.AccountNumber()] = event.RoleMatchingService
+		accounts = append(accounts, ms.Account.AccountNumber())
+	}
+
+	for _, account := range accounts {
+		inbox, inboxAssets, err := ledger.Inbox(s.ledger, account)
+		if err != nil {
+			return err
+		}
+		holdings, holdingAssets, err := ledger.Holdings(s.ledger, account)
+		if err != nil {
+			return err
+		}
+
+		report := func(t event.Type, bitmarks []*bitmark.Bitmark, assets map[string]*asset.Asset) {
+			for _, b := range bitmarks {
+				a := assets[b.AssetID]
+				if s.ownRun(a) {
+					continue
+				}
+				e := event.Event{
+					Type:      t,
+					Time:      time.Now().UTC(),
+					Actor:     account,
+					ActorRole: roles[account],
+					AssetID:   b.AssetID,
+					BitmarkID: b.ID,
+					Reason:    "no run id",
+				}
+				if a != nil {
+					e.Asset = a.Name
+					if runID := a.Metadata[RunIDKey]; runID != "" {
+						e.Reason = "run " + runID
+					}
+				}
+				if b.Offer != nil {
+					e.Counterparty = b.Offer.From
+				}
+				events.Emit(e)
+			}
+		}
+		report(event.ForeignOffer, inbox, inboxAssets)
+		report(event.ForeignHolding, holdings, holdingAssets)
+	}
+	return nil
+}
+
+// offeredBoth returns the health data and consent bitmarks of a consent once both are offered to the account
+func (s *Simulator) offeredBoth(c *Consent, to string) (*bitmark.Bitmark, *bitmark.Bitmark, bool, error) {
+	healthData, ok, err := s.offered(c.HealthDataID, to)
+	if err != nil || !ok {
+		return nil, nil, false, err
+	}
+	consent, ok, err := s.offered(c.ID, to)
+	if err != nil || !ok {
+		return nil, nil, false, err
+	}
+	return healthData, consent, true, nil
+}
+
+// done reports whether every trial was considered and every consent reached a final state
+func (s *Simulator) done() bool {
+	if s.tick == 0 {
+		return false
+	}
+	for _, t := range s.trials {
+		if !t.Announced {
+			return false
+		}
+	}
+	for _, c := range s.consents {
+		if !c.State.Final() {
+			return false
+		}
+	}
+	return true
+}
+
+// stalled reports the bitmarks the last tick found not settled or could not
+// look up, when nothing advanced for too long
+func (s *Simulator) stalled() error {
+	pending := make([]string, 0, len(s.pending))
+	for id := range s.pending {
+		pending = append(pending, id)
+	}
+	sort.Strings(pending)
+	return &util.ConfirmationError{
+		Err:     fmt.Errorf("nothing advanced for %s, waiting for %s", s.confirmer.MaxWait, s.waiting()),
+		Pending: pending,
+		Failed:  s.failed,
+	}
+}
+
+// waiting summarizes the trials and consents that have not finished
+func (s *Simulator) waiting() string {
+	counts := make(map[string]int)
+	for _, t := range s.trials {
+		if !t.Announced {
+			counts["unannounced trial"]++
+		}
+	}
+	for _, c := range s.consents {
+		if !c.State.Final() {
+			counts[string(c.State)]++
+		}
+	}
+
+	waiting := make([]string, 0, len(counts))
+	for state, n := range counts {
+		waiting = append(waiting, fmt.Sprintf("%s: %d", state, n))
+	}
+	sort.Strings(waiting)
+	return strings.Join(waiting, ", ")
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	sdk "github.com/bitmark-inc/bitmark-sdk-go"
+	"github.com/bitmark-inc/bitmark-sdk-go/account"
+	"github.com/bitmark-inc/ct-match/ledger"
+	"github.com/bitmark-inc/ct-match/util"
+)
+
+func TestMain(m *testing.M) {
+	// Account numbers encode the network. Runs only use the in-memory ledger.
+	sdk.Init(&sdk.Config{Network: sdk.Testnet, HTTPClient: &http.Client{Timeout: 10 * time.Second}})
+	os.Exit(m.Run())
+}
+
+func newTestAccount(t *testing.T) account.Account {
+	t.Helper()
+	acc, err := account.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return acc
+}
+
+// newTestConfig is a run of one trial, one matching service and n
+// participants in which every decision is yes, except withdrawing
+func newTestConfig(t *testing.T, participants int) *Configuration {
+	t.Helper()
+	return &Configuration{
+		Network:      string(sdk.Testnet),
+		Confirmation: ConfirmationConf{MaxWait: 2},
+		MatchingService: MatchingServiceConf{
+			Accounts:              []Account{{Identity: "Matching Service", Seed: newTestAccount(t).Seed()}},
+			SelectAssetProb:       1,
+			MatchProb:             1,
+			MatchDataApprovalProb: 1,
+			TrashBinAccount:       newTestAccount(t).AccountNumber(),
+		},
+		Sponsors: SponsorsConf{
+			Accounts:           []Account{{Identity: "Sponsor", Seed: newTestAccount(t).Seed()}},
+			DataApprovalProb:   1,
+			TrialPerSponsorMin: 1,
+			TrialPerSponsorMax: 2,
+			StudiesPool:        []string{"Test Trial"},
+		},
+		Participants: ParticipantsConf{
+			ParticipantNum:        participants,
+			AcceptMatchProb:       1,
+			SubmitDataProb:        1,
+			AcceptTrialInviteProb: 1,
+			Profiles:              ProfilesConf{AgeMin: defaultAgeMin, AgeMax: defaultAgeMax},
+		},
+	}
+}
+
+// runTestSimulation runs a seeded simulation on the in-memory ledger and
+// checks the ledger against its events
+func runTestSimulation(t *testing.T, conf *Configuration) *Simulator {
+	t.Helper()
+	util.Seed(1)
+	s := newSimulator(conf, ledger.NewMemoryLedger(), nil)
+	s.SaveCheckpoints("", Run{ID: "0123456789abcdef", Ledger: ledger.Memory})
+	if err := s.Simulate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	reconciliation, err := s.custody.Reconcile(s.ledger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range reconciliation.Mismatches {
+		t.Errorf("%s bitmark %s: %s, expected %s, actual %s", m.Kind, m.BitmarkID, m.Problem, m.Expected, m.Actual)
+	}
+	return s
+}
+
+// consentStates counts the consents of a run in each state
+func consentStates(s *Simulator) map[ConsentState]int {
+	states := make(map[ConsentState]int)
+	for _, c := range s.consents {
+		states[c.State]++
+	}
+	return states
+}
+
+func TestIgnoreOfferWithoutTTL(t *testing.T) {
+	ignore := map[string]PolicyConf{DecideIgnoreOffer: {Type: PolicyScript, Default: true}}
+	tests := []struct {
+		name     string
+		policies PoliciesConf
+	}{
+		{"participant", PoliciesConf{Participant: ignore}},
+		{"sponsor", PoliciesConf{Sponsor: ignore}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := newTestConfig(t, 3)
+			conf.Policies = tt.policies
+
+			// Offers that never expire are answered, so the run does not stall
+			s := runTestSimulation(t, conf)
+			if states := consentStates(s); states[ConsentParticipating] != 3 {
+				t.Errorf("consents = %v, want 3 participating", states)
+			}
+		})
+	}
+}
+
+func TestValidateIgnoreOffer(t *testing.T) {
+	tests := []struct {
+		name        string
+		participant float64
+		sponsor     float64
+		offers      OffersConf
+		wantErr     bool
+	}{
+		{"no ignoring", 0, 0, OffersConf{}, false},
+		{"participant without a TTL", 0.5, 0, OffersConf{}, true},
+		{"participant with an invite TTL", 0.5, 0, OffersConf{InviteTTL: 60}, false},
+		{"participant with an enrolment TTL", 0.5, 0, OffersConf{EnrolmentTTL: 60}, false},
+		{"participant with a sponsor review TTL", 0.5, 0, OffersConf{SponsorReviewTTL: 60}, true},
+		{"sponsor without a TTL", 0, 0.5, OffersConf{}, true},
+		{"sponsor with a sponsor review TTL", 0, 0.5, OffersConf{SponsorReviewTTL: 60}, false},
+		{"sponsor with an invite TTL", 0, 0.5, OffersConf{InviteTTL: 60}, true},
+	}
+
+	for _, tt := range tests {
+		conf := &Configuration{Offers: tt.offers}
+		conf.Participants.IgnoreOfferProb = tt.participant
+		conf.Sponsors.IgnoreOfferProb = tt.sponsor
+		if err := conf.validateIgnoreOffer(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: validateIgnoreOffer() = %v, want error %t", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestOfferExpiry(t *testing.T) {
+	invite := OffersConf{InviteTTL: 1}
+	enrolment := OffersConf{EnrolmentTTL: 1}
+	matchingService := func(conf *Configuration, c *Consent) string { return c.MatchingService }
+	trashBin := func(conf *Configuration, c *Consent) string { return conf.MatchingService.TrashBinAccount }
+	sponsorTrashBin := func(conf *Configuration, c *Consent) string { return conf.Sponsors.TrashBinAccount }
+
+	tests := []struct {
+		name      string
+		offers    OffersConf
+		onExpiry  string
+		wantState ConsentState
+		wantOwner func(*Configuration, *Consent) string // of the consent, nil when recovered
+	}{
+		{"invite offered again", invite, OnExpiryReoffer, ConsentParticipating, nil},
+		{"invite returned", invite, OnExpiryReturn, ConsentExpired, matchingService},
+		{"invite burnt", invite, OnExpiryBurn, ConsentExpired, trashBin},
+		{"enrolment offered again", enrolment, OnExpiryReoffer, ConsentParticipating, nil},
+		{"enrolment returned", enrolment, OnExpiryReturn, ConsentExpired, matchingService},
+		{"enrolment burnt", enrolment, OnExpiryBurn, ConsentExpired, sponsorTrashBin},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The participant leaves the first offer with a TTL unanswered
+			conf := newTestConfig(t, 1)
+			conf.Confirmation.MaxWait = 10
+			conf.Sponsors.TrashBinAccount = newTestAccount(t).AccountNumber()
+			conf.Offers = tt.offers
+			conf.Offers.OnExpiry = tt.onExpiry
+			conf.Policies.Participant = map[string]PolicyConf{
+				DecideIgnoreOffer: {Type: PolicyScript, Script: []bool{true}},
+			}
+
+			s := runTestSimulation(t, conf)
+			if len(s.consents) != 1 {
+				t.Fatalf("%d consents, want 1", len(s.consents))
+			}
+			c := s.consents[0]
+			if c.State != tt.wantState {
+				t.Fatalf("consent %s, want %s", c.State, tt.wantState)
+			}
+			if expired := s.Report().Total.Expired; expired != 1 {
+				t.Errorf("%d offers expired, want 1", expired)
+			}
+			if tt.wantOwner == nil {
+				return
+			}
+			b, err := s.ledger.GetBitmark(c.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := tt.wantOwner(conf, c); b.Owner != want {
+				t.Errorf("consent owned by %s, want %s", b.Owner, want)
+			}
+		})
+	}
+}
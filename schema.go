@@ -0,0 +1,264 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/bitmark-inc/bitmark-sdk-go/account"
+	"github.com/bitmark-inc/bitmark-sdk-go/asset"
+	"github.com/bitmark-inc/ct-match/ledger"
+)
+
+// Asset types of the consent protocol. Consent bitmarks are issued from the
+// trial asset, so they follow the Trial schema.
+const (
+	AssetTrial      = "Trial"
+	AssetHealthData = "Health Data"
+	AssetWithdrawal = "Withdrawal"
+)
+
+// Metadata keys shared by the asset types
+const (
+	metadataType          = "Type"
+	metadataSchemaVersion = "Schema Version"
+	metadataSponsor       = "Sponsor"
+	metadataTrialBitmark  = "Trial Bitmark"
+)
+
+// SchemaVersion is the version of the metadata schemas assets are
+// registered with. Assets without a version are read as version 1, which
+// they were registered with before the version was recorded.
+const SchemaVersion = 1
+
+// Limits of the Bitmark ledger, in Unicode characters. Metadata is counted
+// packed as keys and values separated by NUL characters.
+const (
+	maxAssetName = 64
+	maxMetadata  = 1024
+)
+
+var (
+	ErrUnknownAssetType     = errors.New("unknown asset type")
+	ErrUnknownSchemaVersion = errors.New("unknown metadata schema version")
+	ErrMissingMetadata      = errors.New("required key is missing")
+	ErrUnexpectedMetadata   = errors.New("key is not in the schema")
+	ErrMalformedMetadata    = errors.New("value is malformed")
+	ErrAssetNameLength      = errors.New("asset name is empty or longer than 64 characters")
+	ErrMetadataLength       = errors.New("metadata is longer than 1024 characters")
+)
+
+// MetadataError is why an asset does not follow the metadata schema of its
+// type. Err is one of the errors above.
+type MetadataError struct {
+	AssetID string // empty before registration
+	Type    string
+	Key     string // empty when the error is not about one key
+	Err     error
+}
+
+func (e *MetadataError) Error() string {
+	var b strings.Builder
+	if e.AssetID != "" {
+		fmt.Fprintf(&b, "asset %s: ", e.AssetID)
+	}
+	if e.Type != "" {
+		fmt.Fprintf(&b, "%s ", e.Type)
+	}
+	b.WriteString("metadata")
+	if e.Key != "" {
+		fmt.Fprintf(&b, " %s", e.Key)
+	}
+	return b.String() + ": " + e.Err.Error()
+}
+
+// MetadataKey is a key of a metadata schema. Valid checks the format of
+// its value, nil for free text.
+type MetadataKey struct {
+	Name     string
+	Required bool
+	Valid    func(value string) bool
+}
+
+// MetadataSchema are the keys the metadata of a version of an asset type
+// may carry. Type and Schema Version are implied.
+type MetadataSchema struct {
+	Type    string
+	Version int
+	Keys    []MetadataKey
+}
+
+var metadataSchemas = make(map[string]map[int]*MetadataSchema)
+
+// RegisterMetadataSchema adds the schema of a version of an asset type
+func RegisterMetadataSchema(s *MetadataSchema) {
+	if _, ok := metadataSchemas[s.Type]; !ok {
+		metadataSchemas[s.Type] = make(map[int]*MetadataSchema)
+	}
+	metadataSchemas[s.Type][s.Version] = s
+}
+
+func init() {
+	runID := MetadataKey{Name: RunIDKey, Valid: isHex}
+	trialBitmark := MetadataKey{Name: metadataTrialBitmark, Required: true, Valid: isBitmarkID}
+
+	RegisterMetadataSchema(&MetadataSchema{
+		Type:    AssetTrial,
+		Version: 1,
+		Keys: []MetadataKey{
+			{Name: metadataSponsor, Required: true},
+			runID,
+			{Name: metadataMinAge, Valid: isCount},
+			{Name: metadataMaxAge, Valid: isCount},
+			{Name: metadataSex, Valid: isSex},
+			{Name: metadataConditions},
+			{Name: metadataExcludedConditions},
+			{Name: metadataExcludedMedications},
+			{Name: metadataLocations},
+			{Name: metadataNCTID, Valid: isNCTID},
+			{Name: metadataPhase},
+			{Name: metadataEnrollmentTarget, Valid: isCount},
+		},
+	})
+	RegisterMetadataSchema(&MetadataSchema{
+		Type:    AssetHealthData,
+		Version: 1,
+		Keys:    []MetadataKey{trialBitmark, runID},
+	})
+	RegisterMetadataSchema(&MetadataSchema{
+		Type:    AssetWithdrawal,
+		Version: 1,
+		Keys:    []MetadataKey{trialBitmark, runID},
+	})
+}
+
+// newMetadata starts the metadata of an asset of the current schema version
+func newMetadata(assetType string) map[string]string {
+	return map[string]string{
+		metadataType:          assetType,
+		metadataSchemaVersion: strconv.Itoa(SchemaVersion),
+	}
+}
+
+// validateAsset checks an asset name and metadata against the schema of
+// the asset type and the limits of the ledger
+func validateAsset(name string, metadata map[string]string) error {
+	assetType := metadata[metadataType]
+	fail := func(key string, err error) error {
+		return &MetadataError{Type: assetType, Key: key, Err: err}
+	}
+
+	if name == "" || utf8.RuneCountInString(name) > maxAssetName {
+		return fail("", ErrAssetNameLength)
+	}
+	if metadataLength(metadata) > maxMetadata {
+		return fail("", ErrMetadataLength)
+	}
+
+	versions, ok := metadataSchemas[assetType]
+	if !ok {
+		return fail(metadataType, ErrUnknownAssetType)
+	}
+	version := 1
+	if v, ok := metadata[metadataSchemaVersion]; ok {
+		var err error
+		if version, err = strconv.Atoi(v); err != nil {
+			return fail(metadataSchemaVersion, ErrMalformedMetadata)
+		}
+	}
+	schema, ok := versions[version]
+	if !ok {
+		return fail(metadataSchemaVersion, ErrUnknownSchemaVersion)
+	}
+
+	known := map[string]bool{metadataType: true, metadataSchemaVersion: true}
+	for _, k := range schema.Keys {
+		known[k.Name] = true
+		v, ok := metadata[k.Name]
+		if !ok || v == "" {
+			if k.Required {
+				return fail(k.Name, ErrMissingMetadata)
+			}
+			continue
+		}
+		if k.Valid != nil && !k.Valid(v) {
+			return fail(k.Name, ErrMalformedMetadata)
+		}
+	}
+
+	// In a fixed order, for the same error every time
+	keys := make([]string, 0, len(metadata))
+	for k := range metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !known[k] {
+			return fail(k, ErrUnexpectedMetadata)
+		}
+	}
+	return nil
+}
+
+// checkAsset validates an asset read from the ledger
+func checkAsset(a *asset.Asset) error {
+	if err := validateAsset(a.Name, a.Metadata); err != nil {
+		err.(*MetadataError).AssetID = a.ID
+		return err
+	}
+	return nil
+}
+
+// registerAsset validates the asset before registering it on the ledger
+func registerAsset(l ledger.Ledger, registrant account.Account, name string, metadata map[string]string, content []byte) (string, error) {
+	if err := validateAsset(name, metadata); err != nil {
+		return "", err
+	}
+	return l.RegisterAsset(registrant, name, metadata, content)
+}
+
+// metadataLength is the length of metadata packed the way the ledger stores it
+func metadataLength(metadata map[string]string) int {
+	n, parts := 0, 0
+	for k, v := range metadata {
+		if k == "" || v == "" {
+			continue
+		}
+		n += utf8.RuneCountInString(k) + utf8.RuneCountInString(v)
+		parts += 2
+	}
+	if parts > 0 {
+		n += parts - 1
+	}
+	return n
+}
+
+var (
+	hexPattern   = regexp.MustCompile(`^[0-9a-f]+$`)
+	nctIDPattern = regexp.MustCompile(`^NCT[0-9]{8}$`)
+)
+
+func isHex(v string) bool {
+	return hexPattern.MatchString(v)
+}
+
+func isBitmarkID(v string) bool {
+	return len(v) == 64 && isHex(v)
+}
+
+func isCount(v string) bool {
+	n, err := strconv.Atoi(v)
+	return err == nil && n >= 0
+}
+
+func isSex(v string) bool {
+	return strings.EqualFold(v, "female") || strings.EqualFold(v, "male")
+}
+
+func isNCTID(v string) bool {
+	return nctIDPattern.MatchString(v)
+}
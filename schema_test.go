@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateAsset(t *testing.T) {
+	bitmarkID := strings.Repeat("ab", 32)
+	trial := func(changes map[string]string) map[string]string {
+		metadata := newMetadata(AssetTrial)
+		metadata[metadataSponsor] = "Sponsor"
+		metadata[metadataNCTID] = "NCT01234567"
+		metadata[metadataMinAge] = "18"
+		for k, v := range changes {
+			if v == "" {
+				delete(metadata, k)
+				continue
+			}
+			metadata[k] = v
+		}
+		return metadata
+	}
+
+	tests := []struct {
+		name     string
+		asset    string
+		metadata map[string]string
+		wantKey  string
+		wantErr  error
+	}{
+		{"trial", "Trial", trial(nil), "", nil},
+		{"health data", "Health Data", map[string]string{
+			metadataType: AssetHealthData, metadataTrialBitmark: bitmarkID, RunIDKey: "0f",
+		}, "", nil},
+		{"without a schema version", "Trial", trial(map[string]string{metadataSchemaVersion: ""}), "", nil},
+		{"empty optional value", "Trial", trial(map[string]string{metadataPhase: ""}), "", nil},
+		{"unknown type", "Trial", trial(map[string]string{metadataType: "Recipe"}), metadataType, ErrUnknownAssetType},
+		{"no type", "Trial", trial(map[string]string{metadataType: ""}), metadataType, ErrUnknownAssetType},
+		{"unknown version", "Trial", trial(map[string]string{metadataSchemaVersion: "2"}), metadataSchemaVersion, ErrUnknownSchemaVersion},
+		{"malformed version", "Trial", trial(map[string]string{metadataSchemaVersion: "one"}), metadataSchemaVersion, ErrMalformedMetadata},
+		{"missing sponsor", "Trial", trial(map[string]string{metadataSponsor: ""}), metadataSponsor, ErrMissingMetadata},
+		{"missing trial bitmark", "Health Data", map[string]string{metadataType: AssetHealthData}, metadataTrialBitmark, ErrMissingMetadata},
+		{"unexpected key", "Trial", trial(map[string]string{"Color": "blue"}), "Color", ErrUnexpectedMetadata},
+		{"key of another type", "Trial", trial(map[string]string{metadataTrialBitmark: bitmarkID}), metadataTrialBitmark, ErrUnexpectedMetadata},
+		{"malformed age", "Trial", trial(map[string]string{metadataMinAge: "-1"}), metadataMinAge, ErrMalformedMetadata},
+		{"malformed sex", "Trial", trial(map[string]string{metadataSex: "any"}), metadataSex, ErrMalformedMetadata},
+		{"malformed NCT ID", "Trial", trial(map[string]string{metadataNCTID: "NCT123"}), metadataNCTID, ErrMalformedMetadata},
+		{"malformed run ID", "Trial", trial(map[string]string{RunIDKey: "run 1"}), RunIDKey, ErrMalformedMetadata},
+		{"malformed trial bitmark", "Health Data", map[string]string{
+			metadataType: AssetHealthData, metadataTrialBitmark: bitmarkID[:63],
+		}, metadataTrialBitmark, ErrMalformedMetadata},
+		{"longest name", strings.Repeat("é", maxAssetName), trial(nil), "", nil},
+		{"empty name", "", trial(nil), "", ErrAssetNameLength},
+		{"long name", strings.Repeat("é", maxAssetName+1), trial(nil), "", ErrAssetNameLength},
+		{"long metadata", "Trial", trial(map[string]string{metadataConditions: strings.Repeat("é", maxMetadata)}), "", ErrMetadataLength},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateAsset(tt.asset, tt.metadata)
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Errorf("validateAsset() = %v", err)
+				}
+				return
+			}
+			metadataErr, ok := err.(*MetadataError)
+			if !ok {
+				t.Fatalf("validateAsset() = %v, want a MetadataError", err)
+			}
+			if metadataErr.Err != tt.wantErr || metadataErr.Key != tt.wantKey {
+				t.Errorf("validateAsset() = %v, want %s: %v", err, tt.wantKey, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMetadataLength(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata map[string]string
+		want     int
+	}{
+		{"none", nil, 0},
+		{"one pair", map[string]string{"Type": "Trial"}, 4 + 1 + 5},
+		{"two pairs", map[string]string{"Type": "Trial", "Sex": "male"}, 4 + 1 + 5 + 1 + 3 + 1 + 4},
+		{"empty value", map[string]string{"Type": "Trial", "Sex": ""}, 4 + 1 + 5},
+		{"empty key", map[string]string{"": "value"}, 0},
+		{"characters, not bytes", map[string]string{"Name": "Zoë"}, 4 + 1 + 3},
+	}
+
+	for _, tt := range tests {
+		if got := metadataLength(tt.metadata); got != tt.want {
+			t.Errorf("%s: metadataLength() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
@@ -1,237 +1,309 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"net/http"
+	"os"
 	"time"
 
 	sdk "github.com/bitmark-inc/bitmark-sdk-go"
+	"github.com/bitmark-inc/bitmark-sdk-go/bitmark"
+	"github.com/bitmark-inc/ct-match/event"
+	"github.com/bitmark-inc/ct-match/ledger"
+	"github.com/bitmark-inc/ct-match/store"
 	"github.com/bitmark-inc/ct-match/util"
 )
 
 type Simulator struct {
-	conf *Configuration
+	conf      *Configuration
+	ledger    ledger.Ledger
+	confirmer *util.Confirmer
+	events    event.Sink // in addition to the narrative on stdout, may be nil
+	funnel    *funnel
+	custody   *custody
+	store     *store.Store // encrypted health data, off the ledger
+
+	identities map[string]string
 
 	matchingServices []*MatchingService
 	participants     []*Participant
 	sponsors         []*Sponsor
-}
 
-func newSimulator(conf *Configuration) *Simulator {
-	return &Simulator{
-		conf: conf,
-	}
+	matchingServiceByAccount map[string]*MatchingService
+	participantByAccount     map[string]*Participant
+	sponsorByAccount         map[string]*Sponsor
+
+	policies *Policies
+
+	tick     int
+	trials   []*Trial
+	consents []*Consent
+	inboxes  map[string]map[string]*bitmark.Bitmark // account -> offered bitmarks, listed during the current tick
+	pending  map[string]bool                        // bitmarks found not settled during the current tick
+	failed   map[string]error                       // bitmarks whose lookup failed during the current tick
+
+	checkpointFile string
+	run            Run
+	restored       *Checkpoint
 }
 
-func (s *Simulator) Simulate() error {
-	// Inititate go sdk
+// initSDK initiates go sdk. Accounts depend on the configured network
+// even when the simulation runs on the in-memory ledger.
+func initSDK(conf *Configuration) {
 	httpClient := &http.Client{
 		Timeout: 10 * time.Second,
 	}
+	if conf.Confirmation.RequestTimeout > 0 {
+		httpClient.Timeout = time.Duration(conf.Confirmation.RequestTimeout) * time.Second
+	}
 	config := &sdk.Config{
-		APIToken:   s.conf.APIToken,
-		Network:    sdk.Network(s.conf.Network),
+		APIToken:   conf.APIToken,
+		Network:    sdk.Network(conf.Network),
 		HTTPClient: httpClient,
 	}
 	sdk.Init(config)
 
-	identities := make(map[string]string)
-
-	sponsors := make([]*Sponsor, 0)
-	for i, account := range s.conf.Sponsors.Accounts {
-		s, err := newSponsor(i, account.Identity, account.Seed, s.conf.Sponsors)
-		if err != nil {
-			return err
-		}
-		identities[s.Account.AccountNumber()] = s.Name
-		sponsors = append(sponsors, s)
+	// Point the SDK to another API server, e.g. the one started by `ct-match mock-api`
+	if conf.APIEndpoint != "" {
+		sdk.GetAPIClient().URLAuthority = conf.APIEndpoint
 	}
+}
 
-	participants := make([]*Participant, 0)
-	for i := 0; i < s.conf.Participants.ParticipantNum; i++ {
-		pp, err := newParticipant(s.conf.Participants)
-		if err != nil {
-			return err
-		}
-		identities[pp.Account.AccountNumber()] = pp.Name
-		participants = append(participants, pp)
+func newSimulator(conf *Configuration, l ledger.Ledger, events event.Sink) *Simulator {
+	return &Simulator{
+		conf:      conf,
+		ledger:    l,
+		confirmer: newConfirmer(conf.Confirmation, l),
+		events:    events,
+		funnel:    newFunnel(conf),
+		custody:   newCustody(),
+		store:     store.New(l),
 	}
+}
 
-	matchingServices := make([]*MatchingService, 0)
-	for _, account := range s.conf.MatchingService.Accounts {
-		m, err := newMatchingService(account.Identity, account.Seed, s.conf.MatchingService)
-		if err != nil {
-			return err
-		}
-
-		m.Participants = participants
+// Report returns the recruitment funnel of the simulation so far
+func (s *Simulator) Report() *FunnelReport {
+	return s.funnel.Report(s.identities)
+}
 
-		identities[m.Account.AccountNumber()] = m.Name
-		matchingServices = append(matchingServices, m)
+// newConfirmer applies the configured bounds over the confirmer defaults
+func newConfirmer(conf ConfirmationConf, l ledger.Ledger) *util.Confirmer {
+	c := util.NewConfirmer(l)
+	if conf.RequestTimeout > 0 {
+		c.RequestTimeout = time.Duration(conf.RequestTimeout) * time.Second
+	}
+	if conf.InitialBackoff > 0 {
+		c.InitialBackoff = time.Duration(conf.InitialBackoff) * time.Second
 	}
+	if conf.MaxBackoff > 0 {
+		c.MaxBackoff = time.Duration(conf.MaxBackoff) * time.Second
+	}
+	if conf.MaxWait > 0 {
+		c.MaxWait = time.Duration(conf.MaxWait) * time.Second
+	}
+	return c
+}
 
-	// Add identities
-	for _, ss := range sponsors {
-		ss.Identities = identities
+func (s *Simulator) Simulate(ctx context.Context) error {
+	switch s.conf.Participants.WithdrawTo {
+	case "", WithdrawToSponsor, WithdrawToTrashBin:
+	default:
+		return fmt.Errorf("unknown withdraw_to: %s", s.conf.Participants.WithdrawTo)
+	}
+	if err := s.conf.Offers.validate(); err != nil {
+		return err
+	}
+	if err := s.conf.validateIgnoreOffer(); err != nil {
+		return err
 	}
-	for _, ms := range matchingServices {
-		ms.Identities = identities
+	if err := s.conf.Participants.Profiles.validate(); err != nil {
+		return err
 	}
-	for _, pp := range participants {
-		pp.Identities = identities
+	if err := s.conf.Participants.Preferences.validate(); err != nil {
+		return err
 	}
 
-	// Register trial bitmark from sponsor
-	trialBitmarkIds := make([]string, 0)
-	trialAssetIds := make([]string, 0)
+	s.identities = make(map[string]string)
 
-	for _, ss := range sponsors {
-		bitmarkIds, assetIds, err := ss.RegisterNewTrial()
-		if err != nil {
+	events := event.Sinks{newNarrative(os.Stdout, s.identities), s.funnel, s.custody}
+	if s.events != nil {
+		events = append(events, s.events)
+	}
+
+	if s.restored != nil {
+		if err := s.restoreRoles(s.restored, events); err != nil {
+			return err
+		}
+		fmt.Printf("Resuming at tick %d\n", s.tick)
+	} else {
+		if err := s.newRoles(events); err != nil {
 			return err
 		}
-
-		trialBitmarkIds = append(trialBitmarkIds, bitmarkIds...)
-		trialAssetIds = append(trialAssetIds, assetIds...)
 	}
 
-	time.Sleep(time.Duration(s.conf.WaitTime) * time.Second)
+	policies, err := newPolicies(s.conf)
+	if err != nil {
+		return err
+	}
+	if s.restored != nil {
+		policies.restoreScriptPositions(s.restored.Scripts)
+	}
+	s.policies = policies
 
-	// Wait for bitmark to be confirmed
-	util.WaitForBitmarkConfirmations(trialBitmarkIds)
+	studies, err := loadStudies(s.conf.Sponsors.StudiesDir)
+	if err != nil {
+		return err
+	}
 
-	// Issue more from matching service
-	moreTrialBitmarkIDs := make([]string, 0)
-	for _, ms := range matchingServices {
-		bitmarkIDs, err := ms.IssueMoreTrial(trialAssetIds)
-		if err != nil {
+	// Add identities, policies, the registry offers are verified against and
+	// the encryption keys health data access is granted with
+	verifier := newVerifier(s.ledger, s.identities)
+	s.sponsorByAccount = make(map[string]*Sponsor)
+	for _, ss := range s.sponsors {
+		s.identities[ss.Account.AccountNumber()] = ss.Name
+		s.sponsorByAccount[ss.Account.AccountNumber()] = ss
+		ss.Identities = s.identities
+		ss.policies = policies.Sponsor
+		ss.runID = s.run.ID
+		ss.verifier = verifier
+		ss.store = s.store
+		ss.studies = studies
+		ss.trashBin = s.conf.Sponsors.TrashBinAccount
+		if ss.trashBin == "" {
+			ss.trashBin = s.conf.MatchingService.TrashBinAccount
+		}
+		verifier.roles[ss.Account.AccountNumber()] = event.RoleSponsor
+		if err := s.store.Register(ss.Account); err != nil {
 			return err
 		}
-
-		moreTrialBitmarkIDs = append(moreTrialBitmarkIDs, bitmarkIDs...)
 	}
-
-	// Wait for bitmark to be confirmed
-	util.WaitForBitmarkConfirmations(moreTrialBitmarkIDs)
-
-	// Send to participant
-	for _, ms := range matchingServices {
-		err := ms.SendTrialToParticipant()
-		if err != nil {
+	s.participantByAccount = make(map[string]*Participant)
+	for _, pp := range s.participants {
+		s.identities[pp.Account.AccountNumber()] = pp.Name
+		s.participantByAccount[pp.Account.AccountNumber()] = pp
+		pp.Identities = s.identities
+		pp.policies = policies.Participant
+		pp.runID = s.run.ID
+		pp.verifier = verifier
+		pp.store = s.store
+		pp.trashBin = s.conf.MatchingService.TrashBinAccount
+		verifier.roles[pp.Account.AccountNumber()] = event.RoleParticipant
+		if err := s.store.Register(pp.Account); err != nil {
 			return err
 		}
 	}
-
-	time.Sleep(time.Duration(s.conf.WaitTime) * time.Second)
-
-	// Ask for acceptance from participants
-	sendToParticipantBitmarkIDs := make([]string, 0)
-	for _, pp := range participants {
-		trialBitmarkIDs, err := pp.ProcessRecevingTrialBitmark(ProcessReceivingTrialBitmarkFromMatchingService)
-		if err != nil {
+	s.matchingServiceByAccount = make(map[string]*MatchingService)
+	for _, ms := range s.matchingServices {
+		s.identities[ms.Account.AccountNumber()] = ms.Name
+		s.matchingServiceByAccount[ms.Account.AccountNumber()] = ms
+		ms.Identities = s.identities
+		ms.policies = policies.MatchingService
+		ms.verifier = verifier
+		ms.store = s.store
+		verifier.roles[ms.Account.AccountNumber()] = event.RoleMatchingService
+		if err := s.store.Register(ms.Account); err != nil {
 			return err
 		}
-
-		sendToParticipantBitmarkIDs = append(sendToParticipantBitmarkIDs, trialBitmarkIDs...)
 	}
 
-	time.Sleep(time.Duration(s.conf.WaitTime) * time.Second)
-
-	// Wait for transactions to be confirmed
-	util.WaitForConfirmations(sendToParticipantBitmarkIDs)
+	// Ticks that move nothing back off until the ledger catches up
+	backoff := s.confirmer.InitialBackoff
+	lastProgress := time.Now()
+	for !s.done() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 
-	// Issue medical data from participants that received the trial
-	medicalBitmarkIDs := make([]string, 0)
-	holdingConsentBitmarkIDs := make([]string, 0)
-	for _, pp := range participants {
-		bitmarkIDs, err := pp.IssueMedicalDataBitmark()
+		util.Reseed(int64(s.tick + 1))
+		progressed, err := s.step(ctx)
 		if err != nil {
+			// Keep what was done in this tick so that a resumed run does not repeat it
+			if saveErr := s.saveCheckpoint(); saveErr != nil {
+				return saveErr
+			}
 			return err
 		}
 
-		medicalBitmarkIDs = append(medicalBitmarkIDs, bitmarkIDs...)
-		holdingConsentBitmarkIDs = append(holdingConsentBitmarkIDs, pp.HoldingConsentBitmarkIDs...)
-	}
-
-	time.Sleep(time.Duration(s.conf.WaitTime) * time.Second)
-
-	// Wait for bitmarks to be confirmed
-	util.WaitForBitmarkConfirmations(medicalBitmarkIDs)
-	util.WaitForBitmarkConfirmations(holdingConsentBitmarkIDs)
-
-	// Send back the trial bitmark and medical data to matching service
-	for _, pp := range participants {
-		err := pp.SendBackTrialBitmark()
-		if err != nil {
+		s.tick++
+		if err := s.saveCheckpoint(); err != nil {
 			return err
 		}
-	}
 
-	time.Sleep(time.Duration(s.conf.WaitTime) * time.Second)
+		if progressed {
+			backoff = s.confirmer.InitialBackoff
+			lastProgress = time.Now()
+			time.Sleep(time.Duration(s.conf.WaitTime) * time.Second)
+			continue
+		}
 
-	// Accept the medical data and trial from participants
-	trialAndMedicalBitmarkIDs := make([]string, 0)
-	for _, ms := range matchingServices {
-		bitmarkIDs, err := ms.AcceptTrialBackAndMedicalData()
-		if err != nil {
-			return err
+		if time.Since(lastProgress) > s.confirmer.MaxWait {
+			return s.stalled()
 		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > s.confirmer.MaxBackoff {
+			backoff = s.confirmer.MaxBackoff
+		}
+	}
 
-		trialAndMedicalBitmarkIDs = append(trialAndMedicalBitmarkIDs, bitmarkIDs...)
+	if err := s.reportForeign(events); err != nil {
+		return err
 	}
 
-	// Wait for bitmarks to be confirmed
-	util.WaitForBitmarkConfirmations(trialAndMedicalBitmarkIDs)
+	fmt.Println("\nLedger reconciliation")
+	reconciliation, err := s.custody.Reconcile(s.ledger)
+	if err != nil {
+		return err
+	}
+	if err := reconciliation.WriteText(os.Stdout, s.name); err != nil {
+		return err
+	}
 
-	time.Sleep(time.Duration(s.conf.WaitTime) * time.Second)
+	fmt.Println("\nRecruitment funnel")
+	return s.Report().WriteText(os.Stdout)
+}
 
-	// Evaluate the trial from participants
-	for _, ms := range matchingServices {
-		err := ms.EvaluateTrialFromParticipant()
-		if err != nil {
-			return err
-		}
+func (s *Simulator) name(account string) string {
+	if name, ok := s.identities[account]; ok {
+		return name
 	}
+	if account == s.conf.MatchingService.TrashBinAccount || account == s.conf.Sponsors.TrashBinAccount {
+		return "Trash bin"
+	}
+	return account
+}
 
-	time.Sleep(time.Duration(s.conf.WaitTime) * time.Second)
-
-	// Accept receiving from sponsors
-	acceptTrialAndMedicalFromSponsorBitmarkIDs := make([]string, 0)
-	for _, ss := range sponsors {
-		bitmarkIDs, err := ss.AcceptTrialBackAndMedicalData()
+func (s *Simulator) newRoles(events event.Sink) error {
+	for i, account := range s.conf.Sponsors.Accounts {
+		ss, err := newSponsor(i, account.Identity, account.Seed, s.conf.Sponsors, s.ledger, events)
 		if err != nil {
 			return err
 		}
-
-		acceptTrialAndMedicalFromSponsorBitmarkIDs = append(acceptTrialAndMedicalFromSponsorBitmarkIDs, bitmarkIDs...)
+		s.sponsors = append(s.sponsors, ss)
 	}
 
-	time.Sleep(time.Duration(s.conf.WaitTime) * time.Second)
-
-	util.WaitForBitmarkConfirmations(acceptTrialAndMedicalFromSponsorBitmarkIDs)
-
-	// Evaluate from sponsors
-	for _, ss := range sponsors {
-		err := ss.EvaluateTrialFromSponsor()
+	for i := 0; i < s.conf.Participants.ParticipantNum; i++ {
+		pp, err := newParticipant(s.conf.Participants, s.ledger, events)
 		if err != nil {
 			return err
 		}
+		s.participants = append(s.participants, pp)
 	}
 
-	time.Sleep(time.Duration(s.conf.WaitTime) * time.Second)
-
-	// Accept transfer from participants
-	sendFromSponsorToParticipantTxs := make([]string, 0)
-	for _, pp := range participants {
-		trialTXs, err := pp.ProcessRecevingTrialBitmark(ProcessReceivingTrialBitmarkFromSponsor)
+	for _, account := range s.conf.MatchingService.Accounts {
+		m, err := newMatchingService(account.Identity, account.Seed, s.conf.MatchingService, s.ledger, events)
 		if err != nil {
 			return err
 		}
 
-		sendFromSponsorToParticipantTxs = append(sendFromSponsorToParticipantTxs, trialTXs...)
+		m.Participants = s.participants
+		s.matchingServices = append(s.matchingServices, m)
 	}
 
-	// Wait for transactions to be confirmed
-	util.WaitForBitmarkConfirmations(sendFromSponsorToParticipantTxs)
-
 	return nil
 }
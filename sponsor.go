@@ -1,29 +1,50 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"strconv"
+	"time"
 
 	"github.com/bitmark-inc/bitmark-sdk-go/bitmark"
 
 	"github.com/bitmark-inc/bitmark-sdk-go/account"
-	"github.com/bitmark-inc/bitmark-sdk-go/asset"
+	"github.com/bitmark-inc/ct-match/event"
+	"github.com/bitmark-inc/ct-match/ledger"
+	"github.com/bitmark-inc/ct-match/store"
 	"github.com/bitmark-inc/ct-match/util"
 )
 
 type Sponsor struct {
-	Account                        account.Account
-	index                          int
-	Name                           string
-	conf                           SponsorsConf
-	receivedTrialAndHealthBitmarks []*bitmark.Bitmark
-	Identities                     map[string]string
+	Account    account.Account
+	index      int
+	Name       string
+	conf       SponsorsConf
+	ledger     ledger.Ledger
+	events     event.Sink
+	Identities map[string]string
+	policies   SponsorPolicies
+	runID      string
+	verifier   *Verifier
+	trashBin   string
+	store      *store.Store
+	studies    []*Study
 }
 
 func (s *Sponsor) print(a ...interface{}) {
 	fmt.Println("["+s.Name+"] ", a)
 }
 
-func newSponsor(index int, name, seed string, conf SponsorsConf) (*Sponsor, error) {
+func newSponsor(index int, name, seed string, conf SponsorsConf, l ledger.Ledger, events event.Sink) (*Sponsor, error) {
+	switch conf.WithdrawnData {
+	case "", WithdrawnDataReturn, WithdrawnDataDispose:
+	default:
+		return nil, fmt.Errorf("unknown withdrawn_data: %s", conf.WithdrawnData)
+	}
+	if err := validateDisposal(conf.ConsentDisposal); err != nil {
+		return nil, err
+	}
+
 	acc, err := account.FromSeed(seed)
 	if err != nil {
 		return nil, err
@@ -33,154 +54,397 @@ func newSponsor(index int, name, seed string, conf SponsorsConf) (*Sponsor, erro
 		Account: acc,
 		Name:    name,
 		conf:    conf,
+		ledger:  l,
+		events:  events,
 		index:   index,
 	}, nil
 }
 
+func (s *Sponsor) emit(e event.Event) {
+	e.Time = time.Now().UTC()
+	e.Actor = s.Account.AccountNumber()
+	e.ActorRole = event.RoleSponsor
+	s.events.Emit(e)
+}
+
 // type TrialBitmark struct {
 // 	BitmarkID string
 // 	AssetID   string
 // }
 
-func (s *Sponsor) RegisterNewTrial() ([]string, []string, error) {
+func (s *Sponsor) RegisterNewTrial() ([]*Trial, error) {
 	numberOfTrials := util.RandWithRange(s.conf.TrialPerSponsorMin, s.conf.TrialPerSponsorMax)
-	trialBitmarkIds := make([]string, 0)
-	trialAssetIds := make([]string, 0)
+	trials := make([]*Trial, 0)
 
 	for i := 0; i < numberOfTrials; i++ {
-		assetName := util.RandInPool(s.conf.StudiesPool)
-		trialContent := assetName + "\n\n" + util.RandStringBytesMaskImprSrc(2000)
-		assetParam, err := asset.NewRegistrationParams(
+		metadata := newMetadata(AssetTrial)
+		metadata[metadataSponsor] = s.Name
+		metadata[RunIDKey] = s.runID
+
+		var assetName, trialContent string
+		capacity := s.conf.EnrollmentTarget
+		status := TrialRecruiting
+		if len(s.studies) > 0 {
+			study := s.studies[util.RandWithRange(0, len(s.studies))]
+			assetName = study.AssetName()
+			content, err := json.MarshalIndent(trialDefinition{
+				Sponsor:      s.Name,
+				Registration: util.RandStringBytesMaskImprSrc(32),
+				Study:        study,
+			}, "", "  ")
+			if err != nil {
+				return nil, err
+			}
+			trialContent = string(content)
+			study.AddTo(metadata)
+			s.studyCriteria(study).AddTo(metadata)
+			if capacity == 0 {
+				capacity = study.EnrollmentTarget
+			}
+			if !study.Recruiting() {
+				status = TrialClosed
+			}
+		} else {
+			assetName = util.RandInPool(s.conf.StudiesPool)
+			trialContent = assetName + "\n\n" + util.RandStringBytesMaskImprSrc(2000)
+			s.criteria(assetName).AddTo(metadata)
+		}
+		if capacity > 0 {
+			metadata[metadataEnrollmentTarget] = strconv.Itoa(capacity)
+		}
+		// A study may have more conditions and sites than the metadata
+		// holds, the content keeps all of them
+		fitLists(metadata, metadataConditions, metadataLocations)
+
+		assetID, err := registerAsset(
+			s.ledger,
+			s.Account,
 			assetName,
-			map[string]string{
-				"Sponsor": s.Name,
-				"Type":    "Trial",
-			},
+			metadata,
+			[]byte(trialContent),
 		)
-		assetParam.SetFingerprintFromData([]byte(trialContent))
-		assetParam.Sign(s.Account)
-		assetID, err := asset.Register(assetParam)
 		if err != nil {
-			return nil, nil, err
+			return nil, err
 		}
 
-		issueParam, _ := bitmark.NewIssuanceParams(
-			assetID,
-			1,
-		)
-		issueParam.Sign(s.Account)
-		bitmarkIDs, err := bitmark.Issue(issueParam)
+		bitmarkIDs, err := s.ledger.Issue(s.Account, assetID, 1)
 		if err != nil {
-			return nil, nil, err
+			return nil, err
 		}
 
-		trialBitmarkIds = append(trialBitmarkIds, bitmarkIDs...)
-		trialAssetIds = append(trialAssetIds, assetID)
+		t := &Trial{
+			AssetID:   assetID,
+			BitmarkID: bitmarkIDs[0],
+			Name:      assetName,
+			Sponsor:   s.Account.AccountNumber(),
+			Capacity:  capacity,
+			Status:    status,
+		}
+		trials = append(trials, t)
 
-		fmt.Printf("%s announced %s by adding the trial asset and bitmark to the blockchain.\n", s.Name, assetName)
+		s.emit(event.Event{
+			Type:      event.TrialRegistered,
+			Kind:      event.KindTrial,
+			AssetID:   assetID,
+			Asset:     assetName,
+			BitmarkID: bitmarkIDs[0],
+			TrialID:   assetID,
+			Trial:     assetName,
+		})
+		if status == TrialClosed {
+			s.AnnounceStatus(t, reasonNotRecruiting)
+		}
 	}
 
-	return trialBitmarkIds, trialAssetIds, nil
+	return trials, nil
 }
 
-func (s *Sponsor) AcceptTrialBackAndMedicalData() ([]string, error) {
-	builder := bitmark.NewQueryParamsBuilder().
-		OfferTo(s.Account.AccountNumber()).
-		LoadAsset(true)
+// AnnounceStatus announces the recruitment status of a trial
+func (s *Sponsor) AnnounceStatus(t *Trial, reason string) {
+	s.emit(event.Event{
+		Type:      event.TrialStatusChanged,
+		Kind:      event.KindTrial,
+		AssetID:   t.AssetID,
+		Asset:     t.Name,
+		BitmarkID: t.BitmarkID,
+		TrialID:   t.AssetID,
+		Trial:     t.Name,
+		Status:    string(t.Status),
+		Reason:    reason,
+	})
+}
 
-	bitmarks, assets, err := bitmark.List(builder)
-	if err != nil {
-		return nil, err
+// criteria returns the configured eligibility criteria of a study
+func (s *Sponsor) criteria(study string) Criteria {
+	for _, c := range s.conf.Eligibility {
+		if c.Study == study {
+			return c.Criteria
+		}
+	}
+	return Criteria{}
+}
+
+// studyCriteria returns the eligibility criteria configured for an imported
+// study, by NCT ID or title, or else the ones of its export
+func (s *Sponsor) studyCriteria(study *Study) Criteria {
+	if c := s.criteria(study.NCTID); !c.Empty() {
+		return c
 	}
-	referencedAssets := make(map[string]*asset.Asset)
-	for _, asset := range assets {
-		referencedAssets[asset.ID] = asset
+	if c := s.criteria(study.Title); !c.Empty() {
+		return c
 	}
+	return study.Criteria
+}
 
-	bitmarkIDs := make([]string, 0)
-	filterredBitmarks := make([]*bitmark.Bitmark, 0)
+// trialDefinition is the content of the trial asset of an imported study.
+// Registration sets apart the assets of the same study.
+type trialDefinition struct {
+	Sponsor      string `json:"sponsor"`
+	Registration string `json:"registration"`
+	Study        *Study `json:"study"`
+}
 
-	for _, b := range bitmarks {
-		params := bitmark.NewTransferResponseParams(b, bitmark.Accept)
-		params.Sign(s.Account)
-		if _, err := bitmark.Respond(params); err != nil {
-			return nil, err
-		}
+// VerifyOffer rejects the offered bitmarks of a consent unless they pass verification
+func (s *Sponsor) VerifyOffer(c *Consent, sender string, bitmarks ...*bitmark.Bitmark) (bool, error) {
+	return verifyOffer(s.verifier, s.ledger, s.Account, s.emit, c, sender, bitmarks...)
+}
 
-		assetType, ok := referencedAssets[b.AssetID].Metadata["Type"]
-		if ok {
-			switch assetType {
-			case "Trial":
-				fmt.Printf("%s signed for acceptance of consent bitmark for %s from %s.\n",
-					s.Name,
-					referencedAssets[b.AssetID].Name,
-					s.Identities[b.Offer.From])
-				bitmarkIDs = append(bitmarkIDs, b.ID)
-				filterredBitmarks = append(filterredBitmarks, b)
-			case "Health Data":
-				fmt.Printf("%s signed for acceptance of health data bitmark for %s from %s for %s and is evaluating it.\n",
-					s.Name,
-					referencedAssets[b.AssetID].Name,
-					s.Identities[b.Offer.From],
-					s.Identities[referencedAssets[b.AssetID].Registrant])
-				bitmarkIDs = append(bitmarkIDs, b.ID)
-				filterredBitmarks = append(filterredBitmarks, b)
-			default:
-				fmt.Println("Unknow bitmark")
-			}
-		}
+// AcceptHealthData signs for the health data and consent bitmarks offered by the matching service
+func (s *Sponsor) AcceptHealthData(c *Consent, healthData, consent *bitmark.Bitmark) error {
+	if _, err := s.ledger.Respond(s.Account, healthData, bitmark.Accept); err != nil {
+		return err
+	}
+	if _, err := s.ledger.Respond(s.Account, consent, bitmark.Accept); err != nil {
+		return err
+	}
 
+	accepted := event.Event{
+		Type:         event.OfferAccepted,
+		Counterparty: c.MatchingService,
+		Participant:  c.Participant,
+		Kind:         event.KindHealthData,
+		AssetID:      c.HealthDataAssetID,
+		Asset:        c.HealthData,
+		BitmarkID:    c.HealthDataID,
+		ConsentID:    c.ID,
+		TrialID:      c.TrialID,
+		Trial:        c.Trial,
 	}
+	s.emit(accepted)
 
-	s.receivedTrialAndHealthBitmarks = filterredBitmarks
-	return bitmarkIDs, nil
+	accepted.Kind = event.KindConsent
+	accepted.AssetID = c.TrialID
+	accepted.Asset = c.Trial
+	accepted.BitmarkID = c.ID
+	s.emit(accepted)
+
+	return nil
 }
 
-func (s *Sponsor) EvaluateTrialFromSponsor() error {
-	for _, b := range s.receivedTrialAndHealthBitmarks {
-		referencedAsset, err := asset.Get(b.AssetID)
-		if err != nil {
-			return err
-		}
-		assetType, ok := referencedAsset.Metadata["Type"]
-		if ok && assetType == "Health Data" {
-			consentBitmarkID, ok := referencedAsset.Metadata["Trial Bitmark"]
-			if !ok {
-				continue
-			}
+// VerifyHealthData checks the health data of a consent against the
+// fingerprint of its asset and returns the profile the intact health data
+// describes. Tampered health data is returned to the participant and the
+// consent is disposed.
+func (s *Sponsor) VerifyHealthData(c *Consent) (Profile, bool, error) {
+	return verifyHealthData(s.ledger, s.store, s.Account, s.emit, c, s.conf.ConsentDisposal, s.trashBin)
+}
 
-			consentBitmark, err := bitmark.Get(consentBitmarkID)
-			if err != nil {
-				return err
-			}
-			consentAsset, err := asset.Get(consentBitmark.AssetID)
-			if err != nil {
-				return err
-			}
+// Evaluate decides on the health data of a consent. Approved participants
+// are offered the consent back, or wait for a seat when the trial is full.
+// The others get their health data back, as do all participants once a
+// full trial is closed.
+func (s *Sponsor) Evaluate(c *Consent, profile Profile, t *Trial, full bool) (bool, error) {
+	if full && t.Status == TrialClosed {
+		return false, s.reject(c, reasonTrialClosed)
+	}
 
-			participantAccountNumber := referencedAsset.Registrant
-
-			if util.RandWithProb(s.conf.DataApprovalProb) {
-				consentOfferParam, _ := bitmark.NewOfferParams(participantAccountNumber, nil)
-				consentOfferParam.FromBitmark(consentBitmarkID)
-				consentOfferParam.Sign(s.Account)
-				if err := bitmark.Offer(consentOfferParam); err != nil {
-					return err
-				}
-				fmt.Printf("%s approved health data bitmark for %s from %s for acceptance into %s and sent consent bitmark to %s for acceptance into %s.\n", s.Name, referencedAsset.Name, s.Identities[participantAccountNumber], referencedAsset.Name, s.Identities[participantAccountNumber], consentAsset.Name)
-			} else {
-				healthTransferParam, _ := bitmark.NewTransferParams(participantAccountNumber)
-				healthTransferParam.FromBitmark(b.ID)
-				healthTransferParam.Sign(s.Account)
-				_, err := bitmark.Transfer(healthTransferParam)
-				if err != nil {
-					return err
-				}
-
-				fmt.Printf("%s rejected health data bitmark for %s from %s. %s has sent the rejected health data bitmark back to %s.\n", s.Name, referencedAsset.Name, s.Identities[participantAccountNumber], s.Name, s.Identities[participantAccountNumber])
-			}
+	if approved, _ := s.policies.ApproveData.Decide(Decision{
+		Point:   DecideApproveData,
+		Actor:   s.Account.AccountNumber(),
+		Trial:   c.Trial,
+		Profile: profile,
+		Consent: c,
+	}); approved {
+		if full {
+			s.emit(event.Event{
+				Type:         event.EvaluationApproved,
+				Counterparty: c.Participant,
+				Participant:  c.Participant,
+				Kind:         event.KindHealthData,
+				AssetID:      c.HealthDataAssetID,
+				Asset:        c.HealthData,
+				BitmarkID:    c.HealthDataID,
+				ConsentID:    c.ID,
+				TrialID:      c.TrialID,
+				Trial:        c.Trial,
+				Reason:       "waitlisted",
+			})
+			return true, nil
 		}
+		s.emit(event.Event{
+			Type:         event.EvaluationApproved,
+			Counterparty: c.Participant,
+			Participant:  c.Participant,
+			Kind:         event.KindHealthData,
+			AssetID:      c.HealthDataAssetID,
+			Asset:        c.HealthData,
+			BitmarkID:    c.HealthDataID,
+			ConsentID:    c.ID,
+			TrialID:      c.TrialID,
+			Trial:        c.Trial,
+		})
+		return true, s.OfferEnrolment(c)
+	}
+
+	return false, s.reject(c, "")
+}
+
+// reject returns the health data of a consent to the participant and
+// disposes of the consent. Health data is rejected on its merits when
+// reason is empty.
+func (s *Sponsor) reject(c *Consent, reason string) error {
+	if _, err := s.ledger.Transfer(s.Account, c.HealthDataID, c.Participant); err != nil {
+		return err
+	}
+
+	rejected := event.Event{
+		Type:         event.EvaluationRejected,
+		Counterparty: c.Participant,
+		Participant:  c.Participant,
+		Kind:         event.KindHealthData,
+		AssetID:      c.HealthDataAssetID,
+		Asset:        c.HealthData,
+		BitmarkID:    c.HealthDataID,
+		ConsentID:    c.ID,
+		TrialID:      c.TrialID,
+		Trial:        c.Trial,
+		Reason:       reason,
+	}
+	s.emit(rejected)
+
+	returned := rejected
+	returned.Type = event.HealthDataReturned
+	s.emit(returned)
+
+	if reason == "" {
+		reason = "health data was rejected"
 	}
+	return disposeConsent(s.ledger, s.Account, s.emit, c, s.conf.ConsentDisposal, s.trashBin, reason)
+}
+
+// PromoteFromWaitlist offers enrolment to a waitlisted participant once a
+// seat of the trial is free
+func (s *Sponsor) PromoteFromWaitlist(c *Consent) error {
+	s.emit(event.Event{
+		Type:         event.WaitlistPromoted,
+		Counterparty: c.Participant,
+		Participant:  c.Participant,
+		Kind:         event.KindConsent,
+		AssetID:      c.TrialID,
+		Asset:        c.Trial,
+		BitmarkID:    c.ID,
+		ConsentID:    c.ID,
+		TrialID:      c.TrialID,
+		Trial:        c.Trial,
+	})
+	return s.OfferEnrolment(c)
+}
 
+// ReleaseWaitlisted returns the health data of a waitlisted participant
+// once no seat of the trial can free up, and disposes of the consent
+func (s *Sponsor) ReleaseWaitlisted(c *Consent) error {
+	if _, err := s.ledger.Transfer(s.Account, c.HealthDataID, c.Participant); err != nil {
+		return err
+	}
+	s.emit(event.Event{
+		Type:         event.HealthDataReturned,
+		Counterparty: c.Participant,
+		Participant:  c.Participant,
+		Kind:         event.KindHealthData,
+		AssetID:      c.HealthDataAssetID,
+		Asset:        c.HealthData,
+		BitmarkID:    c.HealthDataID,
+		ConsentID:    c.ID,
+		TrialID:      c.TrialID,
+		Trial:        c.Trial,
+		Reason:       "trial is full",
+	})
+	return disposeConsent(s.ledger, s.Account, s.emit, c, s.conf.ConsentDisposal, s.trashBin, "trial is full")
+}
+
+// OfferEnrolment offers the consent back to an approved participant
+func (s *Sponsor) OfferEnrolment(c *Consent) error {
+	if err := s.ledger.Offer(s.Account, c.ID, c.Participant); err != nil {
+		return err
+	}
+	s.emit(event.Event{
+		Type:         event.ConsentOffered,
+		Counterparty: c.Participant,
+		Participant:  c.Participant,
+		Kind:         event.KindConsent,
+		AssetID:      c.TrialID,
+		Asset:        c.Trial,
+		BitmarkID:    c.ID,
+		ConsentID:    c.ID,
+		TrialID:      c.TrialID,
+		Trial:        c.Trial,
+	})
+	return nil
+}
+
+// IgnoreOffer decides whether the sponsor leaves the offers of a consent unanswered
+func (s *Sponsor) IgnoreOffer(c *Consent, profile Profile) bool {
+	ignore, _ := s.policies.IgnoreOffer.Decide(Decision{
+		Point:   DecideIgnoreOffer,
+		Actor:   s.Account.AccountNumber(),
+		Trial:   c.Trial,
+		Profile: profile,
+		Consent: c,
+	})
+	return ignore
+}
+
+// CancelOffers cancels the expired offers of a consent
+func (s *Sponsor) CancelOffers(c *Consent, ttl time.Duration, bitmarks ...*bitmark.Bitmark) error {
+	return cancelOffers(s.ledger, s.Account, s.emit, c, ttl, bitmarks...)
+}
+
+// ReleaseExpired returns the health data of a consent whose offer expired
+// to the participant and disposes of the consent
+func (s *Sponsor) ReleaseExpired(c *Consent, disposal string) error {
+	return releaseExpired(s.ledger, s.Account, s.emit, c, disposal, s.trashBin)
+}
+
+// What sponsors do with the health data of a withdrawn participant
+const (
+	WithdrawnDataReturn  = "return"
+	WithdrawnDataDispose = "dispose"
+)
+
+// ReleaseHealthData gives the health data of a withdrawn participant back
+// to them or disposes it into the trash bin
+func (s *Sponsor) ReleaseHealthData(c *Consent) error {
+	e := event.Event{
+		Type:         event.HealthDataReturned,
+		Counterparty: c.Participant,
+		Participant:  c.Participant,
+		Kind:         event.KindHealthData,
+		AssetID:      c.HealthDataAssetID,
+		Asset:        c.HealthData,
+		BitmarkID:    c.HealthDataID,
+		ConsentID:    c.ID,
+		TrialID:      c.TrialID,
+		Trial:        c.Trial,
+		Reason:       "withdrawal",
+	}
+	if s.conf.WithdrawnData == WithdrawnDataDispose {
+		e.Type = event.HealthDataDisposed
+		e.Counterparty = s.trashBin
+	}
+
+	if _, err := s.ledger.Transfer(s.Account, c.HealthDataID, e.Counterparty); err != nil {
+		return err
+	}
+	s.emit(e)
 	return nil
 }
@@ -0,0 +1,236 @@
+package store
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/bitmark-inc/bitmark-sdk-go/account"
+	"github.com/bitmark-inc/ct-match/ledger"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+var (
+	ErrNoEncrKey     = errors.New("account has no encryption key")
+	ErrUnknownKey    = errors.New("encryption key of the account is not registered")
+	ErrNoContent     = errors.New("no content stored for the asset")
+	ErrNoGrant       = errors.New("account has no access grant for the content")
+	ErrNotHolder     = errors.New("account does not hold the bitmark")
+	ErrUndecryptable = errors.New("content cannot be decrypted")
+)
+
+// Grant lets a recipient open the key the content of an asset is encrypted with
+type Grant struct {
+	From      string `json:"from"` // account that sealed the key
+	SealedKey []byte `json:"sealed_key"`
+}
+
+// Store keeps the content of assets off the ledger. Every content is
+// encrypted once with its own key, and that key is sealed for each account
+// granted access with the encryption keys of the accounts. A grant is only
+// opened for the account holding a bitmark of the asset on the ledger, so
+// a recipient reads the content once it accepted the transfer.
+type Store struct {
+	sync.Mutex
+	ledger ledger.Ledger
+
+	keys     map[string][]byte           // account -> public encryption key
+	contents map[string][]byte           // asset id -> nonce followed by the encrypted content
+	grants   map[string]map[string]Grant // asset id -> recipient -> grant
+}
+
+func New(l ledger.Ledger) *Store {
+	return &Store{
+		ledger:   l,
+		keys:     make(map[string][]byte),
+		contents: make(map[string][]byte),
+		grants:   make(map[string]map[string]Grant),
+	}
+}
+
+// SetLedger sets the ledger of a store restored from a checkpoint
+func (s *Store) SetLedger(l ledger.Ledger) {
+	s.ledger = l
+}
+
+// Register publishes the public encryption key of an account
+func (s *Store) Register(acc account.Account) error {
+	key, err := encrKey(acc)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.keys[acc.AccountNumber()] = key.PublicKeyBytes()
+	return nil
+}
+
+// Put encrypts the content of an asset and grants its owner access
+func (s *Store) Put(owner account.Account, assetID string, content []byte) error {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return err
+	}
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.contents[assetID] = secretbox.Seal(nonce[:], content, &nonce, &key)
+	return s.seal(owner, assetID, owner.AccountNumber(), key[:])
+}
+
+// Grant seals the key of the content of an asset for recipient. The holder
+// must have access itself.
+func (s *Store) Grant(holder account.Account, assetID, recipient string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	key, err := s.open(holder, assetID)
+	if err != nil {
+		return err
+	}
+	return s.seal(holder, assetID, recipient, key)
+}
+
+// Read decrypts the content of the asset of a bitmark held by reader
+func (s *Store) Read(reader account.Account, bitmarkID string) ([]byte, error) {
+	b, err := s.ledger.GetBitmark(bitmarkID)
+	if err != nil {
+		return nil, err
+	}
+	if b.Owner != reader.AccountNumber() {
+		return nil, ErrNotHolder
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	encrypted, ok := s.contents[b.AssetID]
+	if !ok {
+		return nil, ErrNoContent
+	}
+	key, err := s.open(reader, b.AssetID)
+	if err != nil {
+		return nil, err
+	}
+
+	var nonce [24]byte
+	var secret [32]byte
+	copy(nonce[:], encrypted[:24])
+	copy(secret[:], key)
+	content, ok := secretbox.Open(nil, encrypted[24:], &nonce, &secret)
+	if !ok {
+		return nil, ErrUndecryptable
+	}
+	return content, nil
+}
+
+// Grantees returns the accounts granted access to the content of an asset
+func (s *Store) Grantees(assetID string) []string {
+	s.Lock()
+	defer s.Unlock()
+
+	grantees := make([]string, 0, len(s.grants[assetID]))
+	for recipient := range s.grants[assetID] {
+		grantees = append(grantees, recipient)
+	}
+	sort.Strings(grantees)
+	return grantees
+}
+
+func (s *Store) seal(sender account.Account, assetID, recipient string, key []byte) error {
+	senderKey, err := encrKey(sender)
+	if err != nil {
+		return err
+	}
+	recipientKey, ok := s.keys[recipient]
+	if !ok {
+		return ErrUnknownKey
+	}
+
+	sealed, err := senderKey.Encrypt(key, recipientKey)
+	if err != nil {
+		return err
+	}
+	if _, ok := s.grants[assetID]; !ok {
+		s.grants[assetID] = make(map[string]Grant)
+	}
+	s.grants[assetID][recipient] = Grant{From: sender.AccountNumber(), SealedKey: sealed}
+	return nil
+}
+
+func (s *Store) open(recipient account.Account, assetID string) ([]byte, error) {
+	grant, ok := s.grants[assetID][recipient.AccountNumber()]
+	if !ok {
+		return nil, ErrNoGrant
+	}
+	senderKey, ok := s.keys[grant.From]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	recipientKey, err := encrKey(recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := recipientKey.Decrypt(grant.SealedKey, senderKey)
+	if err != nil {
+		return nil, ErrUndecryptable
+	}
+	return key, nil
+}
+
+func encrKey(acc account.Account) (account.EncrKey, error) {
+	switch a := acc.(type) {
+	case *account.AccountV1:
+		return a.EncrKey, nil
+	case *account.AccountV2:
+		return a.EncrKey, nil
+	}
+	return nil, ErrNoEncrKey
+}
+
+// storeState is how a Store is saved, e.g. into a checkpoint
+type storeState struct {
+	Keys     map[string][]byte           `json:"keys"`
+	Contents map[string][]byte           `json:"contents"`
+	Grants   map[string]map[string]Grant `json:"grants"`
+}
+
+func (s *Store) MarshalJSON() ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	return json.Marshal(storeState{
+		Keys:     s.keys,
+		Contents: s.contents,
+		Grants:   s.grants,
+	})
+}
+
+func (s *Store) UnmarshalJSON(data []byte) error {
+	restored := New(nil)
+	state := storeState{
+		Keys:     restored.keys,
+		Contents: restored.contents,
+		Grants:   restored.grants,
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.keys = state.Keys
+	s.contents = state.Contents
+	s.grants = state.Grants
+	return nil
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Metadata keys of the study a trial asset is imported from
+const (
+	metadataNCTID            = "NCT ID"
+	metadataPhase            = "Phase"
+	metadataEnrollmentTarget = "Enrollment Target"
+)
+
+// Study is a trial definition imported from a ClinicalTrials.gov export
+type Study struct {
+	NCTID               string   `json:"nct_id"`
+	Title               string   `json:"title"`
+	Conditions          []string `json:"conditions"`
+	Phase               string   `json:"phase,omitempty"`
+	EligibilityCriteria string   `json:"eligibility_criteria,omitempty"`
+	EnrollmentTarget    int      `json:"enrollment_target,omitempty"`
+	Sites               []Site   `json:"sites"`
+	Status              string   `json:"status,omitempty"` // overall status, e.g. RECRUITING or COMPLETED
+
+	Criteria Criteria `json:"-"` // structured part of the eligibility
+}
+
+type Site struct {
+	Facility string `json:"facility,omitempty"`
+	City     string `json:"city,omitempty"`
+	State    string `json:"state,omitempty"`
+	Country  string `json:"country,omitempty"`
+}
+
+// AssetName is the name of the trial asset of the study
+func (s *Study) AssetName() string {
+	name := s.NCTID + " " + s.Title
+	if utf8.RuneCountInString(name) <= maxAssetName {
+		return name
+	}
+	cut := []rune(name)[:maxAssetName-3]
+	return strings.TrimSpace(string(cut)) + "..."
+}
+
+// AddTo writes the study into the metadata of a trial asset
+func (s *Study) AddTo(metadata map[string]string) {
+	metadata[metadataNCTID] = s.NCTID
+	if s.Phase != "" {
+		metadata[metadataPhase] = s.Phase
+	}
+	if s.EnrollmentTarget > 0 {
+		metadata[metadataEnrollmentTarget] = strconv.Itoa(s.EnrollmentTarget)
+	}
+}
+
+// loadStudies reads every ClinicalTrials.gov study of dir: JSON files as
+// exported by the current API, XML files as exported by the classic site
+func loadStudies(dir string) ([]*Study, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	studies := make([]*Study, 0)
+	for _, f := range files {
+		var parse func([]byte) (*Study, error)
+		switch strings.ToLower(filepath.Ext(f.Name())) {
+		case ".json":
+			parse = parseStudyJSON
+		case ".xml":
+			parse = parseStudyXML
+		default:
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		study, err := parse(data)
+		if err != nil {
+			return nil, fmt.Errorf("study %s: %s", f.Name(), err)
+		}
+		studies = append(studies, study)
+	}
+	if len(studies) == 0 {
+		return nil, fmt.Errorf("no study in %s", dir)
+	}
+	return studies, nil
+}
+
+// ctgStudy is the part of a study of the ClinicalTrials.gov API used
+type ctgStudy struct {
+	ProtocolSection struct {
+		IdentificationModule struct {
+			NCTID         string `json:"nctId"`
+			BriefTitle    string `json:"briefTitle"`
+			OfficialTitle string `json:"officialTitle"`
+		} `json:"identificationModule"`
+		StatusModule struct {
+			OverallStatus string `json:"overallStatus"`
+		} `json:"statusModule"`
+		ConditionsModule struct {
+			Conditions []string `json:"conditions"`
+		} `json:"conditionsModule"`
+		DesignModule struct {
+			Phases         []string `json:"phases"`
+			EnrollmentInfo struct {
+				Count int `json:"count"`
+			} `json:"enrollmentInfo"`
+		} `json:"designModule"`
+		EligibilityModule struct {
+			EligibilityCriteria string `json:"eligibilityCriteria"`
+			Sex                 string `json:"sex"`
+			MinimumAge          string `json:"minimumAge"`
+			MaximumAge          string `json:"maximumAge"`
+		} `json:"eligibilityModule"`
+		ContactsLocationsModule struct {
+			Locations []Site `json:"locations"`
+		} `json:"contactsLocationsModule"`
+	} `json:"protocolSection"`
+}
+
+func parseStudyJSON(data []byte) (*Study, error) {
+	var s ctgStudy
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	p := s.ProtocolSection
+
+	phases := make([]string, 0, len(p.DesignModule.Phases))
+	for _, phase := range p.DesignModule.Phases {
+		// e.g. PHASE2 or EARLY_PHASE1
+		if phase == "NA" {
+			continue
+		}
+		phase = strings.Replace(strings.ToLower(phase), "_", " ", -1)
+		phases = append(phases, strings.Title(strings.Replace(phase, "phase", "phase ", 1)))
+	}
+
+	study, err := newStudy(
+		p.IdentificationModule.NCTID,
+		firstOf(p.IdentificationModule.BriefTitle, p.IdentificationModule.OfficialTitle),
+		p.ConditionsModule.Conditions,
+		strings.Join(phases, "/"),
+		p.EligibilityModule.EligibilityCriteria,
+		p.DesignModule.EnrollmentInfo.Count,
+		p.ContactsLocationsModule.Locations,
+		p.EligibilityModule.Sex,
+		p.EligibilityModule.MinimumAge,
+		p.EligibilityModule.MaximumAge,
+	)
+	if err != nil {
+		return nil, err
+	}
+	study.Status = p.StatusModule.OverallStatus
+	return study, nil
+}
+
+// ctgClinicalStudy is the part of a classic ClinicalTrials.gov XML study used
+type ctgClinicalStudy struct {
+	NCTID         string   `xml:"id_info>nct_id"`
+	BriefTitle    string   `xml:"brief_title"`
+	OfficialTitle string   `xml:"official_title"`
+	OverallStatus string   `xml:"overall_status"`
+	Conditions    []string `xml:"condition"`
+	Phase         string   `xml:"phase"`
+	Enrollment    string   `xml:"enrollment"`
+	Eligibility   struct {
+		Criteria   string `xml:"criteria>textblock"`
+		Gender     string `xml:"gender"`
+		MinimumAge string `xml:"minimum_age"`
+		MaximumAge string `xml:"maximum_age"`
+	} `xml:"eligibility"`
+	Locations []struct {
+		Name    string `xml:"facility>name"`
+		City    string `xml:"facility>address>city"`
+		State   string `xml:"facility>address>state"`
+		Country string `xml:"facility>address>country"`
+	} `xml:"location"`
+}
+
+func parseStudyXML(data []byte) (*Study, error) {
+	var s ctgClinicalStudy
+	if err := xml.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+
+	enrollment := 0
+	if e := strings.TrimSpace(s.Enrollment); e != "" {
+		var err error
+		if enrollment, err = strconv.Atoi(e); err != nil {
+			return nil, fmt.Errorf("invalid enrollment: %s", e)
+		}
+	}
+	phase := s.Phase
+	if phase == "N/A" {
+		phase = ""
+	}
+	sites := make([]Site, 0, len(s.Locations))
+	for _, l := range s.Locations {
+		sites = append(sites, Site{Facility: l.Name, City: l.City, State: l.State, Country: l.Country})
+	}
+
+	study, err := newStudy(
+		s.NCTID,
+		firstOf(s.BriefTitle, s.OfficialTitle),
+		s.Conditions,
+		phase,
+		s.Eligibility.Criteria,
+		enrollment,
+		sites,
+		s.Eligibility.Gender,
+		s.Eligibility.MinimumAge,
+		s.Eligibility.MaximumAge,
+	)
+	if err != nil {
+		return nil, err
+	}
+	study.Status = s.OverallStatus
+	return study, nil
+}
+
+// newStudy cleans up the fields of an export and works out the structured
+// eligibility criteria: age range, sex, conditions and site cities
+func newStudy(nctID, title string, conditions []string, phase, criteria string, enrollment int, sites []Site, sex, minAge, maxAge string) (*Study, error) {
+	nctID = strings.TrimSpace(nctID)
+	if nctID == "" {
+		return nil, fmt.Errorf("no NCT ID")
+	}
+	title = strings.Join(strings.Fields(title), " ")
+	if title == "" {
+		return nil, fmt.Errorf("no title")
+	}
+
+	s := &Study{
+		NCTID:               nctID,
+		Title:               title,
+		Conditions:          make([]string, 0, len(conditions)),
+		Phase:               strings.TrimSpace(phase),
+		EligibilityCriteria: strings.TrimSpace(criteria),
+		EnrollmentTarget:    enrollment,
+		Sites:               sites,
+	}
+	for _, condition := range conditions {
+		if condition = strings.TrimSpace(condition); condition != "" {
+			s.Conditions = append(s.Conditions, condition)
+		}
+	}
+	if s.Sites == nil {
+		s.Sites = make([]Site, 0)
+	}
+
+	var err error
+	if s.Criteria.MinAge, _, err = parseStudyAge(minAge); err != nil {
+		return nil, err
+	}
+	var maxLimited bool
+	if s.Criteria.MaxAge, maxLimited, err = parseStudyAge(maxAge); err != nil {
+		return nil, err
+	}
+	// Participants are as old as their whole years, and a maximum of 0 is no limit
+	if maxLimited && s.Criteria.MaxAge == 0 {
+		s.Criteria.MaxAge = 1
+	}
+	if s.Criteria.MaxAge > 0 && s.Criteria.MaxAge < s.Criteria.MinAge {
+		return nil, fmt.Errorf("maximum age %s is under the minimum age %s", maxAge, minAge)
+	}
+	switch strings.ToLower(strings.TrimSpace(sex)) {
+	case "female":
+		s.Criteria.Sex = "female"
+	case "male":
+		s.Criteria.Sex = "male"
+	}
+	s.Criteria.Conditions = s.Conditions
+
+	// Cities with the most sites first, for the ones kept when the metadata
+	// cannot hold them all
+	sitesPerCity := make(map[string]int)
+	for _, site := range s.Sites {
+		if site.City == "" {
+			continue
+		}
+		if sitesPerCity[site.City] == 0 {
+			s.Criteria.Locations = append(s.Criteria.Locations, site.City)
+		}
+		sitesPerCity[site.City]++
+	}
+	sort.SliceStable(s.Criteria.Locations, func(i, j int) bool {
+		return sitesPerCity[s.Criteria.Locations[i]] > sitesPerCity[s.Criteria.Locations[j]]
+	})
+	return s, nil
+}
+
+// parseStudyAge reads an age like "18 Years" or "6 Months" in whole years,
+// and whether there is a limit at all
+func parseStudyAge(age string) (int, bool, error) {
+	fields := strings.Fields(age)
+	if len(fields) == 0 || strings.EqualFold(fields[0], "N/A") {
+		return 0, false, nil
+	}
+	n, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid age: %s", age)
+	}
+	unit := "years"
+	if len(fields) > 1 {
+		unit = strings.ToLower(fields[1])
+	}
+	switch {
+	case strings.HasPrefix(unit, "year"):
+		return n, true, nil
+	case strings.HasPrefix(unit, "month"):
+		return n / 12, true, nil
+	case strings.HasPrefix(unit, "week"):
+		return n / 52, true, nil
+	case strings.HasPrefix(unit, "day"):
+		return n / 365, true, nil
+	case strings.HasPrefix(unit, "hour"), strings.HasPrefix(unit, "minute"):
+		return 0, true, nil
+	}
+	return 0, false, fmt.Errorf("invalid age: %s", age)
+}
+
+func firstOf(values ...string) string {
+	for _, v := range values {
+		if strings.TrimSpace(v) != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseStudyAge(t *testing.T) {
+	tests := []struct {
+		age         string
+		want        int
+		wantLimited bool
+		wantErr     bool
+	}{
+		{"", 0, false, false},
+		{"N/A", 0, false, false},
+		{"n/a", 0, false, false},
+		{"18 Years", 18, true, false},
+		{"18", 18, true, false},
+		{"1 Year", 1, true, false},
+		{"30 Months", 2, true, false},
+		{"11 Months", 0, true, false},
+		{"104 Weeks", 2, true, false},
+		{"400 Days", 1, true, false},
+		{"12 Hours", 0, true, false},
+		{"30 Minutes", 0, true, false},
+		{"eighteen Years", 0, false, true},
+		{"18 Decades", 0, false, true},
+	}
+
+	for _, tt := range tests {
+		got, limited, err := parseStudyAge(tt.age)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseStudyAge(%q) error = %v, want error %t", tt.age, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want || limited != tt.wantLimited {
+			t.Errorf("parseStudyAge(%q) = %d, %t, want %d, %t", tt.age, got, limited, tt.want, tt.wantLimited)
+		}
+	}
+}
+
+func TestNewStudyAges(t *testing.T) {
+	tests := []struct {
+		name           string
+		minAge, maxAge string
+		wantMin        int
+		wantMax        int
+		wantErr        bool
+	}{
+		{"adults", "18 Years", "65 Years", 18, 65, false},
+		{"no limits", "N/A", "N/A", 0, 0, false},
+		{"no maximum", "18 Years", "", 18, 0, false},
+		{"infants", "", "11 Months", 0, 1, false},
+		{"newborns", "", "28 Days", 0, 1, false},
+		{"one age", "40 Years", "40 Years", 40, 40, false},
+		{"maximum under the minimum", "18 Years", "17 Years", 0, 0, true},
+		{"sub-year maximum over a minimum", "2 Years", "6 Months", 0, 0, true},
+		{"invalid minimum", "adult", "", 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := newStudy("NCT00000001", "Study", nil, "", "", 0, nil, "", tt.minAge, tt.maxAge)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newStudy() error = %v, want error %t", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if s.Criteria.MinAge != tt.wantMin || s.Criteria.MaxAge != tt.wantMax {
+				t.Errorf("ages = %d-%d, want %d-%d", s.Criteria.MinAge, s.Criteria.MaxAge, tt.wantMin, tt.wantMax)
+			}
+		})
+	}
+}
+
+const studyJSON = `{
+  "protocolSection": {
+    "identificationModule": {"nctId": "NCT01234567", "briefTitle": " Aspirin  for\nMigraine ", "officialTitle": "A Study of Aspirin"},
+    "statusModule": {"overallStatus": "RECRUITING"},
+    "conditionsModule": {"conditions": ["Migraine", " ", "Headache "]},
+    "designModule": {"phases": ["EARLY_PHASE1", "PHASE2"], "enrollmentInfo": {"count": 120}},
+    "eligibilityModule": {
+      "eligibilityCriteria": "Inclusion Criteria: ...",
+      "sex": "FEMALE",
+      "minimumAge": "N/A",
+      "maximumAge": "11 Months"
+    },
+    "contactsLocationsModule": {"locations": [
+      {"facility": "UCLA", "city": "Los Angeles", "state": "California", "country": "United States"},
+      {"facility": "UCSF", "city": "San Francisco", "state": "California", "country": "United States"},
+      {"facility": "Cedars-Sinai", "city": "Los Angeles", "state": "California", "country": "United States"},
+      {"facility": "Remote"}
+    ]}
+  }
+}`
+
+const studyXML = `<clinical_study>
+  <id_info><nct_id>NCT07654321</nct_id></id_info>
+  <official_title>An Official Title</official_title>
+  <overall_status>Completed</overall_status>
+  <condition>Asthma</condition>
+  <condition>COPD</condition>
+  <phase>N/A</phase>
+  <enrollment type="Actual"> 40 </enrollment>
+  <eligibility>
+    <criteria><textblock>
+      Inclusion Criteria: ...
+    </textblock></criteria>
+    <gender>All</gender>
+    <minimum_age>6 Months</minimum_age>
+    <maximum_age>N/A</maximum_age>
+  </eligibility>
+  <location><facility><name>Stanford</name><address><city>Palo Alto</city><state>California</state><country>United States</country></address></facility></location>
+  <location><facility><name>Kaiser</name><address><city>Oakland</city><country>United States</country></address></facility></location>
+  <location><facility><name>Highland</name><address><city>Oakland</city><country>United States</country></address></facility></location>
+</clinical_study>`
+
+func TestParseStudy(t *testing.T) {
+	tests := []struct {
+		name      string
+		parse     func([]byte) (*Study, error)
+		data      string
+		want      Study
+		wantSites int
+	}{
+		{"json", parseStudyJSON, studyJSON, Study{
+			NCTID:               "NCT01234567",
+			Title:               "Aspirin for Migraine",
+			Conditions:          []string{"Migraine", "Headache"},
+			Phase:               "Early Phase 1/Phase 2",
+			EligibilityCriteria: "Inclusion Criteria: ...",
+			EnrollmentTarget:    120,
+			Status:              "RECRUITING",
+			Criteria: Criteria{
+				MaxAge:     1,
+				Sex:        "female",
+				Conditions: []string{"Migraine", "Headache"},
+				Locations:  []string{"Los Angeles", "San Francisco"},
+			},
+		}, 4},
+		{"xml", parseStudyXML, studyXML, Study{
+			NCTID:               "NCT07654321",
+			Title:               "An Official Title",
+			Conditions:          []string{"Asthma", "COPD"},
+			EligibilityCriteria: "Inclusion Criteria: ...",
+			EnrollmentTarget:    40,
+			Status:              "Completed",
+			Criteria: Criteria{
+				Conditions: []string{"Asthma", "COPD"},
+				Locations:  []string{"Oakland", "Palo Alto"},
+			},
+		}, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.parse([]byte(tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got.Sites) != tt.wantSites {
+				t.Errorf("%d sites, want %d", len(got.Sites), tt.wantSites)
+			}
+			got.Sites = nil
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("study = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseStudyErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		parse func([]byte) (*Study, error)
+		data  string
+	}{
+		{"json syntax", parseStudyJSON, `{"protocolSection": `},
+		{"json without an NCT ID", parseStudyJSON, `{"protocolSection": {"identificationModule": {"briefTitle": "Study"}}}`},
+		{"json without a title", parseStudyJSON, `{"protocolSection": {"identificationModule": {"nctId": "NCT01234567"}}}`},
+		{"json with an inverted age range", parseStudyJSON, strings.Replace(studyJSON, `"N/A"`, `"2 Years"`, 1)},
+		{"xml syntax", parseStudyXML, `<clinical_study>`},
+		{"xml with an invalid enrollment", parseStudyXML, strings.Replace(studyXML, " 40 ", "forty", 1)},
+		{"xml with an invalid age", parseStudyXML, strings.Replace(studyXML, "6 Months", "6 Moons", 1)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.parse([]byte(tt.data)); err == nil {
+				t.Error("no error")
+			}
+		})
+	}
+}
+
+func TestStudyFitsMetadata(t *testing.T) {
+	many := func(format string, n int) []string {
+		values := make([]string, n)
+		for i := range values {
+			values[i] = fmt.Sprintf(format, i)
+		}
+		return values
+	}
+	sites := func(cities []string) []Site {
+		s := make([]Site, 0, len(cities))
+		for _, city := range cities {
+			s = append(s, Site{City: city})
+		}
+		return s
+	}
+
+	tests := []struct {
+		name           string
+		conditions     []string
+		cities         []string
+		wantConditions int // kept in the metadata, -1 for fewer than all
+		wantLocations  int
+	}{
+		{"fits", many("Condition %d", 3), many("City %d", 3), 3, 3},
+		{"many conditions", many("A Rather Long Condition Name %d", 100), many("City %d", 3), -1, 3},
+		{"many locations", many("Condition %d", 3), many("City %d", 200), 3, -1},
+		{"many of both", many("A Rather Long Condition Name %d", 100), many("A Rather Long City Name %d", 100), -1, -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			study, err := newStudy("NCT01234567", "Study", tt.conditions, "Phase 2", "", 100, sites(tt.cities), "", "18 Years", "65 Years")
+			if err != nil {
+				t.Fatal(err)
+			}
+			metadata := newMetadata(AssetTrial)
+			metadata[metadataSponsor] = "Sponsor"
+			study.AddTo(metadata)
+			study.Criteria.AddTo(metadata)
+			fitLists(metadata, metadataConditions, metadataLocations)
+
+			if err := validateAsset(study.AssetName(), metadata); err != nil {
+				t.Fatalf("metadata of %d characters: %s", metadataLength(metadata), err)
+			}
+			for _, l := range []struct {
+				key  string
+				all  []string
+				want int
+			}{
+				{metadataConditions, tt.conditions, tt.wantConditions},
+				{metadataLocations, tt.cities, tt.wantLocations},
+			} {
+				kept := list(metadata, l.key)
+				if len(kept) == 0 || kept[0] != l.all[0] {
+					t.Errorf("%s kept %v, want the first %s", l.key, kept, l.all[0])
+				}
+				if !reflect.DeepEqual(kept, l.all[:len(kept)]) {
+					t.Errorf("%s kept %v, not the first values", l.key, kept)
+				}
+				if l.want >= 0 && len(kept) != l.want || l.want < 0 && len(kept) == len(l.all) {
+					t.Errorf("%s kept %d of %d values, want %d", l.key, len(kept), len(l.all), l.want)
+				}
+			}
+		})
+	}
+}
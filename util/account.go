@@ -0,0 +1,27 @@
+package util
+
+import (
+	sdk "github.com/bitmark-inc/bitmark-sdk-go"
+	"github.com/bitmark-inc/bitmark-sdk-go/account"
+)
+
+// NewAccount creates a new bitmark account. When a seed is set the account
+// is derived from the seeded generator, otherwise it comes from account.New.
+func NewAccount() (account.Account, error) {
+	if !seeded {
+		return account.New()
+	}
+
+	// Same layout as account.New: 128 random bits extended to 132 bits
+	// with the network encoded in the last nibble
+	seed := RandBytes(16)
+	seed = append(seed, seed[15]&0xf0)
+
+	mode := seed[0]&0x80 | seed[1]&0x40 | seed[2]&0x20 | seed[3]&0x10
+	if sdk.GetNetwork() == sdk.Testnet {
+		mode = mode ^ 0xf0
+	}
+	seed[15] = mode | seed[15]&0x0f
+
+	return account.NewAccountV2(seed)
+}
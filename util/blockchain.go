@@ -1,153 +1,90 @@
 package util
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
-	"sync"
+	"sort"
+	"strings"
 	"time"
 
-	"github.com/bitmark-inc/bitmark-sdk-go/bitmark"
-	"github.com/bitmark-inc/bitmark-sdk-go/tx"
+	"github.com/bitmark-inc/ct-match/ledger"
 )
 
-// func apiEndpoint(network string) string {
-// 	if network == "livenet" {
-// 		return "https://api.bitmark.com"
-// 	} else {
-// 		return "https://api.test.bitmark.com"
-// 	}
-// }
+var errRequestTimeout = errors.New("ledger request timed out")
 
-func isTXConfirmed(txID string) (bool, error) {
-	result, err := tx.Get(txID)
-	return result.Status == "confirmed", err
+// ConfirmationError reports the ids that were not confirmed when waiting stopped
+type ConfirmationError struct {
+	Err     error            // why waiting stopped
+	Pending []string         // still unconfirmed on the last check
+	Failed  map[string]error // the last lookup of these ids failed
 }
 
-func isTXsConfirmed(txs []string) bool {
-	var wg sync.WaitGroup
-	isConfirmedChan := make(chan bool, len(txs))
-
-	wg.Add(len(txs))
-	for _, tx := range txs {
-		go func(tx string) {
-			defer wg.Done()
-			isConfirmed, _ := isTXConfirmed(tx)
-			isConfirmedChan <- isConfirmed
-		}(tx)
+func (e *ConfirmationError) Error() string {
+	failed := make([]string, 0, len(e.Failed))
+	for id, err := range e.Failed {
+		failed = append(failed, fmt.Sprintf("%s (%v)", id, err))
 	}
+	sort.Strings(failed)
 
-	wg.Wait()
-
-	isConfirmed := true
-	for {
-		if len(isConfirmedChan) == 0 {
-			return isConfirmed
-		}
-
-		isConfirmed, ok := <-isConfirmedChan
-		if !ok {
-			return isConfirmed
-		}
-		if isConfirmed == false {
-			close(isConfirmedChan)
-			return false
-		}
-	}
+	return fmt.Sprintf("stopped waiting for confirmations: %v, pending: [%s], failed: [%s]",
+		e.Err, strings.Join(e.Pending, ", "), strings.Join(failed, ", "))
 }
 
-func WaitForConfirmation(tx string) error {
-	fmt.Println("Waiting for confirmations")
-	for {
-		confirmed, err := isTXConfirmed(tx)
-		if err != nil {
-			return err
-		}
-
-		if confirmed {
-			fmt.Println("Transaction is confirmed")
-			return nil
-		}
-
-		time.Sleep(1 * time.Second)
-	}
+// Confirmer looks up whether bitmarks are confirmed, and bounds how long
+// to back off between rounds and wait for them in all
+type Confirmer struct {
+	ledger         ledger.Ledger
+	RequestTimeout time.Duration // for each ledger lookup
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	MaxWait        time.Duration // without any progress
 }
 
-func WaitForConfirmations(txs []string) {
-	fmt.Println("Waiting for confirmations")
-	for {
-		confirmed := isTXsConfirmed(txs)
-
-		if confirmed {
-			fmt.Println("Transactions are confirmed")
-			return
-		}
-
-		time.Sleep(1 * time.Second)
+func NewConfirmer(l ledger.Ledger) *Confirmer {
+	return &Confirmer{
+		ledger:         l,
+		RequestTimeout: 10 * time.Second,
+		InitialBackoff: 1 * time.Second,
+		MaxBackoff:     30 * time.Second,
+		MaxWait:        10 * time.Minute,
 	}
 }
 
-func isBitmarkConfirmed(bitmarkID string) (bool, error) {
-	result, err := bitmark.Get(bitmarkID)
-	if err != nil {
-		fmt.Printf("Get bitmark id: %s, error: %v", bitmarkID, err)
-		return false, err
-	}
-	return result.Status == "settled", nil
-}
-
-func filterUnconfirmedBitmarks(bitmarks []string) []string {
-	var wg sync.WaitGroup
-	bitmarkChan := make(chan *bitmark.Bitmark, len(bitmarks))
-
-	wg.Add(len(bitmarks))
-	for _, bitmarkID := range bitmarks {
-		go func(bitmarkID string) {
-			defer wg.Done()
-			bitmarkInfo, err := bitmark.Get(bitmarkID)
-			if err != nil {
-				log.Println(err)
-			}
-
-			bitmarkChan <- bitmarkInfo
-		}(bitmarkID)
-	}
-
-	wg.Wait()
-
-	filterredBitmarkID := make([]string, 0)
-	for {
-		if len(bitmarkChan) == 0 {
-			break
-		}
-
-		b, ok := <-bitmarkChan
-		if !ok {
-			return bitmarks
+// Settled reports whether a bitmark is confirmed as owned by owner with no
+// pending offer. A bitmark the ledger does not know yet is not settled. The
+// lookup fails once it takes longer than RequestTimeout.
+func (c *Confirmer) Settled(ctx context.Context, bitmarkID, owner string) (bool, error) {
+	return c.lookup(ctx, bitmarkID, func(id string) (bool, error) {
+		b, err := c.ledger.GetBitmark(id)
+		if err == ledger.ErrBitmarkNotFound {
+			return false, nil
 		}
-
-		if b == nil {
-			return bitmarks
-		}
-
-		if b.Status != "settled" {
-			filterredBitmarkID = append(filterredBitmarkID, b.ID)
+		if err != nil {
+			return false, err
 		}
-	}
-
-	return filterredBitmarkID
+		return b.Status == "settled" && b.Owner == owner && b.Offer == nil, nil
+	})
 }
 
-func WaitForBitmarkConfirmations(bitmarks []string) {
-	fmt.Println("Waiting for bitmarks's confirmations")
-	filterredBitmarkIDs := bitmarks
-	for {
-		filterredBitmarkIDs := filterUnconfirmedBitmarks(filterredBitmarkIDs)
-
-		if len(filterredBitmarkIDs) == 0 {
-			fmt.Println("Bitmarks are confirmed")
-			return
-		}
+func (c *Confirmer) lookup(ctx context.Context, id string, isConfirmed func(string) (bool, error)) (bool, error) {
+	type result struct {
+		confirmed bool
+		err       error
+	}
 
-		time.Sleep(10 * time.Second)
+	done := make(chan result, 1)
+	go func() {
+		confirmed, err := isConfirmed(id)
+		done <- result{confirmed, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.confirmed, r.err
+	case <-time.After(c.RequestTimeout):
+		return false, errRequestTimeout
+	case <-ctx.Done():
+		return false, ctx.Err()
 	}
 }
@@ -12,16 +12,38 @@ const (
 	letterIdxMax  = 63 / letterIdxBits   // # of letter indices fitting in 63 bits
 )
 
-var src = rand.NewSource(time.Now().UnixNano())
-var ran = rand.New(src)
+var ran = rand.New(rand.NewSource(time.Now().UnixNano()))
+var seeded = false
+var baseSeed int64
+
+// SetRand injects the random number generator behind every random decision
+func SetRand(r *rand.Rand) {
+	ran = r
+}
+
+// Seed makes the simulation reproducible: the same seed replays the same
+// decisions and derives the same participant accounts
+func Seed(seed int64) {
+	SetRand(rand.New(rand.NewSource(seed)))
+	seeded = true
+	baseSeed = seed
+}
+
+// Reseed restarts a seeded generator at the given step, so that a resumed
+// simulation draws the same numbers from that step on as an uninterrupted one
+func Reseed(step int64) {
+	if seeded {
+		SetRand(rand.New(rand.NewSource(baseSeed ^ step<<32)))
+	}
+}
 
 func RandStringBytesMaskImprSrc(n int) string {
 
 	b := make([]byte, n)
-	// A src.Int63() generates 63 random bits, enough for letterIdxMax characters!
-	for i, cache, remain := n-1, src.Int63(), letterIdxMax; i >= 0; {
+	// A ran.Int63() generates 63 random bits, enough for letterIdxMax characters!
+	for i, cache, remain := n-1, ran.Int63(), letterIdxMax; i >= 0; {
 		if remain == 0 {
-			cache, remain = src.Int63(), letterIdxMax
+			cache, remain = ran.Int63(), letterIdxMax
 		}
 		if idx := int(cache & letterIdxMask); idx < len(letterBytes) {
 			b[i] = letterBytes[idx]
@@ -34,6 +56,12 @@ func RandStringBytesMaskImprSrc(n int) string {
 	return string(b)
 }
 
+func RandBytes(n int) []byte {
+	b := make([]byte, n)
+	ran.Read(b)
+	return b
+}
+
 func RandWithProb(prob float64) bool {
 	return ran.Float64() <= prob
 }
@@ -43,6 +71,6 @@ func RandWithRange(min, max int) int {
 }
 
 func RandInPool(pool []string) string {
-	index := RandWithRange(0, len(pool)-1)
+	index := RandWithRange(0, len(pool))
 	return pool[index]
 }
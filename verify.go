@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/bitmark-inc/bitmark-sdk-go/account"
+	"github.com/bitmark-inc/bitmark-sdk-go/asset"
+	"github.com/bitmark-inc/bitmark-sdk-go/bitmark"
+	"github.com/bitmark-inc/ct-match/event"
+	"github.com/bitmark-inc/ct-match/ledger"
+)
+
+// Verifier checks an offer against the identity registry before a role
+// accepts it, the way a real app protects its user against phishing
+type Verifier struct {
+	ledger     ledger.Ledger
+	identities map[string]string // account -> name
+	roles      map[string]string // account -> role
+}
+
+func newVerifier(l ledger.Ledger, identities map[string]string) *Verifier {
+	return &Verifier{
+		ledger:     l,
+		identities: identities,
+		roles:      make(map[string]string),
+	}
+}
+
+// Verify returns why the offer of a consent or health data bitmark of
+// the consent is suspicious, or an empty string if it is genuine
+func (v *Verifier) Verify(c *Consent, sender string, b *bitmark.Bitmark) (string, error) {
+	if b.Offer == nil || b.Offer.From != sender {
+		return "not offered by " + v.name(sender), nil
+	}
+	if _, ok := v.roles[sender]; !ok {
+		return "offered by unknown account " + sender, nil
+	}
+
+	a, err := v.ledger.GetAsset(b.AssetID)
+	if err != nil {
+		return "", err
+	}
+
+	var reason, issuer string
+	if b.ID == c.ID {
+		reason, issuer = v.trialAsset(c, a), c.MatchingService
+	} else {
+		reason, issuer = v.healthDataAsset(c, a), c.Participant
+	}
+	if reason != "" {
+		return reason, nil
+	}
+
+	return v.provenance(b, issuer, sender)
+}
+
+// trialAsset checks that a consent refers to a trial registered by its sponsor
+func (v *Verifier) trialAsset(c *Consent, a *asset.Asset) string {
+	switch {
+	case a.ID != c.TrialID:
+		return "asset is not the trial " + c.Trial
+	case a.Registrant != c.Sponsor || v.roles[a.Registrant] != event.RoleSponsor:
+		return "trial not registered by its sponsor " + v.name(c.Sponsor)
+	case a.Metadata[metadataType] != AssetTrial:
+		return "asset type is not " + AssetTrial
+	}
+	if err := checkAsset(a); err != nil {
+		return err.Error()
+	}
+	if a.Metadata[metadataSponsor] != v.identities[a.Registrant] {
+		return "sponsor of the metadata is not the registrant"
+	}
+	return ""
+}
+
+// healthDataAsset checks that health data was registered by the participant for the consent
+func (v *Verifier) healthDataAsset(c *Consent, a *asset.Asset) string {
+	switch {
+	case a.ID != c.HealthDataAssetID:
+		return "asset is not the health data of the consent"
+	case a.Registrant != c.Participant || v.roles[a.Registrant] != event.RoleParticipant:
+		return "health data not registered by " + v.name(c.Participant)
+	case a.Metadata[metadataType] != AssetHealthData:
+		return "asset type is not " + AssetHealthData
+	}
+	if err := checkAsset(a); err != nil {
+		return err.Error()
+	}
+	if a.Metadata[metadataTrialBitmark] != c.ID {
+		return "health data is for another consent"
+	}
+	return ""
+}
+
+// provenance checks that the bitmark was issued by issuer and only went
+// through known accounts on its way to the sender
+func (v *Verifier) provenance(b *bitmark.Bitmark, issuer, sender string) (string, error) {
+	txs, err := v.ledger.Provenance(b.ID)
+	if err != nil {
+		return "", err
+	}
+
+	if len(txs) == 0 || txs[0].ID != b.ID || txs[0].Owner != issuer {
+		return "not issued by " + v.name(issuer), nil
+	}
+	for _, t := range txs {
+		if _, ok := v.roles[t.Owner]; !ok {
+			return "provenance goes through unknown account " + t.Owner, nil
+		}
+	}
+	if last := txs[len(txs)-1]; last.Owner != sender {
+		return "provenance does not end with " + v.name(sender), nil
+	}
+	return "", nil
+}
+
+func (v *Verifier) name(account string) string {
+	if name, ok := v.identities[account]; ok {
+		return name
+	}
+	return account
+}
+
+// verifyOffer verifies every bitmark offered for a consent. If one is
+// suspicious, all of them are rejected and the rejection is reported.
+func verifyOffer(v *Verifier, l ledger.Ledger, acc account.Account, emit func(event.Event), c *Consent, sender string, bitmarks ...*bitmark.Bitmark) (bool, error) {
+	var reason string
+	var suspicious *bitmark.Bitmark
+	for _, b := range bitmarks {
+		r, err := v.Verify(c, sender, b)
+		if err != nil {
+			return false, err
+		}
+		if r != "" {
+			reason, suspicious = r, b
+			break
+		}
+	}
+	if suspicious == nil {
+		return true, nil
+	}
+
+	for _, b := range bitmarks {
+		if _, err := l.Respond(acc, b, bitmark.Reject); err != nil {
+			return false, fmt.Errorf("reject suspicious bitmark %s: %s", b.ID, err)
+		}
+	}
+
+	e := event.Event{
+		Type:         event.SuspiciousOffer,
+		Counterparty: sender,
+		Participant:  c.Participant,
+		Kind:         event.KindConsent,
+		AssetID:      c.TrialID,
+		Asset:        c.Trial,
+		BitmarkID:    suspicious.ID,
+		ConsentID:    c.ID,
+		TrialID:      c.TrialID,
+		Trial:        c.Trial,
+		Reason:       reason,
+	}
+	if suspicious.ID != c.ID {
+		e.Kind = event.KindHealthData
+		e.AssetID = c.HealthDataAssetID
+		e.Asset = c.HealthData
+	}
+	emit(e)
+
+	return false, nil
+}